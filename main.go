@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	"github.com/52north/admission-webhook-server/pkg/admission/metrics"
 	"github.com/52north/admission-webhook-server/pkg/admission/podnodesselector"
 	"github.com/52north/admission-webhook-server/pkg/admission/podtolerationrestriction"
+	"github.com/52north/admission-webhook-server/pkg/admission/webhookconfig"
 	"github.com/52north/admission-webhook-server/pkg/utils"
 )
 
@@ -16,6 +25,7 @@ const (
 	tlsDir  = `/run/secrets/tls`
 	tlsCert = `tls.crt`
 	tlsKey  = `tls.key`
+	tlsCA   = `ca.crt`
 )
 
 // Port to listen to
@@ -24,25 +34,129 @@ const (
 	listenPort      = ":8443"
 )
 
+// Unix domain socket to serve plain HTTP at as well, if set
+const (
+	ENV_LISTEN_SOCKET = "LISTEN_SOCKET"
+)
+
+// Minimum level of log messages, debug logging includes the patches sent to the apiserver
+const (
+	ENV_LOG_LEVEL = "LOG_LEVEL"
+	logLevel      = "info"
+)
+
+// Serve Prometheus metrics at /metrics if set to "true"
+const (
+	ENV_METRICS_ENABLED = "METRICS_ENABLED"
+)
+
+// Serve the names of the registered handlers at /debug/handlers if set to "true"
+const (
+	ENV_DEBUG_HANDLERS_ENABLED = "DEBUG_HANDLERS_ENABLED"
+)
+
+// Serve the profiling data of net/http/pprof at this address, e.g. localhost:6060, if set
+const (
+	ENV_PPROF_ADDR = "PPROF_ADDR"
+)
+
+// Serve the certificate in these files to clients requesting one of the comma separated names via SNI, e.g. an
+// external DNS name of the webhook, and the default certificate to all others
+const (
+	ENV_SNI_CERT_FILE = "SNI_CERT_FILE"
+	ENV_SNI_KEY_FILE  = "SNI_KEY_FILE"
+	ENV_SNI_NAMES     = "SNI_NAMES"
+)
+
+// Require clients to present a certificate signed by the CA in this file, optionally with one of the comma
+// separated names
+const (
+	ENV_CLIENT_CA_FILE = "CLIENT_CA_FILE"
+	ENV_CLIENT_NAMES   = "CLIENT_NAMES"
+)
+
+// Inject the serving CA into the webhooks of the named MutatingWebhookConfiguration pointing at the service, if set,
+// failing startup if the apiserver does not respond in time
+const (
+	ENV_WEBHOOK_CONFIG_NAME = "WEBHOOK_CONFIG_NAME"
+	ENV_SERVICE_NAME        = "SERVICE_NAME"
+	ENV_SERVICE_NAMESPACE   = "SERVICE_NAMESPACE"
+	ENV_KUBECONFIG          = "KUBECONFIG"
+	injectTimeout           = 30 * time.Second
+)
+
 func main() {
 	cert := filepath.Join(tlsDir, tlsCert)
 	key := filepath.Join(tlsDir, tlsKey)
 
-	mux := http.NewServeMux()
-	ctrl := admit.New()
-	mux.Handle(admit.GetBasePath(), ctrl)
+	level, err := admit.ParseLevel(utils.GetEnvVal(ENV_LOG_LEVEL, logLevel))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts := []admit.Option{admit.WithLogger(admit.NewStdLogger(log.Default(), level))}
+	if utils.GetEnvVal(ENV_METRICS_ENABLED, "false") == "true" {
+		opts = append(opts, admit.WithMetrics(metrics.NewRecorder()))
+	}
+	if utils.GetEnvVal(ENV_DEBUG_HANDLERS_ENABLED, "false") == "true" {
+		opts = append(opts, admit.WithDebugHandlers(true))
+	}
+
+	ctrl := admit.New(opts...)
 	log.Print("Registering handlers...")
 	registerAllHandlers(ctrl)
 
-	// Config server
-	server := &http.Server{
-		Addr:    utils.GetEnvVal(ENV_LISTEN_PORT, listenPort),
-		Handler: mux,
+	// Ready as soon as the serving certificate can be loaded, it is reloaded when rotated
+	tlsConfig, err := admit.NewTLSConfig(cert, key)
+	if err != nil {
+		log.Fatalf("Could not load TLS certificate: %v", err)
+	}
+	if names := splitList(utils.GetEnvVal(ENV_SNI_NAMES, "")); len(names) > 0 {
+		sniCert, sniKey := utils.GetEnvVal(ENV_SNI_CERT_FILE, ""), utils.GetEnvVal(ENV_SNI_KEY_FILE, "")
+		if err := admit.AddSNICertificate(tlsConfig, sniCert, sniKey, names...); err != nil {
+			log.Fatalf("Could not load SNI certificate: %v", err)
+		}
+	}
+	if caFile := utils.GetEnvVal(ENV_CLIENT_CA_FILE, ""); caFile != "" {
+		names := splitList(utils.GetEnvVal(ENV_CLIENT_NAMES, ""))
+		if err := admit.RequireClientCert(tlsConfig, caFile, names...); err != nil {
+			log.Fatalf("Could not load client CA: %v", err)
+		}
+	}
+	if name := utils.GetEnvVal(ENV_WEBHOOK_CONFIG_NAME, ""); name != "" {
+		if err := injectCABundle(name); err != nil {
+			log.Fatalf("Could not inject CA bundle: %v", err)
+		}
+	}
+	ctrl.SetReady(true)
+
+	// Serve until terminated
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		ctrl.SetReady(false)
+	}()
+
+	if addr := utils.GetEnvVal(ENV_PPROF_ADDR, ""); addr != "" {
+		go func() {
+			log.Printf("Serving profiling data at %s", addr)
+			if err := http.ListenAndServe(addr, admit.PprofHandler()); err != nil {
+				log.Printf("Could not serve profiling data: %v", err)
+			}
+		}()
 	}
 
-	// Serve
 	log.Print("Starting admission webhook server...")
-	log.Fatal(server.ListenAndServeTLS(cert, key))
+	serverOpts := []admit.ServerOption{admit.WithTLSConfig(tlsConfig)}
+	if socket := utils.GetEnvVal(ENV_LISTEN_SOCKET, ""); socket != "" {
+		serverOpts = append(serverOpts, admit.WithUnixSocket(socket))
+	}
+	server := admit.NewServer(ctrl, serverOpts...)
+	if err := server.ListenAndServeTLS(ctx, utils.GetEnvVal(ENV_LISTEN_PORT, listenPort), "", ""); err != nil {
+		log.Fatal(err)
+	}
+	log.Print("Admission webhook server stopped")
 }
 
 // Register all admission handlers
@@ -50,3 +164,41 @@ func registerAllHandlers(ctrl admit.AdmissionController) {
 	podnodesselector.Register(ctrl)
 	podtolerationrestriction.Register(ctrl)
 }
+
+// Split a comma separated list, trimming whitespace and dropping empty entries
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Inject the serving CA into the named webhook configuration, failing if the service is not configured as no webhook
+// would match it
+func injectCABundle(name string) error {
+	serviceName, serviceNamespace := utils.GetEnvVal(ENV_SERVICE_NAME, ""), utils.GetEnvVal(ENV_SERVICE_NAMESPACE, "")
+	if serviceName == "" || serviceNamespace == "" {
+		return fmt.Errorf("%s and %s must be set along with %s", ENV_SERVICE_NAME, ENV_SERVICE_NAMESPACE, ENV_WEBHOOK_CONFIG_NAME)
+	}
+	caBundle, err := os.ReadFile(filepath.Join(tlsDir, tlsCA))
+	if err != nil {
+		return err
+	}
+	client, err := webhookconfig.NewClient(utils.GetEnvVal(ENV_KUBECONFIG, ""))
+	if err != nil {
+		return err
+	}
+	log.Printf("Injecting CA bundle into %s...", name)
+	ctx, cancel := context.WithTimeout(context.Background(), injectTimeout)
+	defer cancel()
+	if err := webhookconfig.InjectCABundle(ctx, client, name, serviceName, serviceNamespace, caBundle); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("timed out after %s: %v", injectTimeout, err)
+		}
+		return err
+	}
+	return nil
+}
@@ -4,18 +4,33 @@
 package admit
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/52north/admission-webhook-server/pkg/utils"
 	admissionV1 "k8s.io/api/admission/v1"
+	admissionV1beta1 "k8s.io/api/admission/v1beta1"
+	admissionregistrationV1 "k8s.io/api/admissionregistration/v1"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilRuntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
 )
 
 // Query base path
@@ -24,14 +39,38 @@ const (
 	basePath      = "/mutate"
 )
 
+// Query validation path
+const (
+	ENV_VALIDATE_PATH = "VALIDATE_PATH"
+	validatePath      = "/validate"
+)
+
+// Request body size limit, matching the limit of the apiserver
+const (
+	ENV_MAX_BODY_BYTES = "MAX_BODY_BYTES"
+	maxBodyBytes       = 3 << 20
+)
+
+// Number of bytes of malformed request bodies that are logged
+const (
+	snippetBytes = 256
+)
+
 const (
 	jsonContentType = `application/json`
 )
 
 var (
-	UniversalDeserializer = serializer.NewCodecFactory(runtime.NewScheme()).UniversalDeserializer()
+	scheme                = runtime.NewScheme()
+	UniversalDeserializer = serializer.NewCodecFactory(scheme).UniversalDeserializer()
 )
 
+func init() {
+	// Both AdmissionReview versions are accepted, later ones are answered in the version they were sent in.
+	utilRuntime.Must(admissionV1.AddToScheme(scheme))
+	utilRuntime.Must(admissionV1beta1.AddToScheme(scheme))
+}
+
 // patchOperation is an operation of a JSON patch, see https://tools.ietf.org/html/rfc6902 .
 type PatchOperation struct {
 	Op    string      `json:"op"`
@@ -40,138 +79,767 @@ type PatchOperation struct {
 }
 
 // admitFunc is a callback for admission controller logic. Given an AdmissionRequest, it returns the sequence of patch
-// operations to be applied in case of success, or the error that will be shown when the operation is rejected.
+// operations to be applied in case of success, or the error that will be shown when the operation is rejected. If any
+// registered AdmitFunc returns an error, the whole review is denied and no patches are emitted.
+//
+// Requests may be dry-run (see AdmissionRequest.DryRun), handlers with side effects must check for it or be registered
+// with SkipDryRun.
 type AdmitFunc func(*admissionV1.AdmissionRequest) ([]PatchOperation, error)
 
-// Get server base path
+// AdmitFuncCtx is an AdmitFunc that also receives the context of the webhook request, which is canceled if the
+// client goes away.
+type AdmitFuncCtx func(context.Context, *admissionV1.AdmissionRequest) ([]PatchOperation, error)
+
+// Result is the outcome of a successful HandlerFunc.
+type Result struct {
+	// Patches are the patch operations to be applied to the object.
+	Patches []PatchOperation
+	// Warnings are non-fatal messages that are returned to the client, e.g. shown by kubectl.
+	Warnings []string
+	// AuditAnnotations are recorded in the audit log of the apiserver, which prefixes their keys with the name of the
+	// webhook. Keys therefore must be the name part of a qualified name, i.e. not contain a "/".
+	AuditAnnotations map[string]string
+	// Patch is a raw patch of PatchType returned instead of Patches, e.g. a strategic merge patch for apiservers that
+	// accept one. It cannot be combined with the patches of other handlers.
+	Patch []byte
+	// PatchType is the type of Patch, defaulting to JSONPatch.
+	PatchType admissionV1.PatchType
+}
+
+// HandlerFunc is a callback for admission controller logic like AdmitFuncCtx, but returning a Result that can carry
+// warnings besides the patch operations. A nil Result is treated like an empty one.
+type HandlerFunc func(context.Context, *admissionV1.AdmissionRequest) (*Result, error)
+
+// ValidateFunc is a callback for validating admission controller logic. Given an AdmissionRequest, it returns nil if
+// the object is allowed, or the error that will be shown when the operation is rejected.
+type ValidateFunc func(*admissionV1.AdmissionRequest) error
+
+// WarningValidateFunc is a callback for validating admission controller logic like ValidateFunc, but also returning
+// advisory warnings, e.g. about deprecated fields. The warnings are returned to the client whether the object is
+// allowed or not.
+type WarningValidateFunc func(*admissionV1.AdmissionRequest) ([]string, error)
+
+// handlerFunc adapts the AdmitFunc to a HandlerFunc ignoring the context.
+func (adm AdmitFunc) handlerFunc() HandlerFunc {
+	return AdmitFuncCtx(func(_ context.Context, req *admissionV1.AdmissionRequest) ([]PatchOperation, error) {
+		return adm(req)
+	}).handlerFunc()
+}
+
+// handlerFunc adapts the AdmitFuncCtx to a HandlerFunc.
+func (adm AdmitFuncCtx) handlerFunc() HandlerFunc {
+	return func(ctx context.Context, req *admissionV1.AdmissionRequest) (*Result, error) {
+		patches, err := adm(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Patches: patches}, nil
+	}
+}
+
+// handlerFunc adapts the ValidateFunc to a HandlerFunc ignoring the context.
+func (v ValidateFunc) handlerFunc() HandlerFunc {
+	return func(_ context.Context, req *admissionV1.AdmissionRequest) (*Result, error) {
+		return nil, v(req)
+	}
+}
+
+// handlerFunc adapts the WarningValidateFunc to a HandlerFunc ignoring the context.
+func (v WarningValidateFunc) handlerFunc() HandlerFunc {
+	return func(_ context.Context, req *admissionV1.AdmissionRequest) (*Result, error) {
+		warnings, err := v(req)
+		return &Result{Warnings: warnings}, err
+	}
+}
+
+// Get server base path, normalized to a single leading and no trailing slash
 func GetBasePath() string {
-	return utils.GetEnvVal(ENV_BASE_PATH, basePath)
+	return normalizePath(utils.GetEnvVal(ENV_BASE_PATH, basePath))
+}
+
+// Get server validation path, normalized to a single leading and no trailing slash
+func GetValidatePath() string {
+	return normalizePath(utils.GetEnvVal(ENV_VALIDATE_PATH, validatePath))
+}
+
+// normalizePath cleans the URL path and makes it absolute, e.g. both mutate and //mutate/ become /mutate.
+func normalizePath(p string) string {
+	return path.Clean("/" + p)
 }
 
-// isKubeNamespace checks if the given namespace is a Kubernetes-owned namespace.
-func isKubeNamespace(ns string) bool {
-	return ns == metaV1.NamespacePublic || ns == metaV1.NamespaceSystem
+// Get request body size limit, falling back to the default if not set to a positive number
+func GetMaxBodyBytes() int64 {
+	if n, err := strconv.ParseInt(utils.GetEnvVal(ENV_MAX_BODY_BYTES, ""), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return maxBodyBytes
 }
 
 type AdmissionController interface {
 	http.Handler
-	Register(name string, adm AdmitFunc)
+	Register(name string, adm AdmitFunc, opts ...HandlerOption)
+	RegisterCtx(name string, adm AdmitFuncCtx, opts ...HandlerOption)
+	RegisterForGVK(name string, gvk metaV1.GroupVersionKind, adm AdmitFunc, opts ...HandlerOption)
+	RegisterForOps(name string, ops []admissionV1.Operation, adm AdmitFunc, opts ...HandlerOption)
+	RegisterForResource(name string, resource, subResource string, adm AdmitFunc, opts ...HandlerOption)
+	RegisterPod(name string, adm PodAdmitFunc, opts ...HandlerOption)
+	RegisterWithPriority(name string, priority int, adm AdmitFunc, opts ...HandlerOption)
+	RegisterWithSelector(name string, sel labels.Selector, adm AdmitFunc, opts ...HandlerOption)
+	RegisterWithAllowedPaths(name string, prefixes []string, adm AdmitFunc, opts ...HandlerOption)
+	RegisterWithSchema(name string, schema []byte, adm AdmitFunc, opts ...HandlerOption)
+	RegisterHandler(name string, h HandlerFunc, opts ...HandlerOption)
+	Handle(path, name string, adm AdmitFunc, opts ...HandlerOption)
+	Paths() []string
+	Handlers() []string
+	RegisterValidator(name string, v ValidateFunc)
+	RegisterValidatorWithWarnings(name string, v WarningValidateFunc)
+	Unregister(name string)
+	Reset()
+	SetReady(ready bool)
+	Use(mw func(http.Handler) http.Handler)
 }
 
 type admissionController struct {
-	admitFuncs []AdmitFunc
+	// mu guards handlers, validators and middleware, which may be registered while requests are served. The slices are
+	// never modified in place, so requests keep using the handlers registered when they arrived.
+	mu sync.RWMutex
+	// handlers holds the registered handlers by the path they are served at.
+	handlers   map[string][]*handler
+	validators []*handler
+	mux        *http.ServeMux
+	// routes holds the paths served by the mux, which panics on registering a path twice.
+	routes sets.Set[string]
+	// chain is the mux wrapped by the middleware, which is guarded by mu. The chain is replaced as a whole when adding
+	// middleware, so requests are served without locking.
+	chain        atomic.Pointer[http.Handler]
+	middleware   []func(http.Handler) http.Handler
+	ready        atomic.Bool
+	metrics      MetricsRecorder
+	logger       Logger
+	basePath     string
+	validatePath string
+	maxBodyBytes int64
+	// snippetBytes is the number of bytes of malformed request bodies that are logged.
+	snippetBytes int
+	exempt       sets.Set[string]
+	include      sets.Set[string]
+	// handleClusterScoped enables running handlers for requests of cluster-scoped objects.
+	handleClusterScoped bool
+	// alwaysAllow holds the kinds requests are allowed for without running any handler.
+	alwaysAllow sets.Set[metaV1.GroupVersionKind]
+	// validatePatches enables applying the patches to the object before responding.
+	validatePatches bool
+	// panicPolicy decides how requests with a panicking handler are answered.
+	panicPolicy admissionregistrationV1.FailurePolicyType
+	// handlerTimeout limits the time each handler may take if positive, timeoutPolicy decides how requests with a
+	// timed out handler are answered.
+	handlerTimeout time.Duration
+	timeoutPolicy  admissionregistrationV1.FailurePolicyType
+	// requireHandlers fails requests to paths without registered handlers instead of admitting them.
+	requireHandlers bool
+	// validatorsUsed is set once a validator was registered, so the validation path requires handlers only from then.
+	validatorsUsed atomic.Bool
+	// conflictPolicy decides how patch operations of handlers with the same op and path are treated.
+	conflictPolicy ConflictPolicy
+	// kubeClient is passed to handlers through their context if set.
+	kubeClient kubernetes.Interface
+	// listers are passed to handlers through their context if set. The controller is not ready before they synced.
+	listers *listers
+	// interceptors are run on each response review before it is marshaled.
+	interceptors []func(*admissionV1.AdmissionReview)
+	// authToken is the bearer token admission requests have to carry if set.
+	authToken string
+	// rateLimiter limits the rate of admission requests if set.
+	rateLimiter *rateLimiter
+	// tracer starts the spans of admission requests and handlers.
+	tracer Tracer
+	// sortPatches orders the patch operations by path before responding.
+	sortPatches bool
+	// maxPatchOps limits the number of patch operations of a response if positive.
+	maxPatchOps int
+	// dispatchMode decides which of the matching handlers are run.
+	dispatchMode DispatchMode
+	// pprof enables serving the profiling data of net/http/pprof.
+	pprof bool
+	// debugHandlers enables serving the list of registered handlers.
+	debugHandlers bool
+	// marshalPatch encodes the patch operations of responses.
+	marshalPatch func(interface{}) ([]byte, error)
+	// slowThreshold is the processing time above which requests are logged as slow, if positive.
+	slowThreshold time.Duration
+	// enforcement decides whether denials of handlers take effect.
+	enforcement EnforcementMode
+	// strictDecoding rejects reviews with unknown fields.
+	strictDecoding bool
+	// mutatedAnnotation is the key of the audit annotation recording whether the object was patched, if set.
+	mutatedAnnotation string
+	// contextualDeny prefixes deny messages with the kind, namespace and name of the object.
+	contextualDeny bool
+}
+
+// New creates an AdmissionController serving mutations at the base path, validations at the validation path and the
+// /healthz and /readyz probes.
+func New(opts ...Option) AdmissionController {
+	ac := &admissionController{
+		handlers:            map[string][]*handler{},
+		mux:                 http.NewServeMux(),
+		routes:              sets.New[string](),
+		metrics:             nopMetricsRecorder{},
+		logger:              NewStdLogger(log.Default(), LevelInfo),
+		basePath:            utils.GetEnvVal(ENV_BASE_PATH, basePath),
+		validatePath:        utils.GetEnvVal(ENV_VALIDATE_PATH, validatePath),
+		maxBodyBytes:        GetMaxBodyBytes(),
+		snippetBytes:        snippetBytes,
+		handleClusterScoped: true,
+		exempt:              sets.New(append(kubeNamespaces, GetExemptNamespaces()...)...),
+		panicPolicy:         admissionregistrationV1.Fail,
+		timeoutPolicy:       admissionregistrationV1.Fail,
+		tracer:              nopTracer{},
+		marshalPatch:        json.Marshal,
+	}
+	var chain http.Handler = ac.mux
+	ac.chain.Store(&chain)
+	for _, opt := range opts {
+		opt(ac)
+	}
+	ac.basePath = ac.cleanPath(ac.basePath)
+	ac.validatePath = ac.cleanPath(ac.validatePath)
+	// Paths configured to clash are served by the first of them, instead of making New panic. The probes and
+	// diagnostics come first, so a base path clashing with them serves no handlers rather than breaking the probes.
+	serve := func(path string, h http.Handler) {
+		if err := ac.serve(path, h); err != nil {
+			ac.logger.Error("could not serve path", err)
+		}
+	}
+	serve(healthzPath, http.HandlerFunc(ac.serveHealthz))
+	serve(readyzPath, http.HandlerFunc(ac.serveReadyz))
+	if ac.debugHandlers {
+		serve(debugHandlersPath, http.HandlerFunc(ac.serveDebugHandlers))
+	}
+	if ac.pprof {
+		serve(pprofPath, PprofHandler())
+	}
+	if h, ok := ac.metrics.(http.Handler); ok {
+		serve(metricsPath, h)
+	}
+	if err := ac.route(ac.basePath); err != nil {
+		ac.logger.Error("could not serve mutations", err)
+	}
+	serve(ac.validatePath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ac.serveAdmitFunc(w, r, ac.registeredValidators(), true)
+	}))
+	return ac
+}
+
+// ServeHTTP passes the request through the middleware and dispatches it to the admission or probe handler matching
+// its path.
+func (ac *admissionController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*ac.chain.Load()).ServeHTTP(w, r)
+}
+
+// Use adds a middleware wrapping the handling of all requests, including the routing by path. The middleware added
+// first is the outermost one. Middleware may be added while requests are served, which are passed through the
+// middleware added when they arrived.
+func (ac *admissionController) Use(mw func(http.Handler) http.Handler) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.middleware = append(ac.middleware, mw)
+	var h http.Handler = ac.mux
+	for i := len(ac.middleware) - 1; i >= 0; i-- {
+		h = ac.middleware[i](h)
+	}
+	ac.chain.Store(&h)
+}
+
+// Register registers a new AdmitFunc at this controller that is run for requests of any kind.
+func (ac *admissionController) Register(name string, adm AdmitFunc, opts ...HandlerOption) {
+	ac.register(&handler{name: name, handle: adm.handlerFunc()}, opts)
+}
+
+// RegisterCtx registers a new AdmitFuncCtx at this controller that is run for requests of any kind.
+func (ac *admissionController) RegisterCtx(name string, adm AdmitFuncCtx, opts ...HandlerOption) {
+	ac.register(&handler{name: name, handle: adm.handlerFunc()}, opts)
+}
+
+// RegisterForGVK registers a new AdmitFunc at this controller that is only run for requests of the given kind.
+func (ac *admissionController) RegisterForGVK(name string, gvk metaV1.GroupVersionKind, adm AdmitFunc, opts ...HandlerOption) {
+	ac.register(&handler{name: name, handle: adm.handlerFunc(), gvk: &gvk}, opts)
+}
+
+// RegisterForOps registers a new AdmitFunc at this controller that is only run for requests of the given operations.
+func (ac *admissionController) RegisterForOps(name string, ops []admissionV1.Operation, adm AdmitFunc, opts ...HandlerOption) {
+	ac.register(&handler{name: name, handle: adm.handlerFunc()}, append(opts, ForOperations(ops...)))
+}
+
+// RegisterForResource registers a new AdmitFunc at this controller that is only run for requests of the given resource
+// and subresource, see ForResource.
+func (ac *admissionController) RegisterForResource(name string, resource, subResource string, adm AdmitFunc, opts ...HandlerOption) {
+	ac.register(&handler{name: name, handle: adm.handlerFunc()}, append(opts, ForResource(resource, subResource)))
+}
+
+// RegisterWithPriority registers a new AdmitFunc at this controller that is run in the order of the given priority,
+// see Priority.
+func (ac *admissionController) RegisterWithPriority(name string, priority int, adm AdmitFunc, opts ...HandlerOption) {
+	ac.register(&handler{name: name, handle: adm.handlerFunc()}, append(opts, Priority(priority)))
+}
+
+// RegisterWithSelector registers a new AdmitFunc at this controller that is only run for objects whose labels match
+// the selector.
+func (ac *admissionController) RegisterWithSelector(name string, sel labels.Selector, adm AdmitFunc, opts ...HandlerOption) {
+	ac.register(&handler{name: name, handle: adm.handlerFunc()}, append(opts, ForSelector(sel)))
+}
+
+// RegisterWithAllowedPaths registers a new AdmitFunc at this controller whose patch operations are restricted to the
+// given paths and the paths below, see AllowedPaths.
+func (ac *admissionController) RegisterWithAllowedPaths(name string, prefixes []string, adm AdmitFunc, opts ...HandlerOption) {
+	ac.register(&handler{name: name, handle: adm.handlerFunc()}, append(opts, AllowedPaths(prefixes...)))
+}
+
+// RegisterHandler registers a new HandlerFunc at this controller that is run for requests of any kind.
+func (ac *admissionController) RegisterHandler(name string, h HandlerFunc, opts ...HandlerOption) {
+	ac.register(&handler{name: name, handle: h}, opts)
+}
+
+// Handle registers a new AdmitFunc at this controller that is served at the given path instead of the base path. This
+// allows a single server to back several webhook configurations, each with its own set of handlers. Paths served
+// otherwise, like the validation path or the probes, are refused, which is logged as error.
+func (ac *admissionController) Handle(path, name string, adm AdmitFunc, opts ...HandlerOption) {
+	path = ac.cleanPath(path)
+	ac.mu.Lock()
+	if _, ok := ac.handlers[path]; !ok {
+		if err := ac.route(path); err != nil {
+			ac.mu.Unlock()
+			ac.logger.Error("could not register handler", err, "name", name)
+			return
+		}
+	}
+	ac.mu.Unlock()
+	ac.registerAt(path, &handler{name: name, handle: adm.handlerFunc()}, opts)
+}
+
+// Paths returns the sorted paths mutating handlers are served at, including the base path unless it clashes with a
+// probe or diagnostics path.
+func (ac *admissionController) Paths() []string {
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+	return sets.List(sets.KeySet(ac.handlers))
+}
+
+// handlersAt returns the handlers currently registered for the path.
+func (ac *admissionController) handlersAt(path string) []*handler {
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+	return ac.handlers[path]
+}
+
+// registeredValidators returns the validators currently registered.
+func (ac *admissionController) registeredValidators() []*handler {
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+	return ac.validators
+}
+
+// cleanPath normalizes the path, warning if it had to be changed, as such paths are likely misconfigured.
+func (ac *admissionController) cleanPath(p string) string {
+	normalized := normalizePath(p)
+	if normalized != p {
+		ac.logger.Warn("normalized serving path", "path", p, "normalized", normalized)
+	}
+	return normalized
+}
+
+// route serves the handlers registered for the path at the path. It fails if the path is already served otherwise, like
+// the validation path or the probes. The caller has to hold mu once the controller may be serving.
+func (ac *admissionController) route(path string) error {
+	if err := ac.serve(path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ac.serveAdmitFunc(w, r, ac.handlersAt(path), false)
+	})); err != nil {
+		return err
+	}
+	ac.handlers[path] = nil
+	return nil
+}
+
+// serve serves h at the path, failing if the path is already served, as the mux panics on registering a path twice.
+// The caller has to hold mu once the controller may be serving.
+func (ac *admissionController) serve(path string, h http.Handler) error {
+	if ac.routes.Has(path) {
+		return fmt.Errorf("path %s is already served", path)
+	}
+	ac.routes.Insert(path)
+	ac.mux.Handle(path, h)
+	return nil
+}
+
+// register applies the options to the handler and adds it to the handlers served at the base path.
+func (ac *admissionController) register(h *handler, opts []HandlerOption) {
+	ac.registerAt(ac.basePath, h, opts)
+}
+
+// registerAt applies the options to the handler and adds it to the handlers served at the path. Handlers are refused
+// for paths that are not routed to handlers, e.g. a base path clashing with a probe, as they would never run and
+// Paths would list the path for webhooks nonetheless.
+func (ac *admissionController) registerAt(path string, h *handler, opts []HandlerOption) {
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	if h.gvk != nil {
+		ac.logger.Info("registering handler", "name", h.name, "path", path, "kind", h.gvk.String())
+	} else {
+		ac.logger.Info("registering handler", "name", h.name, "path", path)
+	}
+	if h.ops != nil && h.ops.Len() == 0 {
+		ac.logger.Warn("registering handler restricted to no operations, it never runs", "name", h.name)
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if _, ok := ac.handlers[path]; !ok {
+		ac.logger.Error("could not register handler", fmt.Errorf("path %s is not served by handlers", path), "name", h.name)
+		return
+	}
+	ac.checkName(h.name)
+	ac.handlers[path] = withHandler(ac.handlers[path], h)
 }
 
-func New() AdmissionController {
-	return &admissionController{}
+// withHandler returns the handlers with h added in the order of their priority. It does not modify the given slice,
+// which requests being served may still range over.
+func withHandler(handlers []*handler, h *handler) []*handler {
+	handlers = append(append([]*handler(nil), handlers...), h)
+	sort.SliceStable(handlers, func(i, j int) bool {
+		return handlers[i].priority < handlers[j].priority
+	})
+	return handlers
 }
 
-// Register registers a new AdmitFunc at this controller.
-func (ac *admissionController) Register(name string, adm AdmitFunc) {
-	log.Printf("registering %s", name)
-	ac.admitFuncs = append(ac.admitFuncs, adm)
+// checkName warns if a handler or validator with the name is already registered. Names identify the handlers in logs,
+// metrics and traces, which cannot tell handlers of the same name apart. Registering is not refused, as the
+// registration methods cannot return an error. The caller has to hold mu, so that the check and the registration are
+// atomic.
+func (ac *admissionController) checkName(name string) {
+	for _, registered := range ac.handlerNames() {
+		if registered == name {
+			ac.logger.Warn("registering duplicate handler name, handlers of this name cannot be told apart", "name", name)
+			return
+		}
+	}
+}
+
+// RegisterValidator registers a new ValidateFunc at this controller. Validators are served at the validation path and
+// never produce patches.
+func (ac *admissionController) RegisterValidator(name string, v ValidateFunc) {
+	ac.addValidator(&handler{name: name, handle: v.handlerFunc()})
+}
+
+// RegisterValidatorWithWarnings registers a new WarningValidateFunc at this controller, which is served at the
+// validation path like those registered by RegisterValidator.
+func (ac *admissionController) RegisterValidatorWithWarnings(name string, v WarningValidateFunc) {
+	ac.addValidator(&handler{name: name, handle: v.handlerFunc()})
+}
+
+// addValidator adds the validator to the validators served at the validation path.
+func (ac *admissionController) addValidator(v *handler) {
+	ac.logger.Info("registering validator", "name", v.name)
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.checkName(v.name)
+	ac.validators = withHandler(ac.validators, v)
+	ac.validatorsUsed.Store(true)
+}
+
+// Unregister removes the handlers and validators with the name, which are no longer run for subsequent requests.
+func (ac *admissionController) Unregister(name string) {
+	ac.logger.Info("unregistering handler", "name", name)
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	for path, handlers := range ac.handlers {
+		ac.handlers[path] = without(handlers, name)
+	}
+	ac.validators = without(ac.validators, name)
+}
+
+// Reset removes all handlers and validators. The paths stay served, requests are allowed unchanged until handlers are
+// registered again.
+func (ac *admissionController) Reset() {
+	ac.logger.Info("removing all handlers")
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	for path := range ac.handlers {
+		ac.handlers[path] = nil
+	}
+	ac.validators = nil
+}
+
+// without returns the handlers except those with the name. It does not modify the given slice, which may still be in
+// use by a request being served.
+func without(handlers []*handler, name string) []*handler {
+	var kept []*handler
+	for _, h := range handlers {
+		if h.name != name {
+			kept = append(kept, h)
+		}
+	}
+	return kept
 }
 
 // doServeAdmitFunc parses the HTTP request for an admission controller webhook, and -- in case of a well-formed
-// request -- delegates the admission control logic to the given admitFunc. The response body is then returned as raw
-// bytes.
-func (ac *admissionController) doServeAdmitFunc(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+// request -- delegates the admission control logic to the given handlers, which are validators if validating is set.
+// The response body is then encoded to buf and returned as raw bytes backed by it. Errors carry the HTTP status code
+// the request is to be answered with.
+func (ac *admissionController) doServeAdmitFunc(w http.ResponseWriter, r *http.Request, buf *bytes.Buffer, handlers []*handler, validating bool) ([]byte, error) {
+	start := time.Now()
+	outcome := OutcomeError
+	defer func() {
+		ac.observeRequest(outcome, time.Since(start))
+	}()
+
 	// Step 1: Request validation. Only handle POST requests with a body and json content type.
 
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return nil, fmt.Errorf("invalid method %s, only POST requests are allowed", r.Method)
+		w.Header().Set("Allow", http.MethodPost)
+		return nil, httpErrorf(http.StatusMethodNotAllowed, "invalid method %s, only POST requests are allowed", r.Method)
+	}
+	if !ac.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		return nil, httpErrorf(http.StatusUnauthorized, "missing or invalid bearer token")
+	}
+	if ac.requireHandlers && len(handlers) == 0 && (!validating || ac.validatorsUsed.Load()) {
+		return nil, fmt.Errorf("no handlers registered for path %s", r.URL.Path)
 	}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil, fmt.Errorf("could not read request body: %v", err)
+	// A global limit is checked before reading the body, so requests exceeding it cost as little as possible, while
+	// limits per namespace have to wait for the request to be decoded.
+	if ac.rateLimiter != nil && !ac.rateLimiter.perNamespace && !ac.rateLimiter.allow("") {
+		return nil, httpErrorf(http.StatusTooManyRequests, "rate limit exceeded")
 	}
 
-	if contentType := r.Header.Get("Content-Type"); contentType != jsonContentType {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil, fmt.Errorf("unsupported content type %s, only %s is supported", contentType, jsonContentType)
+	reader := http.MaxBytesReader(w, r.Body, ac.maxBodyBytes)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, httpErrorf(http.StatusBadRequest, "could not decompress request body: %v", err)
+		}
+		defer gzipReader.Close()
+		// The limit applies to the decompressed body as well.
+		reader = http.MaxBytesReader(w, gzipReader, ac.maxBodyBytes)
 	}
 
-	// Step 2: Parse the AdmissionReview request.
+	body, err := io.ReadAll(reader)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return nil, httpErrorf(http.StatusRequestEntityTooLarge, "request body exceeds %d bytes", maxBytesErr.Limit)
+	} else if err != nil {
+		return nil, httpErrorf(http.StatusBadRequest, "could not read request body: %v", err)
+	}
+
+	body, err = bodyToJSON(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		return nil, err
+	}
 
-	var admissionReviewReq admissionV1.AdmissionReview
+	// Step 2: Parse the AdmissionReview request.
 
-	if _, _, err := UniversalDeserializer.Decode(body, nil, &admissionReviewReq); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil, fmt.Errorf("could not deserialize request: %v", err)
+	admissionReviewReq, err := decodeReview(body)
+	if err == nil && ac.strictDecoding {
+		err = checkReviewFields(body)
+	}
+	if err != nil {
+		if ac.snippetBytes > 0 {
+			// The body is only logged, responses must not leak the data that arrived.
+			ac.logger.Warn("received malformed admission review", "path", r.URL.Path, "body", bodySnippet(body, ac.snippetBytes))
+		}
+		return nil, httpErrorf(http.StatusBadRequest, "could not deserialize request: %v", err)
 	} else if admissionReviewReq.Request == nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil, errors.New("malformed admission review: request is nil")
+		return nil, httpErrorf(http.StatusBadRequest, "malformed admission review: request is nil")
 	}
 
+	if ac.rateLimiter != nil && ac.rateLimiter.perNamespace && !ac.rateLimiter.allow(admissionReviewReq.Request.Namespace) {
+		return nil, httpErrorf(http.StatusTooManyRequests, "rate limit exceeded")
+	}
+
+	ac.logger.Debug("handling admission request", requestFields(admissionReviewReq.Request)...)
+
 	// Step 3: Construct the AdmissionReview response.
 
+	response, err := ac.review(r.Context(), admissionReviewReq.Request, handlers, validating)
+	if err != nil {
+		return nil, err
+	}
+
+	// The request is not echoed, the apiserver only reads the response.
 	admissionReviewResponse := &admissionV1.AdmissionReview{
 		TypeMeta: admissionReviewReq.TypeMeta,
-		Request:  admissionReviewReq.Request,
-		Response: &admissionV1.AdmissionResponse{
-			UID: admissionReviewReq.Request.UID,
-		},
-	}
-
-	var patchOps []PatchOperation
-	// Apply the admit() function only for non-Kubernetes namespaces. For objects in Kubernetes namespaces, return
-	// an empty set of patch operations.
-	if !isKubeNamespace(admissionReviewReq.Request.Namespace) {
-		for _, adm := range ac.admitFuncs {
-			if patches, err := adm(admissionReviewReq.Request); err != nil {
-				break
-			} else {
-				patchOps = append(patchOps, patches...)
-			}
-		}
+		Response: response,
+	}
+	if admissionReviewResponse.APIVersion == "" || admissionReviewResponse.Kind == "" {
+		// The apiserver rejects responses without TypeMeta.
+		admissionReviewResponse.SetGroupVersionKind(defaultReviewKind)
+	}
+	for _, intercept := range ac.interceptors {
+		intercept(admissionReviewResponse)
+	}
 
+	// Return the AdmissionReview with a response as JSON.
+	if err := encodeJSON(buf, admissionReviewResponse); err != nil {
+		return nil, fmt.Errorf("marshaling response: %v", err)
 	}
 
-	if err != nil {
+	// Interceptors may have changed the decision.
+	outcome = OutcomeDenied
+	if admissionReviewResponse.Response != nil && admissionReviewResponse.Response.Allowed {
+		outcome = OutcomeAllowed
+	}
+	return buf.Bytes(), nil
+}
+
+// review runs the handlers, which are validators if validating is set, against the request and constructs the
+// AdmissionResponse. An error is only returned if no response could be constructed or a handler failed with a
+// RetriableError. Either way, the decision is logged.
+func (ac *admissionController) review(ctx context.Context, req *admissionV1.AdmissionRequest, handlers []*handler, validating bool) (_ *admissionV1.AdmissionResponse, reviewErr error) {
+	response := &admissionV1.AdmissionResponse{
+		UID: req.UID,
+	}
+	start := time.Now()
+	ctx = ac.handlerContext(ctx)
+	span := spanFromContext(ctx)
+	span.SetRequest(req)
+
+	res := &Result{}
+	var ran []handlerRun
+	defer func() {
+		ac.logReview(req, ran, response, len(res.Patches), reviewErr, time.Since(start))
+	}()
+	var err error
+	// Apply the admit() function only for handled namespaces and kinds. For objects in other namespaces, like the
+	// Kubernetes-owned ones, and of always allowed kinds return an empty set of patch operations.
+	if ac.handlesNamespace(scopeOf(req)) && ac.handlesKind(req.Kind) {
+		res, ran, err = ac.dispatch(ctx, handlers, req)
+	}
+
+	// Warnings and audit annotations are returned regardless of the decision.
+	response.Warnings = res.Warnings
+	response.AuditAnnotations = res.AuditAnnotations
+
+	if err != nil && isRetriable(err) {
+		// Transient failures are not a decision, the apiserver applies the failure policy of the webhook instead.
+		return nil, &httpError{code: http.StatusServiceUnavailable, err: err}
+	} else if err != nil {
 		// If the handler returned an error, incorporate the error message into the response and deny the object
 		// creation.
-		admissionReviewResponse.Response.Allowed = false
-		admissionReviewResponse.Response.Result = &metaV1.Status{Message: err.Error()}
+		response.Allowed = false
+		response.Result = statusOf(err)
+		if ac.contextualDeny {
+			response.Result.Message = objectContext(req) + ": " + response.Result.Message
+		}
+	} else if validating {
+		// Validators only decide, they never patch.
+		response.Allowed = true
+	} else if len(res.Patch) > 0 {
+		// A raw patch is returned as is, once it is known to be of its type. Raw JSON patches are checked like patch
+		// operations.
+		patchType := patchTypeOf(res)
+		ops, err := checkRawPatch(patchType, res.Patch)
+		if err != nil {
+			return nil, err
+		}
+		if patchType == admissionV1.PatchTypeJSONPatch {
+			if err := ac.checkPatch(req, ops, res.Patch); err != nil {
+				return nil, err
+			}
+		}
+		response.Allowed = true
+		response.Patch = res.Patch
+		response.PatchType = &patchType
 	} else {
 		// Otherwise, encode the patch operations to JSON and return a positive response.
-		patchBytes, err := json.Marshal(patchOps)
+		if ac.sortPatches {
+			sortPatches(res.Patches)
+		}
+		patchBytes, err := ac.marshalPatch(res.Patches)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
 			return nil, fmt.Errorf("could not marshal JSON patch: %v", err)
 		}
+		if err := ac.checkPatch(req, len(res.Patches), patchBytes); err != nil {
+			return nil, err
+		}
 
-		admissionReviewResponse.Response.Allowed = true
-		admissionReviewResponse.Response.Patch = patchBytes
+		response.Allowed = true
+		response.Patch = patchBytes
 		patchType := admissionV1.PatchTypeJSONPatch
-		admissionReviewResponse.Response.PatchType = &patchType
+		response.PatchType = &patchType
 	}
 
-	// Return the AdmissionReview with a response as JSON.
-	bytes, err := json.Marshal(admissionReviewResponse)
-	if err != nil {
-		return nil, fmt.Errorf("marshaling response: %v", err)
+	if ac.mutatedAnnotation != "" && !validating {
+		if response.AuditAnnotations == nil {
+			response.AuditAnnotations = map[string]string{}
+		}
+		response.AuditAnnotations[ac.mutatedAnnotation] = strconv.FormatBool(len(res.Patches) > 0 || len(res.Patch) > 0)
 	}
 
-	return bytes, nil
+	span.SetDecision(response.Allowed, len(res.Patches))
+	return response, nil
 }
 
-// serveAdmitFunc is a wrapper around doServeAdmitFunc that adds error handling and logging.
-func (ac *admissionController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	//log.Print("Handling webhook request ...")
+// logReview logs the decision on the request and, if it took longer than the threshold, that it was slow. Requests
+// no response was constructed for are logged as not allowed along with the error, without patch operations.
+func (ac *admissionController) logReview(req *admissionV1.AdmissionRequest, ran []handlerRun, response *admissionV1.AdmissionResponse, patchOps int, err error, elapsed time.Duration) {
+	fields := append(requestFields(req), "operation", req.Operation, "handlers", joinRuns(ran, false))
+	if err != nil {
+		fields = append(fields, "allowed", false, "patchOperations", 0, "error", err)
+	} else {
+		fields = append(fields, "allowed", response.Allowed, "patchOperations", patchOps)
+	}
+	ac.logger.Info("reviewed admission request", fields...)
+	if ac.slowThreshold > 0 && elapsed > ac.slowThreshold {
+		ac.logger.Warn("slow admission request", append(requestFields(req),
+			"duration", elapsed, "threshold", ac.slowThreshold, "handlers", joinRuns(ran, true))...)
+	}
+}
 
+// checkPatch checks the JSON patch of n operations produced for the request against the limit of operations and, if
+// enabled, against the object, logging it at debug level.
+func (ac *admissionController) checkPatch(req *admissionV1.AdmissionRequest, n int, patchBytes []byte) error {
+	if ac.maxPatchOps > 0 && n > ac.maxPatchOps {
+		return fmt.Errorf("handlers produced %d patch operations, exceeding the limit of %d", n, ac.maxPatchOps)
+	}
+	ac.logger.Debug("patching object", append(requestFields(req), "patch", string(patchBytes))...)
+
+	if ac.validatePatches && n > 0 && len(req.Object.Raw) > 0 {
+		return validatePatch(req.Object.Raw, patchBytes)
+	}
+	return nil
+}
+
+// serveAdmitFunc is a wrapper around doServeAdmitFunc that adds error handling, logging and tracing. Denials are
+// regular AdmissionReview responses, only requests no review could be constructed for are answered with an error
+// status and a JSON body like {"error": "..."}. Responses are encoded as YAML instead if the Accept header asks so.
+func (ac *admissionController) serveAdmitFunc(w http.ResponseWriter, r *http.Request, handlers []*handler, validating bool) {
+	r, span := ac.startSpan(r)
 	var writeErr error
-	if bytes, err := ac.doServeAdmitFunc(w, r); err != nil {
-		log.Printf("Error handling webhook request: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		_, writeErr = w.Write([]byte(err.Error()))
+	buf := getBuffer()
+	// The response is written before the buffer is returned.
+	defer putBuffer(buf)
+	bytes, err := ac.doServeAdmitFunc(w, r, buf, handlers, validating)
+	contentType := responseContentType(r.Header.Get("Accept"))
+	if err == nil {
+		if bytes, err = encodeAs(contentType, bytes); err != nil {
+			err = fmt.Errorf("encoding response: %v", err)
+		}
+	}
+	defer span.End(err)
+	if err != nil {
+		ac.logger.Error("could not handle webhook request", err, "path", r.URL.Path)
+		// Converting the JSON of a struct of a string to YAML cannot fail.
+		body, _ := encodeAs(contentType, errorBodyOf(err))
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(statusCodeOf(err))
+		_, writeErr = w.Write(body)
 	} else {
+		w.Header().Set("Content-Type", contentType)
 		_, writeErr = w.Write(bytes)
 	}
 
 	if writeErr != nil {
-		log.Printf("Could not write response: %v", writeErr)
+		ac.logger.Error("could not write response", writeErr, "path", r.URL.Path)
 	}
 }
@@ -0,0 +1,74 @@
+package admit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	admissionV1 "k8s.io/api/admission/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// BenchmarkDoServeAdmitFunc compares encoding the responses to pooled buffers, as serveAdmitFunc does, with encoding
+// them to a new buffer for each request.
+func BenchmarkDoServeAdmitFunc(b *testing.B) {
+	ac := New(WithLogger(nil)).(*admissionController)
+	ac.RegisterPod("sidecar", func(pod *coreV1.Pod, _ *admissionV1.AdmissionRequest) ([]PatchOperation, error) {
+		return InjectContainer(pod, coreV1.Container{Name: "proxy", Image: "envoy"}), nil
+	})
+	ac.Register("label", func(*admissionV1.AdmissionRequest) ([]PatchOperation, error) {
+		return new(PatchBuilder).Add(Pointer("metadata", "labels", "a"), "true").Build(), nil
+	})
+	handlers := ac.handlersAt(ac.basePath)
+
+	pod := &coreV1.Pod{
+		TypeMeta:   metaV1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metaV1.ObjectMeta{Name: "web", Namespace: "default", Labels: map[string]string{"app": "web"}},
+		Spec:       coreV1.PodSpec{Containers: []coreV1.Container{{Name: "app", Image: "nginx"}}},
+	}
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		b.Fatal(err)
+	}
+	body, err := json.Marshal(&admissionV1.AdmissionReview{
+		TypeMeta: metaV1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionV1.AdmissionRequest{
+			UID:       "uid",
+			Kind:      metaV1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  metaV1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Namespace: pod.Namespace,
+			Operation: admissionV1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		get  func() *bytes.Buffer
+		put  func(*bytes.Buffer)
+	}{
+		{name: "pooled", get: getBuffer, put: putBuffer},
+		{name: "unpooled", get: func() *bytes.Buffer { return new(bytes.Buffer) }, put: func(*bytes.Buffer) {}},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+				r.Header.Set("Content-Type", jsonContentType)
+				buf := tt.get()
+				if _, err := ac.doServeAdmitFunc(httptest.NewRecorder(), r, buf, handlers, false); err != nil {
+					b.Fatal(err)
+				}
+				tt.put(buf)
+			}
+		})
+	}
+}
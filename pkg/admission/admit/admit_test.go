@@ -0,0 +1,961 @@
+package admit_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	admissionV1 "k8s.io/api/admission/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// testPod returns a pod with a single container in the default namespace.
+func testPod() *coreV1.Pod {
+	return &coreV1.Pod{
+		TypeMeta:   metaV1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metaV1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: coreV1.PodSpec{
+			Containers: []coreV1.Container{{Name: "app", Image: "nginx"}},
+		},
+	}
+}
+
+// podRequest returns a CREATE request admitting the pod.
+func podRequest(t testing.TB, pod *coreV1.Pod) *admissionV1.AdmissionRequest {
+	t.Helper()
+	return &admissionV1.AdmissionRequest{
+		UID:       "uid",
+		Kind:      metaV1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Resource:  metaV1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		Name:      pod.Name,
+		Namespace: pod.Namespace,
+		Operation: admissionV1.Create,
+		Object:    runtime.RawExtension{Raw: mustMarshal(t, pod)},
+	}
+}
+
+// newReview wraps the request into an AdmissionReview of the current version.
+func newReview(req *admissionV1.AdmissionRequest) *admissionV1.AdmissionReview {
+	return &admissionV1.AdmissionReview{
+		TypeMeta: metaV1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  req,
+	}
+}
+
+// mustMarshal marshals v to JSON, failing the test on error.
+func mustMarshal(t testing.TB, v interface{}) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshaling %T: %v", v, err)
+	}
+	return b
+}
+
+// post sends the body as JSON to the path of the handler and returns the recorded response. Bodies other than byte
+// slices are marshaled to JSON first.
+func post(t testing.TB, h http.Handler, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	raw, ok := body.([]byte)
+	if !ok {
+		raw = mustMarshal(t, body)
+	}
+	return send(h, path, raw, http.Header{"Content-Type": {"application/json"}})
+}
+
+// send posts the raw body with the headers to the path of the handler and returns the recorded response.
+func send(h http.Handler, path string, body []byte, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	r.Header = header
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+// responseOf decodes the AdmissionResponse of a recorded response, failing the test unless it was answered with an
+// AdmissionReview.
+func responseOf(t testing.TB, rec *httptest.ResponseRecorder) *admissionV1.AdmissionResponse {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	var review admissionV1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if review.Response == nil {
+		t.Fatalf("response review carries no response: %s", rec.Body)
+	}
+	return review.Response
+}
+
+// patchesOf decodes the JSON patch of the response.
+func patchesOf(t testing.TB, res *admissionV1.AdmissionResponse) []admit.PatchOperation {
+	t.Helper()
+	if len(res.Patch) == 0 {
+		return nil
+	}
+	var patches []admit.PatchOperation
+	if err := json.Unmarshal(res.Patch, &patches); err != nil {
+		t.Fatalf("decoding patch: %v", err)
+	}
+	return patches
+}
+
+// messageOf returns the status message of the response, which is empty for responses without status.
+func messageOf(res *admissionV1.AdmissionResponse) string {
+	if res.Result == nil {
+		return ""
+	}
+	return res.Result.Message
+}
+
+func TestHandlerErrorDenies(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantAllowed bool
+		wantMessage string
+	}{
+		{name: "allow", wantAllowed: true},
+		{name: "deny", err: errors.New("pods must not run as root"), wantMessage: "pods must not run as root"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			ac.Register("test", func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				return nil, tt.err
+			})
+
+			res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+			if res.Allowed != tt.wantAllowed {
+				t.Errorf("got allowed %t, want %t", res.Allowed, tt.wantAllowed)
+			}
+			if got := messageOf(res); got != tt.wantMessage {
+				t.Errorf("got message %q, want %q", got, tt.wantMessage)
+			}
+			if res.UID != "uid" {
+				t.Errorf("got UID %q, want uid", res.UID)
+			}
+		})
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	tests := []struct {
+		name         string
+		patches      []admit.PatchOperation
+		err          error
+		wantAllowed  bool
+		wantWarnings []string
+	}{
+		{
+			name:         "allow with patches",
+			patches:      new(admit.PatchBuilder).Add("/metadata/labels", map[string]string{"a": "b"}).Build(),
+			wantAllowed:  true,
+			wantWarnings: []string{"deprecated annotation detected", "second warning"},
+		},
+		{
+			name:         "deny",
+			err:          errors.New("denied"),
+			wantWarnings: []string{"deprecated annotation detected", "second warning"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			ac.RegisterHandler("test", func(context.Context, *admissionV1.AdmissionRequest) (*admit.Result, error) {
+				return &admit.Result{Patches: tt.patches, Warnings: []string{"deprecated annotation detected", "second warning"}}, tt.err
+			})
+
+			res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+			if res.Allowed != tt.wantAllowed {
+				t.Errorf("got allowed %t, want %t", res.Allowed, tt.wantAllowed)
+			}
+			if !reflect.DeepEqual(res.Warnings, tt.wantWarnings) {
+				t.Errorf("got warnings %q, want %q", res.Warnings, tt.wantWarnings)
+			}
+			if got := len(patchesOf(t, res)); got != len(tt.patches) {
+				t.Errorf("got %d patch operations, want %d", got, len(tt.patches))
+			}
+		})
+	}
+}
+
+func TestValidatorWarnings(t *testing.T) {
+	tests := []struct {
+		name string
+		// warnings are returned by one validator each, along with err by the last.
+		warnings     [][]string
+		err          error
+		wantAllowed  bool
+		wantWarnings []string
+	}{
+		{
+			name:         "allow with two warnings",
+			warnings:     [][]string{{"spec.deprecatedField is deprecated", "image uses the latest tag"}},
+			wantAllowed:  true,
+			wantWarnings: []string{"spec.deprecatedField is deprecated", "image uses the latest tag"},
+		},
+		{
+			name:        "allow without warnings",
+			warnings:    [][]string{nil},
+			wantAllowed: true,
+		},
+		{
+			name:         "warnings of several validators",
+			warnings:     [][]string{{"first"}, {"second"}},
+			wantAllowed:  true,
+			wantWarnings: []string{"first", "second"},
+		},
+		{
+			name:         "deny with warnings",
+			warnings:     [][]string{{"image uses the latest tag"}},
+			err:          errors.New("denied"),
+			wantWarnings: []string{"image uses the latest tag"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			for i, warnings := range tt.warnings {
+				warnings, err := warnings, error(nil)
+				if i == len(tt.warnings)-1 {
+					err = tt.err
+				}
+				ac.RegisterValidatorWithWarnings(fmt.Sprintf("validator-%d", i), func(*admissionV1.AdmissionRequest) ([]string, error) {
+					return warnings, err
+				})
+			}
+
+			res := responseOf(t, post(t, ac, "/validate", newReview(podRequest(t, testPod()))))
+			if res.Allowed != tt.wantAllowed {
+				t.Errorf("got allowed %t, want %t", res.Allowed, tt.wantAllowed)
+			}
+			if !reflect.DeepEqual(res.Warnings, tt.wantWarnings) {
+				t.Errorf("got warnings %q, want %q", res.Warnings, tt.wantWarnings)
+			}
+			if res.Patch != nil {
+				t.Errorf("got patch %s from validators", res.Patch)
+			}
+		})
+	}
+}
+
+func TestHandlerContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		cancel  bool
+		wantErr error
+	}{
+		{name: "active"},
+		{name: "canceled", cancel: true, wantErr: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			var got error
+			ac.RegisterCtx("test", func(ctx context.Context, _ *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				got = ctx.Err()
+				return nil, nil
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+			r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(mustMarshal(t, newReview(podRequest(t, testPod())))))
+			r.Header.Set("Content-Type", "application/json")
+			ac.ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+			if !errors.Is(got, tt.wantErr) {
+				t.Errorf("handler observed %v, want %v", got, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	body := mustMarshal(t, newReview(podRequest(t, testPod())))
+	tests := []struct {
+		name     string
+		limit    int64
+		wantCode int
+	}{
+		{name: "below limit", limit: int64(len(body)) + 1, wantCode: http.StatusOK},
+		{name: "at limit", limit: int64(len(body)), wantCode: http.StatusOK},
+		{name: "above limit", limit: int64(len(body)) - 1, wantCode: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(admit.WithMaxBodyBytes(tt.limit))
+			if rec := post(t, ac, "/mutate", body); rec.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+		})
+	}
+}
+
+func TestGzipBodies(t *testing.T) {
+	body := mustMarshal(t, newReview(podRequest(t, testPod())))
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(body)
+	gz.Close()
+	truncated := compressed.Bytes()[:compressed.Len()/2]
+
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+		limit    int64
+		wantCode int
+	}{
+		{name: "plain", body: body, wantCode: http.StatusOK},
+		{name: "gzip", body: compressed.Bytes(), encoding: "gzip", wantCode: http.StatusOK},
+		{name: "malformed gzip", body: body, encoding: "gzip", wantCode: http.StatusBadRequest},
+		{name: "truncated gzip", body: truncated, encoding: "gzip", wantCode: http.StatusBadRequest},
+		{name: "decompressed body above limit", body: compressed.Bytes(), encoding: "gzip", limit: int64(len(body)) - 1, wantCode: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []admit.Option
+			if tt.limit > 0 {
+				opts = append(opts, admit.WithMaxBodyBytes(tt.limit))
+			}
+			ac := admit.New(opts...)
+			ac.Register("label", patching("a"))
+
+			header := http.Header{"Content-Type": {"application/json"}}
+			if tt.encoding != "" {
+				header.Set("Content-Encoding", tt.encoding)
+			}
+			rec := send(ac, "/mutate", tt.body, header)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantCode == http.StatusOK && len(patchesOf(t, responseOf(t, rec))) != 1 {
+				t.Errorf("got response %s, want a patch", rec.Body)
+			}
+		})
+	}
+}
+
+func TestDebugLogsPatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		level   admit.Level
+		wantLog bool
+	}{
+		{name: "debug", level: admit.LevelDebug, wantLog: true},
+		{name: "info", level: admit.LevelInfo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, buf := bufferLogger(tt.level)
+			ac := admit.New(admit.WithLogger(logger))
+			ac.Register("label", patching("a"))
+			post(t, ac, "/mutate", newReview(podRequest(t, testPod())))
+
+			patch := `patch=[{"op":"add","path":"/metadata/labels/a","value":"true"}]`
+			logged := strings.Contains(buf.String(), "patching object uid=uid") && strings.Contains(buf.String(), patch)
+			if logged != tt.wantLog {
+				t.Errorf("got patch logged %t, want %t: %s", logged, tt.wantLog, buf)
+			}
+		})
+	}
+}
+
+func TestDenialsAndInfrastructureErrors(t *testing.T) {
+	valid := mustMarshal(t, newReview(podRequest(t, testPod())))
+	tests := []struct {
+		name     string
+		body     []byte
+		wantCode int
+	}{
+		{name: "denial", body: valid, wantCode: http.StatusOK},
+		{name: "malformed JSON", body: []byte(`{"request":`), wantCode: http.StatusBadRequest},
+		{name: "missing request", body: []byte(`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview"}`), wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			ac.Register("deny", failing("denied"))
+
+			rec := post(t, ac, "/mutate", tt.body)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			if res := responseOf(t, rec); res.Allowed || messageOf(res) != "denied" {
+				t.Errorf("got response %+v, want a denial", res)
+			}
+		})
+	}
+}
+
+func TestHandlePaths(t *testing.T) {
+	ac := admit.New()
+	ran := map[string]bool{}
+	ac.Handle("/mutate-pods", "pods", recording(ran, "pods"))
+	ac.Handle("/mutate-pods/", "pods-2", recording(ran, "pods-2"))
+	ac.Handle("/mutate-ingress", "ingress", recording(ran, "ingress"))
+	ac.Register("base", recording(ran, "base"))
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{path: "/mutate-pods", want: []string{"pods", "pods-2"}},
+		{path: "/mutate-ingress", want: []string{"ingress"}},
+		{path: "/mutate", want: []string{"base"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			for name := range ran {
+				delete(ran, name)
+			}
+			responseOf(t, post(t, ac, tt.path, newReview(podRequest(t, testPod()))))
+			var got []string
+			for _, name := range []string{"base", "ingress", "pods", "pods-2"} {
+				if ran[name] {
+					got = append(got, name)
+				}
+			}
+			sort.Strings(tt.want)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got handlers %v run, want %v", got, tt.want)
+			}
+		})
+	}
+	if want := []string{"/mutate", "/mutate-ingress", "/mutate-pods"}; !reflect.DeepEqual(ac.Paths(), want) {
+		t.Errorf("got paths %v, want %v", ac.Paths(), want)
+	}
+}
+
+func TestBasePathNormalization(t *testing.T) {
+	tests := []struct {
+		basePath string
+		wantWarn bool
+	}{
+		{basePath: "mutate", wantWarn: true},
+		{basePath: "/mutate/", wantWarn: true},
+		{basePath: "//mutate", wantWarn: true},
+		{basePath: "/mutate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.basePath, func(t *testing.T) {
+			t.Setenv(admit.ENV_BASE_PATH, tt.basePath)
+			if got := admit.GetBasePath(); got != "/mutate" {
+				t.Errorf("got base path %q, want /mutate", got)
+			}
+
+			logger, buf := bufferLogger(admit.LevelWarn)
+			ac := admit.New(admit.WithLogger(logger))
+			ran := map[string]bool{}
+			ac.Register("base", recording(ran, "base"))
+			responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+			if !ran["base"] {
+				t.Error("handler at the normalized base path did not run")
+			}
+			if got := strings.Contains(buf.String(), "normalized serving path"); got != tt.wantWarn {
+				t.Errorf("got normalization warning %t, want %t: %q", got, tt.wantWarn, buf.String())
+			}
+		})
+	}
+}
+
+func TestRequireHandlers(t *testing.T) {
+	tests := []struct {
+		name     string
+		require  bool
+		register bool
+		// unregistered registers a validator and removes it again.
+		unregistered bool
+		path         string
+		wantCode     int
+	}{
+		{name: "lenient without handlers", path: "/mutate", wantCode: http.StatusOK},
+		{name: "require without handlers", require: true, path: "/mutate", wantCode: http.StatusInternalServerError},
+		{name: "require without validators ever registered", require: true, register: true, path: "/validate", wantCode: http.StatusOK},
+		{name: "require without validators", require: true, unregistered: true, path: "/validate", wantCode: http.StatusInternalServerError},
+		{name: "require with handlers", require: true, register: true, path: "/mutate", wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, buf := bufferLogger(admit.LevelError)
+			ac := admit.New(admit.WithLogger(logger), admit.WithRequireHandlers(tt.require))
+			if tt.register {
+				ac.Register("label", patching("a"))
+			}
+			if tt.unregistered {
+				ac.RegisterValidator("policy", func(*admissionV1.AdmissionRequest) error { return nil })
+				ac.Unregister("policy")
+			}
+
+			rec := post(t, ac, tt.path, newReview(podRequest(t, testPod())))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.wantCode)
+			}
+			logged := strings.Contains(buf.String(), "no handlers registered for path "+tt.path)
+			if want := tt.wantCode != http.StatusOK; logged != want {
+				t.Errorf("got missing handlers logged %t, want %t: %q", logged, want, buf.String())
+			}
+		})
+	}
+}
+
+func TestResponseInterceptor(t *testing.T) {
+	var seen []string
+	ac := admit.New(
+		admit.WithResponseInterceptor(func(review *admissionV1.AdmissionReview) {
+			res := review.Response
+			seen = append(seen, fmt.Sprintf("%s %s %t %s", review.APIVersion, res.UID, res.Allowed, res.Patch))
+			res.Warnings = append(res.Warnings, "proxied")
+		}),
+		admit.WithResponseInterceptor(func(review *admissionV1.AdmissionReview) {
+			seen = append(seen, strings.Join(review.Response.Warnings, ","))
+			review.Response.UID = "proxied-uid"
+		}))
+	ac.Register("label", patching("a"))
+
+	res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+	want := []string{
+		`admission.k8s.io/v1 uid true [{"op":"add","path":"/metadata/labels/a","value":"true"}]`,
+		"proxied",
+	}
+	if !reflect.DeepEqual(seen, want) {
+		t.Errorf("interceptors saw %q, want %q", seen, want)
+	}
+	if res.UID != "proxied-uid" || !reflect.DeepEqual(res.Warnings, []string{"proxied"}) {
+		t.Errorf("got UID %s and warnings %v, want the modifications of the interceptors", res.UID, res.Warnings)
+	}
+}
+
+func TestResponseOmitsRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		apiVersion string
+	}{
+		{name: "v1", apiVersion: "admission.k8s.io/v1"},
+		{name: "v1beta1", apiVersion: "admission.k8s.io/v1beta1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			ac.Register("label", patching("a"))
+
+			review := newReview(podRequest(t, testPod()))
+			review.APIVersion = tt.apiVersion
+			rec := post(t, ac, "/mutate", review)
+
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(rec.Body.Bytes(), &fields); err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for key := range fields {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			if want := []string{"apiVersion", "kind", "response"}; !reflect.DeepEqual(keys, want) {
+				t.Errorf("got fields %v, want %v", keys, want)
+			}
+
+			// The apiserver decodes the response like any other review.
+			obj, gvk, err := admit.UniversalDeserializer.Decode(rec.Body.Bytes(), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gvk.GroupVersion().String() != tt.apiVersion || gvk.Kind != "AdmissionReview" {
+				t.Errorf("got response of %s", gvk)
+			}
+			if got := reflect.ValueOf(obj).Elem().FieldByName("Request"); !got.IsNil() {
+				t.Errorf("got request %v in response", got)
+			}
+		})
+	}
+}
+
+// requestIDKey is the context key of the request ID injected by middleware.
+type requestIDKey struct{}
+
+// tagging returns a middleware appending the tag to the X-Middleware header and to the calls.
+func tagging(tag string, calls *[]string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*calls = append(*calls, tag)
+			r.Header.Add("X-Middleware", tag)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestUse(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		// wantCode is the status of the response, wantHeader the X-Middleware header seen by the innermost middleware.
+		wantCode   int
+		wantHeader []string
+	}{
+		{name: "admission request", method: http.MethodPost, wantCode: http.StatusOK, wantHeader: []string{"outer", "inner"}},
+		{name: "invalid request", method: http.MethodGet, wantCode: http.StatusMethodNotAllowed, wantHeader: []string{"outer", "inner"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			var calls []string
+			var header []string
+			var requestID interface{}
+			ac.Use(tagging("outer", &calls))
+			ac.Use(tagging("inner", &calls))
+			ac.Use(func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					header = r.Header.Values("X-Middleware")
+					next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, "id")))
+				})
+			})
+			ac.RegisterCtx("request-id", func(ctx context.Context, _ *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				requestID = ctx.Value(requestIDKey{})
+				return nil, nil
+			})
+
+			r := httptest.NewRequest(tt.method, "/mutate", bytes.NewReader(mustMarshal(t, newReview(podRequest(t, testPod())))))
+			r.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			ac.ServeHTTP(rec, r)
+			if rec.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantCode)
+			}
+			if want := []string{"outer", "inner"}; !reflect.DeepEqual(calls, want) {
+				t.Errorf("got middleware called %v, want %v", calls, want)
+			}
+			if !reflect.DeepEqual(header, tt.wantHeader) {
+				t.Errorf("got header %v, want %v", header, tt.wantHeader)
+			}
+			if wantID := tt.wantCode == http.StatusOK; (requestID == "id") != wantID {
+				t.Errorf("handler observed request ID %v", requestID)
+			}
+		})
+	}
+}
+
+func TestUseWhileServing(t *testing.T) {
+	ac := admit.New()
+	ac.Register("label", patching("a"))
+	body := mustMarshal(t, newReview(podRequest(t, testPod())))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if rec := post(t, ac, "/mutate", body); rec.Code != http.StatusOK {
+					t.Errorf("got status %d", rec.Code)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		ac.Use(func(next http.Handler) http.Handler { return next })
+	}
+	wg.Wait()
+}
+
+// TestConcurrentRegistration changes the controller while serving requests, races are only detected by go test -race.
+func TestConcurrentRegistration(t *testing.T) {
+	nop := func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) { return nil, nil }
+	// changes modify the controller while requests are served, each is run repeatedly by a goroutine of its own.
+	changes := []func(ac admit.AdmissionController, i int){
+		func(ac admit.AdmissionController, i int) {
+			ac.Register(fmt.Sprintf("label-%d", i), patching(fmt.Sprintf("l%d", i)))
+		},
+		func(ac admit.AdmissionController, i int) {
+			ac.RegisterValidator("policy", func(*admissionV1.AdmissionRequest) error { return nil })
+		},
+		func(ac admit.AdmissionController, i int) { ac.Handle(fmt.Sprintf("/mutate-%d", i), "path", nop) },
+		func(ac admit.AdmissionController, i int) {
+			ac.Use(func(next http.Handler) http.Handler { return next })
+		},
+		func(ac admit.AdmissionController, i int) { ac.Unregister(fmt.Sprintf("label-%d", i-1)) },
+		func(ac admit.AdmissionController, i int) {
+			if i%5 == 0 {
+				ac.Reset()
+			}
+		},
+		func(ac admit.AdmissionController, i int) {
+			ac.Handlers()
+			ac.Paths()
+			ac.SetReady(i%2 == 0)
+		},
+	}
+	ac := admit.New(admit.WithLogger(nil))
+	body := mustMarshal(t, newReview(podRequest(t, testPod())))
+
+	var wg sync.WaitGroup
+	for _, change := range changes {
+		change := change
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				change(ac, i)
+			}
+		}()
+	}
+	for _, path := range []string{"/mutate", "/validate", "/mutate-0"} {
+		path := path
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				rec := post(t, ac, path, body)
+				if rec.Code == http.StatusNotFound && path == "/mutate-0" {
+					// The path may not be registered yet.
+					continue
+				}
+				if res := responseOf(t, rec); !res.Allowed {
+					t.Errorf("got %s denied: %s", path, messageOf(res))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Once the changes are done, the controller serves the handlers registered afterwards.
+	ac.Reset()
+	ac.Register("final", patching("final"))
+	if got := ac.Handlers(); !reflect.DeepEqual(got, []string{"final"}) {
+		t.Errorf("got handlers %q, want final", got)
+	}
+	if res := responseOf(t, post(t, ac, "/mutate", body)); !res.Allowed || len(patchesOf(t, res)) != 1 {
+		t.Errorf("got response %+v, want the final handler run", res)
+	}
+}
+
+func TestConcurrentDuplicateNames(t *testing.T) {
+	logger, buf := bufferLogger(admit.LevelWarn)
+	ac := admit.New(admit.WithLogger(logger))
+
+	// All but the first of the concurrent registrations of the name are duplicates.
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i%2 == 0 {
+				ac.Register("same", patching(fmt.Sprintf("l%d", i)))
+			} else {
+				ac.RegisterValidator("same", func(*admissionV1.AdmissionRequest) error { return nil })
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := strings.Count(buf.String(), "registering duplicate handler name"); got != n-1 {
+		t.Errorf("got %d duplicate names logged, want %d", got, n-1)
+	}
+}
+
+func TestReservedPaths(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []admit.Option
+		// path is the path a handler is registered at, if not empty.
+		path string
+		// probe is a GET request that has to keep working.
+		probe string
+	}{
+		{name: "validate path clashing with base path", opts: []admit.Option{admit.WithBasePath("/hook"), admit.WithValidatePath("/hook/")}},
+		{name: "base path clashing with probe", opts: []admit.Option{admit.WithBasePath("/healthz")}, probe: "/healthz"},
+		{name: "handler at validate path", path: "/validate"},
+		{name: "handler at healthz", path: "/healthz", probe: "/healthz"},
+		{name: "handler at readyz", path: "/readyz/", probe: "/readyz"},
+		{name: "handler at debug handlers", opts: []admit.Option{admit.WithDebugHandlers(true)}, path: "/debug/handlers", probe: "/debug/handlers"},
+		{name: "handler at metrics", opts: []admit.Option{admit.WithMetrics(metricsHandler{})}, path: "/metrics", probe: "/metrics"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, buf := bufferLogger(admit.LevelError)
+			var ac admit.AdmissionController
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("panicked: %v", r)
+					}
+				}()
+				ac = admit.New(append([]admit.Option{admit.WithLogger(logger)}, tt.opts...)...)
+				if tt.path != "" {
+					ac.Handle(tt.path, "clashing", patching("a"))
+				}
+			}()
+			if !strings.Contains(buf.String(), "is already served") {
+				t.Errorf("got log %q, want the clash logged", buf)
+			}
+			if tt.probe != "" {
+				ac.SetReady(true)
+				rec := httptest.NewRecorder()
+				ac.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.probe, nil))
+				if rec.Code != http.StatusOK {
+					t.Errorf("got status %d for %s, want it still served", rec.Code, tt.probe)
+				}
+			}
+			for _, name := range ac.Handlers() {
+				if name == "clashing" {
+					t.Error("handler at a reserved path got registered")
+				}
+			}
+		})
+	}
+}
+
+func TestBasePathClashingWithProbe(t *testing.T) {
+	logger, buf := bufferLogger(admit.LevelError)
+	ac := admit.New(admit.WithLogger(logger), admit.WithBasePath("/healthz"))
+	ac.Register("clashing", patching("a"))
+
+	if !strings.Contains(buf.String(), "path /healthz is not served by handlers") {
+		t.Errorf("got log %q, want the refused handler logged", buf)
+	}
+	if got := ac.Paths(); len(got) != 0 {
+		t.Errorf("got paths %q, want none", got)
+	}
+	if got := ac.Handlers(); len(got) != 0 {
+		t.Errorf("got handlers %q, want none", got)
+	}
+}
+
+// metricsHandler is a MetricsRecorder serving an empty page of metrics.
+type metricsHandler struct{}
+
+func (metricsHandler) ObserveHandler(string, string, time.Duration) {}
+
+func (metricsHandler) ServeHTTP(http.ResponseWriter, *http.Request) {}
+
+func TestMethodNotAllowed(t *testing.T) {
+	body := mustMarshal(t, newReview(podRequest(t, testPod())))
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		opts      []admit.Option
+		wantCode  int
+		wantAllow string
+	}{
+		{name: "get mutate", method: http.MethodGet, path: "/mutate", wantCode: http.StatusMethodNotAllowed, wantAllow: "POST"},
+		{name: "put validate", method: http.MethodPut, path: "/validate", wantCode: http.StatusMethodNotAllowed, wantAllow: "POST"},
+		{name: "head mutate", method: http.MethodHead, path: "/mutate", wantCode: http.StatusMethodNotAllowed, wantAllow: "POST"},
+		{name: "delete at base path", method: http.MethodDelete, path: "/webhook", opts: []admit.Option{admit.WithBasePath("/webhook")}, wantCode: http.StatusMethodNotAllowed, wantAllow: "POST"},
+		{name: "post", method: http.MethodPost, path: "/mutate", wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(tt.opts...)
+			ac.Register("label", patching("a"))
+			r := httptest.NewRequest(tt.method, tt.path, bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			ac.ServeHTTP(rec, r)
+
+			if rec.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Header().Values("Allow"); !reflect.DeepEqual(got, nonEmpty(tt.wantAllow)) {
+				t.Errorf("got Allow header %q, want %q", got, tt.wantAllow)
+			}
+		})
+	}
+}
+
+// nonEmpty returns the header values holding s, which are none if s is empty.
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+func FuzzDoServeAdmitFunc(f *testing.F) {
+	v1 := mustMarshal(f, newReview(podRequest(f, testPod())))
+	v1beta1 := bytes.Replace(v1, []byte(`"admission.k8s.io/v1"`), []byte(`"admission.k8s.io/v1beta1"`), 1)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(v1)
+	zw.Close()
+	yamlV1, err := yaml.JSONToYAML(v1)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, seed := range []struct {
+		contentType string
+		gzipped     bool
+		body        []byte
+	}{
+		{contentType: "application/json", body: v1},
+		{contentType: "application/json", body: v1beta1},
+		{contentType: "application/json", body: []byte("null")},
+		{contentType: "application/json", body: []byte("[]")},
+		{contentType: "application/json", body: []byte(`{"request":{"object":5}}`)},
+		{contentType: "application/json", gzipped: true, body: compressed.Bytes()},
+		{contentType: "application/json", gzipped: true, body: compressed.Bytes()[:compressed.Len()/2]},
+		{contentType: "application/yaml", body: yamlV1},
+		{contentType: "application/yaml", body: []byte("a: &a [*a, *a]\nb: *a\n")},
+	} {
+		f.Add(seed.contentType, seed.gzipped, seed.body)
+	}
+
+	ac := admit.New()
+	ac.RegisterPod("env", func(pod *coreV1.Pod, _ *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+		return admit.InjectEnv(pod, []coreV1.EnvVar{{Name: "REGION", Value: "eu"}}), nil
+	})
+	ac.Register("label", patching("a"))
+	ac.RegisterValidator("policy", func(req *admissionV1.AdmissionRequest) error {
+		return admit.DecodeTarget(req, &coreV1.Pod{})
+	})
+	f.Fuzz(func(t *testing.T, contentType string, gzipped bool, body []byte) {
+		for _, path := range []string{"/mutate", "/validate"} {
+			r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+			r.Header.Set("Content-Type", contentType)
+			if gzipped {
+				r.Header.Set("Content-Encoding", "gzip")
+			}
+			rec := httptest.NewRecorder()
+			ac.ServeHTTP(rec, r)
+
+			if rec.Code < http.StatusOK || rec.Code > 599 {
+				t.Fatalf("got status %d", rec.Code)
+			}
+			if rec.Code != http.StatusOK {
+				if rec.Code < http.StatusBadRequest || !json.Valid(rec.Body.Bytes()) {
+					t.Fatalf("got status %d with body %q, want an error as JSON", rec.Code, rec.Body)
+				}
+				continue
+			}
+			var review admissionV1.AdmissionReview
+			if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil || review.Response == nil {
+				t.Fatalf("got body %q, want an AdmissionReview with a response: %v", rec.Body, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,24 @@
+package admit
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// bearerPrefix precedes the token in the Authorization header.
+const bearerPrefix = "Bearer "
+
+// authorized checks if the request carries the bearer token the controller was configured with, if any. The tokens
+// are compared in constant time, so the comparison does not leak how much of the token was guessed.
+func (ac *admissionController) authorized(r *http.Request) bool {
+	if ac.authToken == "" {
+		return true
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, bearerPrefix) {
+		return false
+	}
+	token := strings.TrimPrefix(header, bearerPrefix)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(ac.authToken)) == 1
+}
@@ -0,0 +1,48 @@
+package admit_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+)
+
+func TestAuthToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		body          []byte
+		wantCode      int
+	}{
+		{name: "valid token", token: "secret", authorization: "Bearer secret", wantCode: http.StatusOK},
+		{name: "invalid token", token: "secret", authorization: "Bearer guess", wantCode: http.StatusUnauthorized},
+		{name: "token prefix", token: "secret", authorization: "Bearer secre", wantCode: http.StatusUnauthorized},
+		{name: "missing token", token: "secret", wantCode: http.StatusUnauthorized},
+		{name: "other scheme", token: "secret", authorization: "Basic secret", wantCode: http.StatusUnauthorized},
+		{name: "checked before parsing", token: "secret", body: []byte("{"), wantCode: http.StatusUnauthorized},
+		{name: "no token configured", authorization: "Bearer anything", wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(admit.WithAuthToken(tt.token))
+			ac.Register("label", patching("a"))
+
+			body := tt.body
+			if body == nil {
+				body = mustMarshal(t, newReview(podRequest(t, testPod())))
+			}
+			header := http.Header{"Content-Type": {"application/json"}}
+			if tt.authorization != "" {
+				header.Set("Authorization", tt.authorization)
+			}
+			rec := send(ac, "/mutate", body, header)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.wantCode)
+			}
+			if tt.wantCode == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("got WWW-Authenticate %q, want Bearer", rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
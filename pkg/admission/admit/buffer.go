@@ -0,0 +1,45 @@
+package admit
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+)
+
+// maxPooledBufferBytes is the capacity above which buffers are not returned to the pool, so a single large response
+// does not keep its memory in use for all subsequent ones.
+const maxPooledBufferBytes = 1 << 20
+
+// bufferPool holds the buffers responses are encoded to, which are reused across requests to reduce the allocations
+// under heavy load, see BenchmarkDoServeAdmitFunc.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// getBuffer returns an empty buffer from the pool.
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns the buffer to the pool. Neither it nor the bytes it returned may be used afterwards.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferBytes {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// encodeJSON encodes v to buf like json.Marshal, but without copying the result out of the encoder. The encoder does
+// not escape, so it is not allocated on the heap and needs no pooling of its own.
+func encodeJSON(buf *bytes.Buffer, v interface{}) error {
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+	// Unlike json.Marshal, the encoder terminates the value with a newline.
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
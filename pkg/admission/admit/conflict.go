@@ -0,0 +1,262 @@
+package admit
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ConflictPolicy decides how patch operations of different handlers with the same op and path are treated. Operations
+// appending to a list, i.e. those with a path ending in /-, and test operations never conflict this way, so the
+// preconditions of all handlers are kept. Operations of different handlers colliding on list items referenced by
+// index, e.g. one handler inserting /spec/volumes/0 and another replacing /spec/volumes/1, deny the request regardless
+// of the policy.
+//
+// Handlers initializing the same missing map or list, as EnsureLabel and InjectVolume do before adding to it, do not
+// conflict under any policy: only the first initialization is applied, so the entries added by all handlers are kept.
+type ConflictPolicy int
+
+const (
+	// ConflictIgnore emits all patch operations as returned by the handlers, except redundant initializations. This is
+	// the default.
+	ConflictIgnore ConflictPolicy = iota
+	// ConflictLastWins drops the operations of earlier handlers that an operation of a later registered handler has
+	// the same op and path as, or sets the value of as a whole, so the last registered handler takes precedence.
+	ConflictLastWins
+	// ConflictDeny denies requests for which handlers return operations with the same op and path. So do operations
+	// setting a value as a whole another handler patched within, e.g. one handler adding /metadata/labels/a and a
+	// later one adding /metadata/labels, as the later operation would silently discard the earlier one.
+	ConflictDeny
+)
+
+// patchKey identifies the target of a patch operation for conflict detection.
+type patchKey struct {
+	op, path string
+}
+
+// appendPatches adds the patches returned by the named handler to acc, resolving conflicts with the patches of
+// earlier handlers according to the conflict policy. owners holds the name of the handler of each accumulated patch
+// and is returned updated.
+func (ac *admissionController) appendPatches(acc *Result, owners []string, name string, patches []PatchOperation) ([]string, error) {
+	patches = withoutRedundantInits(acc.Patches, patches)
+	if err := ac.checkIndexCollisions(acc.Patches, owners, name, patches); err != nil {
+		return owners, err
+	}
+	if ac.conflictPolicy == ConflictDeny {
+		if err := checkOverwrites(acc.Patches, owners, name, patches); err != nil {
+			return owners, err
+		}
+	}
+	if ac.conflictPolicy == ConflictIgnore || len(acc.Patches) == 0 {
+		acc.Patches = append(acc.Patches, patches...)
+		return append(owners, repeat(name, len(patches))...), nil
+	}
+
+	targets := make(map[patchKey]bool, len(patches))
+	for _, p := range patches {
+		if !appends(p.Path) && p.Op != "test" {
+			targets[patchKey{p.Op, p.Path}] = true
+		}
+	}
+
+	kept, keptOwners := acc.Patches[:0], owners[:0]
+	for i, p := range acc.Patches {
+		overridden := targets[patchKey{p.Op, p.Path}]
+		if !overridden && ac.conflictPolicy == ConflictLastWins {
+			overridden = overwrittenBy(p, patches)
+		}
+		if !overridden {
+			kept = append(kept, p)
+			keptOwners = append(keptOwners, owners[i])
+			continue
+		}
+		if ac.conflictPolicy == ConflictDeny {
+			return owners, fmt.Errorf("handlers %s and %s conflict on %s %s", owners[i], name, p.Op, p.Path)
+		}
+		ac.logger.Warn("overriding patch operation", "op", p.Op, "path", p.Path, "handler", owners[i], "overriddenBy", name)
+	}
+	acc.Patches = append(kept, patches...)
+	return append(keptOwners, repeat(name, len(patches))...), nil
+}
+
+// appends checks if the path of a patch operation refers to the end of a list, e.g. /spec/volumes/-.
+func appends(path string) bool {
+	return strings.HasSuffix(path, "/-")
+}
+
+// withoutRedundantInits returns the patches except those initializing a map or list the accumulated operations
+// already add, which would discard the entries added to it since.
+func withoutRedundantInits(acc, patches []PatchOperation) []PatchOperation {
+	kept := make([]PatchOperation, 0, len(patches))
+	for _, p := range patches {
+		if !redundantInit(acc, p) {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// redundantInit checks if the operation adds an empty map or list at a path the last of the accumulated operations on
+// it already adds a value of the same kind at.
+func redundantInit(acc []PatchOperation, p PatchOperation) bool {
+	if p.Op != "add" {
+		return false
+	}
+	for i := len(acc) - 1; i >= 0; i-- {
+		if acc[i].Path != p.Path {
+			continue
+		}
+		if acc[i].Op != "add" && acc[i].Op != "replace" {
+			return false
+		}
+		kind, empty := jsonKind(p.Value)
+		accKind, _ := jsonKind(acc[i].Value)
+		return empty && kind == accKind
+	}
+	return false
+}
+
+// jsonKind returns the first byte of the JSON encoding of the value, which is '{' for maps and '[' for lists, and
+// whether it is an empty map or list. Values that cannot be marshaled are of kind 0.
+func jsonKind(value interface{}) (kind byte, empty bool) {
+	b, err := json.Marshal(value)
+	if err != nil || len(b) == 0 {
+		return 0, false
+	}
+	return b[0], len(b) == 2 && (b[0] == '{' || b[0] == '[')
+}
+
+// overwrites checks if the operation q sets the value at its path as a whole, discarding the operation p within it.
+// Operations on list items referenced by index are left to collides.
+func overwrites(q, p PatchOperation) bool {
+	if q.Op == "test" || p.Op == "test" || !strings.HasPrefix(p.Path, q.Path+"/") {
+		return false
+	}
+	last := q.Path[strings.LastIndex(q.Path, "/")+1:]
+	return last != "-" && !isIndex(last)
+}
+
+// overwrittenBy checks if one of the patches sets a value as a whole the operation p is within.
+func overwrittenBy(p PatchOperation, patches []PatchOperation) bool {
+	for _, q := range patches {
+		if overwrites(q, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOverwrites fails if patch operations of the named handler overwrite accumulated ones of other handlers within
+// the value they set.
+func checkOverwrites(acc []PatchOperation, owners []string, name string, patches []PatchOperation) error {
+	for i, p := range acc {
+		if owners[i] == name {
+			continue
+		}
+		for _, q := range patches {
+			if overwrites(q, p) {
+				return fmt.Errorf("handlers %s and %s conflict: %s %s overwrites %s %s", owners[i], name, q.Op, q.Path, p.Op, p.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// indexRef is a reference of a patch operation to an item of a list by its index.
+type indexRef struct {
+	// list is the path of the list and index the index of the item.
+	list, index string
+	// whole is set if the operation targets the item itself rather than a field within it.
+	whole bool
+}
+
+// indexRefs returns the references of the path to list items by index, e.g. /spec/volumes/0/name references the item
+// 0 of /spec/volumes.
+func indexRefs(path string) []indexRef {
+	tokens := strings.Split(path, "/")
+	var refs []indexRef
+	for i, token := range tokens {
+		if i > 0 && isIndex(token) {
+			refs = append(refs, indexRef{list: strings.Join(tokens[:i], "/"), index: token, whole: i == len(tokens)-1})
+		}
+	}
+	return refs
+}
+
+// isIndex checks if the JSON pointer token is an array index.
+func isIndex(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, r := range token {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// collides checks if patch operations of different handlers referencing list items by index cannot be applied in
+// one patch: adding or removing an item shifts the indexes of the item and the following ones the other handler refers
+// to, and replacing an item discards the changes of the other handler within it.
+func collides(p, q PatchOperation) bool {
+	for _, a := range indexRefs(p.Path) {
+		for _, b := range indexRefs(q.Path) {
+			if a.list != b.list {
+				continue
+			}
+			if (a.whole && shiftsIndexes(p.Op) && !indexBefore(b.index, a.index)) ||
+				(b.whole && shiftsIndexes(q.Op) && !indexBefore(a.index, b.index)) {
+				return true
+			}
+			if a.index == b.index && (a.whole || b.whole) && (p.Op != "test" || q.Op != "test") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shiftsIndexes checks if the operation shifts the indexes of the following items when targeting a list item.
+func shiftsIndexes(op string) bool {
+	return op == "add" || op == "remove"
+}
+
+// indexBefore checks if the list index i is less than j. Both are tokens accepted by isIndex, compared by value
+// without converting them, so overlong indexes cannot overflow.
+func indexBefore(i, j string) bool {
+	i, j = strings.TrimLeft(i, "0"), strings.TrimLeft(j, "0")
+	if len(i) != len(j) {
+		return len(i) < len(j)
+	}
+	return i < j
+}
+
+// checkIndexCollisions fails if patch operations of the named handler collide with accumulated ones of other handlers
+// on list items referenced by index. Operations with the same op and path are left to the conflict policy, unless it
+// ignores conflicts.
+func (ac *admissionController) checkIndexCollisions(acc []PatchOperation, owners []string, name string, patches []PatchOperation) error {
+	for i, p := range acc {
+		if owners[i] == name {
+			continue
+		}
+		for _, q := range patches {
+			if ac.conflictPolicy != ConflictIgnore && p.Op == q.Op && p.Path == q.Path {
+				continue
+			}
+			if collides(p, q) {
+				return fmt.Errorf("handlers %s and %s collide on list indexes: %s %s and %s %s", owners[i], name, p.Op, p.Path, q.Op, q.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// repeat returns a slice holding s n times.
+func repeat(s string, n int) []string {
+	r := make([]string, n)
+	for i := range r {
+		r[i] = s
+	}
+	return r
+}
@@ -0,0 +1,344 @@
+package admit_test
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	admissionV1 "k8s.io/api/admission/v1"
+	coreV1 "k8s.io/api/core/v1"
+)
+
+// labelling returns a PodAdmitFunc ensuring the label key.
+func labelling(key string) admit.PodAdmitFunc {
+	return func(pod *coreV1.Pod, _ *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+		return admit.EnsureLabel(pod, key, "true"), nil
+	}
+}
+
+// withVolume returns a PodAdmitFunc injecting an empty dir volume of the name.
+func withVolume(name string) admit.PodAdmitFunc {
+	return func(pod *coreV1.Pod, _ *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+		return admit.InjectVolume(pod, coreV1.Volume{Name: name}), nil
+	}
+}
+
+// withEnv returns a PodAdmitFunc injecting the environment variable into all containers.
+func withEnv(name string) admit.PodAdmitFunc {
+	return func(pod *coreV1.Pod, _ *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+		return admit.InjectEnv(pod, []coreV1.EnvVar{{Name: name, Value: "1"}}), nil
+	}
+}
+
+// settingLabels returns a PodAdmitFunc setting all labels of the pod at once.
+func settingLabels(labels map[string]string) admit.PodAdmitFunc {
+	return func(*coreV1.Pod, *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+		return new(admit.PatchBuilder).Add("/metadata/labels", labels).Build(), nil
+	}
+}
+
+// resolvingPolicies are the conflict policies not ignoring conflicts.
+var resolvingPolicies = []struct {
+	name   string
+	policy admit.ConflictPolicy
+}{
+	{name: "last wins", policy: admit.ConflictLastWins},
+	{name: "deny", policy: admit.ConflictDeny},
+}
+
+// annotatingWith returns a PodAdmitFunc setting the annotation foo to the value.
+func annotatingWith(value string) admit.PodAdmitFunc {
+	return func(*coreV1.Pod, *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+		return new(admit.PatchBuilder).Add("/metadata/annotations", map[string]string{"foo": value}).Build(), nil
+	}
+}
+
+func TestInitializingHandlersKeepEntries(t *testing.T) {
+	tests := []struct {
+		name     string
+		handlers []admit.PodAdmitFunc
+		check    func(t *testing.T, pod *coreV1.Pod)
+	}{
+		{
+			name:     "labels",
+			handlers: []admit.PodAdmitFunc{labelling("a"), labelling("b")},
+			check: func(t *testing.T, pod *coreV1.Pod) {
+				if want := map[string]string{"a": "true", "b": "true"}; !reflect.DeepEqual(pod.Labels, want) {
+					t.Errorf("got labels %v, want %v", pod.Labels, want)
+				}
+			},
+		},
+		{
+			name:     "volumes",
+			handlers: []admit.PodAdmitFunc{withVolume("a"), withVolume("b")},
+			check: func(t *testing.T, pod *coreV1.Pod) {
+				if len(pod.Spec.Volumes) != 2 || pod.Spec.Volumes[0].Name != "a" || pod.Spec.Volumes[1].Name != "b" {
+					t.Errorf("got volumes %v, want a and b", pod.Spec.Volumes)
+				}
+			},
+		},
+		{
+			name:     "env",
+			handlers: []admit.PodAdmitFunc{withEnv("A"), withEnv("B")},
+			check: func(t *testing.T, pod *coreV1.Pod) {
+				if env := pod.Spec.Containers[0].Env; len(env) != 2 || env[0].Name != "A" || env[1].Name != "B" {
+					t.Errorf("got env %v, want A and B", env)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		for _, policy := range resolvingPolicies {
+			t.Run(tt.name+"/"+policy.name, func(t *testing.T) {
+				ac := admit.New(admit.WithPatchValidation(true), admit.WithConflictPolicy(policy.policy))
+				for i, h := range tt.handlers {
+					ac.RegisterPod("handler-"+strconv.Itoa(i), h)
+				}
+
+				pod := testPod()
+				res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, pod))))
+				if !res.Allowed {
+					t.Fatalf("got denied: %s", messageOf(res))
+				}
+				tt.check(t, applyToPod(t, pod, patchesOf(t, res)))
+			})
+		}
+	}
+}
+
+func TestConflictPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   admit.ConflictPolicy
+		handlers []admit.PodAdmitFunc
+		// wantLabels and wantAnnotations are the metadata of the patched pod, wantMessage the message of a denial.
+		wantLabels      map[string]string
+		wantAnnotations map[string]string
+		wantMessage     []string
+		wantOverride    bool
+	}{
+		{
+			name:            "same path ignored",
+			policy:          admit.ConflictIgnore,
+			handlers:        []admit.PodAdmitFunc{annotatingWith("first"), annotatingWith("second")},
+			wantAnnotations: map[string]string{"foo": "second"},
+		},
+		{
+			name:            "same path last wins",
+			policy:          admit.ConflictLastWins,
+			handlers:        []admit.PodAdmitFunc{annotatingWith("first"), annotatingWith("second")},
+			wantAnnotations: map[string]string{"foo": "second"},
+			wantOverride:    true,
+		},
+		{
+			name:        "same path denied",
+			policy:      admit.ConflictDeny,
+			handlers:    []admit.PodAdmitFunc{annotatingWith("first"), annotatingWith("second")},
+			wantMessage: []string{"handlers handler-0 and handler-1 conflict on add /metadata/annotations"},
+		},
+		{
+			name:       "overwrite ignored",
+			policy:     admit.ConflictIgnore,
+			handlers:   []admit.PodAdmitFunc{labelling("a"), settingLabels(map[string]string{"b": "true"})},
+			wantLabels: map[string]string{"b": "true"},
+		},
+		{
+			name:       "initialization ignored",
+			policy:     admit.ConflictIgnore,
+			handlers:   []admit.PodAdmitFunc{labelling("a"), labelling("b")},
+			wantLabels: map[string]string{"a": "true", "b": "true"},
+		},
+		{
+			name:         "overwrite last wins",
+			policy:       admit.ConflictLastWins,
+			handlers:     []admit.PodAdmitFunc{labelling("a"), settingLabels(map[string]string{"b": "true"})},
+			wantLabels:   map[string]string{"b": "true"},
+			wantOverride: true,
+		},
+		{
+			name:        "overwrite denied",
+			policy:      admit.ConflictDeny,
+			handlers:    []admit.PodAdmitFunc{labelling("a"), settingLabels(map[string]string{"b": "true"})},
+			wantMessage: []string{"handler-0 and handler-1 conflict", "/metadata/labels/a"},
+		},
+		{
+			name:       "label after overwrite last wins",
+			policy:     admit.ConflictLastWins,
+			handlers:   []admit.PodAdmitFunc{settingLabels(map[string]string{"b": "true"}), labelling("a")},
+			wantLabels: map[string]string{"a": "true", "b": "true"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, buf := bufferLogger(admit.LevelWarn)
+			ac := admit.New(admit.WithLogger(logger), admit.WithPatchValidation(true), admit.WithConflictPolicy(tt.policy))
+			for i, h := range tt.handlers {
+				ac.RegisterPod("handler-"+strconv.Itoa(i), h)
+			}
+
+			pod := testPod()
+			res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, pod))))
+			if tt.wantMessage != nil {
+				if res.Allowed {
+					t.Fatalf("got allowed with patch %s", res.Patch)
+				}
+				for _, want := range tt.wantMessage {
+					if msg := messageOf(res); !strings.Contains(msg, want) {
+						t.Errorf("got message %q, want it to contain %q", msg, want)
+					}
+				}
+				return
+			}
+			if !res.Allowed {
+				t.Fatalf("got denied: %s", messageOf(res))
+			}
+			patched := applyToPod(t, pod, patchesOf(t, res))
+			if !reflect.DeepEqual(patched.Labels, tt.wantLabels) {
+				t.Errorf("got labels %v, want %v", patched.Labels, tt.wantLabels)
+			}
+			if !reflect.DeepEqual(patched.Annotations, tt.wantAnnotations) {
+				t.Errorf("got annotations %v, want %v", patched.Annotations, tt.wantAnnotations)
+			}
+			overridden := strings.Contains(buf.String(), "overriding patch operation") && strings.Contains(buf.String(), "overriddenBy=handler-1")
+			if overridden != tt.wantOverride {
+				t.Errorf("got override logged %t, want %t: %q", overridden, tt.wantOverride, buf.String())
+			}
+		})
+	}
+}
+
+func TestTestOperationsNeverConflict(t *testing.T) {
+	precondition := admit.PatchOperation{Op: "test", Path: "/metadata/name", Value: "web"}
+	policies := append([]struct {
+		name   string
+		policy admit.ConflictPolicy
+	}{{name: "ignore", policy: admit.ConflictIgnore}}, resolvingPolicies...)
+	for _, policy := range policies {
+		t.Run(policy.name, func(t *testing.T) {
+			ac := admit.New(admit.WithConflictPolicy(policy.policy))
+			ac.Register("first", returning(precondition, admit.PatchOperation{Op: "add", Path: "/metadata/labels", Value: map[string]string{"a": "true"}}))
+			ac.Register("second", returning(precondition, admit.PatchOperation{Op: "add", Path: "/metadata/annotations", Value: map[string]string{"b": "true"}}))
+
+			res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+			if !res.Allowed {
+				t.Fatalf("got denied: %s", messageOf(res))
+			}
+			tests := 0
+			for _, p := range patchesOf(t, res) {
+				if p.Op == "test" {
+					tests++
+				}
+			}
+			if tests != 2 {
+				t.Errorf("got %d test operations, want the ones of both handlers", tests)
+			}
+		})
+	}
+}
+
+func TestIndexCollisions(t *testing.T) {
+	op := func(op, path string) admit.PatchOperation {
+		return admit.PatchOperation{Op: op, Path: path, Value: map[string]string{"name": "v"}}
+	}
+	tests := []struct {
+		name   string
+		first  []admit.PatchOperation
+		second []admit.PatchOperation
+		policy admit.ConflictPolicy
+		// wantCollision is the message of the collision, none is expected if it is empty.
+		wantCollision string
+	}{
+		{
+			name:   "appends",
+			first:  []admit.PatchOperation{op("add", "/spec/volumes/-")},
+			second: []admit.PatchOperation{op("add", "/spec/volumes/-")},
+		},
+		{
+			name:          "replacing the same index",
+			first:         []admit.PatchOperation{op("replace", "/spec/volumes/0")},
+			second:        []admit.PatchOperation{op("replace", "/spec/volumes/0")},
+			policy:        admit.ConflictIgnore,
+			wantCollision: "handlers first and second collide on list indexes: replace /spec/volumes/0 and replace /spec/volumes/0",
+		},
+		{
+			name:          "insert shifting indexes",
+			first:         []admit.PatchOperation{op("add", "/spec/volumes/0")},
+			second:        []admit.PatchOperation{op("replace", "/spec/volumes/1/name")},
+			wantCollision: "handlers first and second collide on list indexes: add /spec/volumes/0 and replace /spec/volumes/1/name",
+		},
+		{
+			name:          "remove shifting indexes",
+			first:         []admit.PatchOperation{op("replace", "/spec/containers/1/image")},
+			second:        []admit.PatchOperation{op("remove", "/spec/containers/0")},
+			wantCollision: "handlers first and second collide on list indexes: replace /spec/containers/1/image and remove /spec/containers/0",
+		},
+		{
+			name:          "replacing an item changed within",
+			first:         []admit.PatchOperation{op("add", "/spec/containers/0/env/-")},
+			second:        []admit.PatchOperation{op("replace", "/spec/containers/0")},
+			wantCollision: "handlers first and second collide on list indexes: add /spec/containers/0/env/- and replace /spec/containers/0",
+		},
+		{
+			name:   "remove after the referenced index",
+			first:  []admit.PatchOperation{op("remove", "/spec/containers/2")},
+			second: []admit.PatchOperation{op("replace", "/spec/containers/0/image")},
+		},
+		{
+			name:   "insert after the referenced index",
+			first:  []admit.PatchOperation{op("replace", "/spec/volumes/1/name")},
+			second: []admit.PatchOperation{op("add", "/spec/volumes/10")},
+		},
+		{
+			name:          "remove at the referenced index",
+			first:         []admit.PatchOperation{op("remove", "/spec/containers/1")},
+			second:        []admit.PatchOperation{op("replace", "/spec/containers/1/image")},
+			wantCollision: "handlers first and second collide on list indexes: remove /spec/containers/1 and replace /spec/containers/1/image",
+		},
+		{
+			name:          "insert before a larger index",
+			first:         []admit.PatchOperation{op("replace", "/spec/volumes/10/name")},
+			second:        []admit.PatchOperation{op("add", "/spec/volumes/9")},
+			wantCollision: "handlers first and second collide on list indexes: replace /spec/volumes/10/name and add /spec/volumes/9",
+		},
+		{
+			name:   "changes within the same item",
+			first:  []admit.PatchOperation{op("replace", "/spec/containers/0/image")},
+			second: []admit.PatchOperation{op("add", "/spec/containers/0/env/-")},
+		},
+		{
+			name:   "different lists",
+			first:  []admit.PatchOperation{op("add", "/spec/volumes/0")},
+			second: []admit.PatchOperation{op("replace", "/spec/containers/0/image")},
+		},
+		{
+			name:  "same handler",
+			first: []admit.PatchOperation{op("add", "/spec/volumes/0"), op("replace", "/spec/volumes/1/name")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(admit.WithConflictPolicy(tt.policy))
+			ac.Register("first", returning(tt.first...))
+			ac.Register("second", returning(tt.second...))
+
+			res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+			if tt.wantCollision == "" {
+				if !res.Allowed {
+					t.Fatalf("got denied: %s", messageOf(res))
+				}
+				if got, want := len(patchesOf(t, res)), len(tt.first)+len(tt.second); got != want {
+					t.Errorf("got %d patch operations, want %d", got, want)
+				}
+				return
+			}
+			if res.Allowed {
+				t.Fatalf("got allowed with patch %s, want a collision", res.Patch)
+			}
+			if msg := messageOf(res); !strings.Contains(msg, tt.wantCollision) {
+				t.Errorf("got message %q, want it to contain %q", msg, tt.wantCollision)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package admit
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// YAML media types accepted besides JSON, e.g. from debugging clients. The apiserver always sends JSON.
+const (
+	yamlContentType       = `application/yaml`
+	legacyYAMLContentType = `application/x-yaml`
+)
+
+// isYAML checks if the media type is one of the YAML ones.
+func isYAML(mediaType string) bool {
+	return mediaType == yamlContentType || mediaType == legacyYAMLContentType
+}
+
+// bodyToJSON returns the request body of the given content type as JSON, converting YAML bodies.
+func bodyToJSON(contentType string, body []byte) ([]byte, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || (mediaType != jsonContentType && !isYAML(mediaType)) {
+		return nil, httpErrorf(http.StatusBadRequest, "unsupported content type %s, only %s and %s are supported", contentType, jsonContentType, yamlContentType)
+	}
+	if mediaType == jsonContentType {
+		return body, nil
+	}
+	converted, err := yaml.YAMLToJSON(body)
+	if err != nil {
+		return nil, httpErrorf(http.StatusBadRequest, "could not convert YAML request body: %v", err)
+	}
+	return converted, nil
+}
+
+// responseContentType returns the first of JSON and YAML the Accept header asks for, defaulting to JSON.
+func responseContentType(accept string) string {
+	for _, entry := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(entry))
+		if err != nil {
+			continue
+		}
+		if mediaType == jsonContentType {
+			return jsonContentType
+		}
+		if isYAML(mediaType) {
+			return yamlContentType
+		}
+	}
+	return jsonContentType
+}
+
+// encodeAs converts the JSON body of a response to the content type returned by responseContentType.
+func encodeAs(contentType string, body []byte) ([]byte, error) {
+	if contentType != yamlContentType {
+		return body, nil
+	}
+	return yaml.JSONToYAML(body)
+}
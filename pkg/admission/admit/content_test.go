@@ -0,0 +1,110 @@
+package admit_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	admissionV1 "k8s.io/api/admission/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestContentTypes(t *testing.T) {
+	body := mustMarshal(t, newReview(podRequest(t, testPod())))
+	tests := []struct {
+		contentType string
+		wantCode    int
+	}{
+		{contentType: "application/json", wantCode: http.StatusOK},
+		{contentType: "application/json; charset=utf-8", wantCode: http.StatusOK},
+		{contentType: "Application/JSON", wantCode: http.StatusOK},
+		{contentType: "text/plain", wantCode: http.StatusBadRequest},
+		{contentType: "application/json;;", wantCode: http.StatusBadRequest},
+		{contentType: "", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			ac := admit.New()
+			rec := send(ac, "/mutate", body, http.Header{"Content-Type": {tt.contentType}})
+			if rec.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+		})
+	}
+}
+
+func TestResponseContentType(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     []byte
+		wantCode int
+	}{
+		{name: "review", body: mustMarshal(t, newReview(podRequest(t, testPod()))), wantCode: http.StatusOK},
+		{name: "error", body: []byte("{"), wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			ac.Register("label", patching("a"))
+			rec := post(t, ac, "/mutate", tt.body)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("got content type %q, want application/json", got)
+			}
+		})
+	}
+}
+
+func TestYAMLReviews(t *testing.T) {
+	jsonBody := mustMarshal(t, newReview(podRequest(t, testPod())))
+	yamlBody, err := yaml.JSONToYAML(jsonBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		accept      string
+		body        []byte
+		wantCode    int
+		wantType    string
+	}{
+		{name: "yaml request", contentType: "application/yaml", body: yamlBody, wantCode: http.StatusOK, wantType: "application/json"},
+		{name: "legacy yaml request", contentType: "application/x-yaml", body: yamlBody, wantCode: http.StatusOK, wantType: "application/json"},
+		{name: "yaml round-trip", contentType: "application/yaml", accept: "application/yaml", body: yamlBody, wantCode: http.StatusOK, wantType: "application/yaml"},
+		{name: "yaml response", contentType: "application/json", accept: "application/x-yaml", body: jsonBody, wantCode: http.StatusOK, wantType: "application/yaml"},
+		{name: "json preferred", contentType: "application/yaml", accept: "application/json, application/yaml", body: yamlBody, wantCode: http.StatusOK, wantType: "application/json"},
+		{name: "malformed yaml", contentType: "application/yaml", accept: "application/yaml", body: []byte("request: [\n"), wantCode: http.StatusBadRequest, wantType: "application/yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			ac.Register("label", patching("a"))
+			header := http.Header{"Content-Type": {tt.contentType}}
+			if tt.accept != "" {
+				header.Set("Accept", tt.accept)
+			}
+			rec := send(ac, "/mutate", tt.body, header)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("got content type %q, want %q", got, tt.wantType)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			// YAML is a superset of JSON, so both kinds of responses decode the same way.
+			var review admissionV1.AdmissionReview
+			if err := yaml.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+				t.Fatalf("could not decode response %s: %v", rec.Body, err)
+			}
+			if res := review.Response; res == nil || !res.Allowed || res.UID != "uid" || len(res.Patch) == 0 {
+				t.Errorf("got response %+v, want an allow with patch", res)
+			}
+		})
+	}
+}
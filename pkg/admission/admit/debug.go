@@ -0,0 +1,78 @@
+package admit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// Diagnostics paths
+const (
+	debugHandlersPath = "/debug/handlers"
+	pprofPath         = "/debug/pprof/"
+)
+
+// PprofHandler returns a handler serving the runtime profiling data of net/http/pprof under /debug/pprof/. It can be
+// served by a separate listener bound to localhost, so that profiles are not exposed with the admission endpoints.
+func PprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(pprofPath, pprof.Index)
+	mux.HandleFunc(pprofPath+"cmdline", pprof.Cmdline)
+	mux.HandleFunc(pprofPath+"profile", pprof.Profile)
+	mux.HandleFunc(pprofPath+"symbol", pprof.Symbol)
+	mux.HandleFunc(pprofPath+"trace", pprof.Trace)
+	return mux
+}
+
+// Handlers returns the names of the registered handlers ordered by the path they are served at, followed by the
+// names of the registered validators.
+func (ac *admissionController) Handlers() []string {
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+	return ac.handlerNames()
+}
+
+// handlerNames returns the names of the registered handlers and validators like Handlers. The caller has to hold mu.
+func (ac *admissionController) handlerNames() []string {
+	var names []string
+	for _, path := range sets.List(sets.KeySet(ac.handlers)) {
+		for _, h := range ac.handlers[path] {
+			names = append(names, h.name)
+		}
+	}
+	for _, v := range ac.validators {
+		names = append(names, v.name)
+	}
+	return names
+}
+
+// handlerNamesByPath returns the names of the registered handlers and validators by the path they are served at.
+func (ac *admissionController) handlerNamesByPath() map[string][]string {
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+	paths := map[string][]string{}
+	for path, handlers := range ac.handlers {
+		paths[path] = []string{}
+		for _, h := range handlers {
+			paths[path] = append(paths[path], h.name)
+		}
+	}
+	for _, v := range ac.validators {
+		paths[ac.validatePath] = append(paths[ac.validatePath], v.name)
+	}
+	return paths
+}
+
+// serveDebugHandlers lists the names of the registered handlers by the path they are served at as JSON object.
+func (ac *admissionController) serveDebugHandlers(w http.ResponseWriter, _ *http.Request) {
+	bytes, err := json.Marshal(ac.handlerNamesByPath())
+	if err != nil {
+		ac.logger.Error("could not marshal handlers", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	_, _ = w.Write(bytes)
+}
@@ -0,0 +1,114 @@
+package admit_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	admissionV1 "k8s.io/api/admission/v1"
+)
+
+func TestHandlers(t *testing.T) {
+	nop := func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) { return nil, nil }
+	tests := []struct {
+		name      string
+		register  func(admit.AdmissionController)
+		want      []string
+		wantPaths map[string][]string
+	}{
+		{
+			name:      "none",
+			wantPaths: map[string][]string{"/mutate": {}},
+		},
+		{
+			name: "three handlers",
+			register: func(ac admit.AdmissionController) {
+				ac.Register("labels", nop)
+				ac.Register("sidecar", nop)
+				ac.RegisterValidator("policy", func(*admissionV1.AdmissionRequest) error { return nil })
+			},
+			want:      []string{"labels", "sidecar", "policy"},
+			wantPaths: map[string][]string{"/mutate": {"labels", "sidecar"}, "/validate": {"policy"}},
+		},
+		{
+			name: "several paths",
+			register: func(ac admit.AdmissionController) {
+				ac.Handle("/mutate-pods", "pods", nop)
+				ac.Register("labels", nop)
+			},
+			want:      []string{"labels", "pods"},
+			wantPaths: map[string][]string{"/mutate": {"labels"}, "/mutate-pods": {"pods"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(admit.WithDebugHandlers(true))
+			if tt.register != nil {
+				tt.register(ac)
+			}
+			if got := ac.Handlers(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got handlers %v, want %v", got, tt.want)
+			}
+
+			rec := httptest.NewRecorder()
+			ac.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/handlers", nil))
+			if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+				t.Fatalf("got status %d with content type %q", rec.Code, rec.Header().Get("Content-Type"))
+			}
+			var got map[string][]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.wantPaths) {
+				t.Errorf("got handlers by path %v, want %v", got, tt.wantPaths)
+			}
+		})
+	}
+}
+
+func TestDebugHandlersDisabled(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []admit.Option
+	}{
+		{name: "disabled", opts: []admit.Option{admit.WithDebugHandlers(false)}},
+		{name: "by default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			admit.New(tt.opts...).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/handlers", nil))
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("got status %d, want %d", rec.Code, http.StatusNotFound)
+			}
+		})
+	}
+}
+
+func TestPprof(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.Handler
+		path    string
+		want    int
+	}{
+		{name: "index enabled", handler: admit.New(admit.WithPprof(true)), path: "/debug/pprof/", want: http.StatusOK},
+		{name: "cmdline enabled", handler: admit.New(admit.WithPprof(true)), path: "/debug/pprof/cmdline", want: http.StatusOK},
+		{name: "index disabled", handler: admit.New(admit.WithPprof(false)), path: "/debug/pprof/", want: http.StatusNotFound},
+		{name: "index by default", handler: admit.New(), path: "/debug/pprof/", want: http.StatusNotFound},
+		{name: "separate handler", handler: admit.PprofHandler(), path: "/debug/pprof/", want: http.StatusOK},
+		{name: "separate handler without admission", handler: admit.PprofHandler(), path: "/mutate", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.want {
+				t.Errorf("got status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package admit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	admissionV1 "k8s.io/api/admission/v1"
+	admissionV1beta1 "k8s.io/api/admission/v1beta1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	kubeScheme "k8s.io/client-go/kubernetes/scheme"
+)
+
+// DecodeObject decodes the object of the admission request into the given object. It fails for DELETE requests,
+// which carry the object being deleted in OldObject, use DecodeOldObject or DecodeTarget for these.
+func DecodeObject(req *admissionV1.AdmissionRequest, into runtime.Object) error {
+	return decodeRaw(req.Object.Raw, req.Kind, into)
+}
+
+// DecodeOldObject decodes the previous state of the object of an UPDATE admission request, or the object being deleted
+// of a DELETE admission request, into the given object.
+func DecodeOldObject(req *admissionV1.AdmissionRequest, into runtime.Object) error {
+	return decodeRaw(req.OldObject.Raw, req.Kind, into)
+}
+
+// RawObject returns the raw object the admission request is about. Object holds the new state of the object for
+// CREATE, UPDATE and CONNECT requests, while it is empty for DELETE requests, for which OldObject holds the object being
+// deleted. OldObject holds the previous state of the object for UPDATE requests as well. RawObject returns Object if
+// it is populated and OldObject otherwise, which is empty if the request carries neither.
+func RawObject(req *admissionV1.AdmissionRequest) []byte {
+	if len(req.Object.Raw) > 0 {
+		return req.Object.Raw
+	}
+	return req.OldObject.Raw
+}
+
+// DecodeTarget decodes the object the admission request is about, as returned by RawObject, into the given object.
+func DecodeTarget(req *admissionV1.AdmissionRequest, into runtime.Object) error {
+	return decodeRaw(RawObject(req), req.Kind, into)
+}
+
+// AnnotationGate reports whether a handler should run for the object of the admission request according to the boolean
+// annotation key, e.g. to let users opt out of a mutation with an annotation like "example.com/inject: false". Absent
+// annotations yield defaultOn, as do requests without an object. Values that are not booleans are an error, so
+// that typos do not silently fall back to the default.
+func AnnotationGate(req *admissionV1.AdmissionRequest, key string, defaultOn bool) (bool, error) {
+	raw := RawObject(req)
+	if len(raw) == 0 {
+		return defaultOn, nil
+	}
+	var obj metaV1.PartialObjectMetadata
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return false, fmt.Errorf("could not decode metadata of %s object: %v", req.Kind.String(), err)
+	}
+	v, ok := obj.Annotations[key]
+	if !ok {
+		return defaultOn, nil
+	}
+	on, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil {
+		return false, fmt.Errorf("invalid value %q of annotation %s, expected true or false", v, key)
+	}
+	return on, nil
+}
+
+// decodeRaw decodes raw into the given object, failing if the request kind does not fit the type of the object.
+func decodeRaw(raw []byte, kind metaV1.GroupVersionKind, into runtime.Object) error {
+	if len(raw) == 0 {
+		return fmt.Errorf("admission request carries no %s object", kind.String())
+	}
+
+	if !decodesKind(kind, into) {
+		return fmt.Errorf("could not deserialize %s object into %T", kind.String(), into)
+	}
+
+	if _, _, err := UniversalDeserializer.Decode(raw, nil, into); err != nil {
+		return fmt.Errorf("could not deserialize %s object: %v", kind.String(), err)
+	}
+	return nil
+}
+
+// decodesKind checks if objects of the kind can be decoded into the given object. Objects of the built-in API types
+// only hold objects of their group, version and kind, while unstructured objects, object metadata and types unknown to
+// the client-go scheme, e.g. those of custom resources, hold objects of any kind.
+func decodesKind(kind metaV1.GroupVersionKind, into runtime.Object) bool {
+	switch into.(type) {
+	case runtime.Unstructured, *metaV1.PartialObjectMetadata:
+		return true
+	}
+	if kind.Kind == "" {
+		return true
+	}
+	gvks, _, err := kubeScheme.Scheme.ObjectKinds(into)
+	if err != nil {
+		return true
+	}
+	for _, gvk := range gvks {
+		if gvk.Group == kind.Group && gvk.Version == kind.Version && gvk.Kind == kind.Kind {
+			return true
+		}
+	}
+	return false
+}
+
+// bodySnippet returns at most the first n bytes of body for logging, with non-printable characters replaced so the
+// snippet cannot break the log line.
+func bodySnippet(body []byte, n int) string {
+	truncated := len(body) > n
+	if truncated {
+		body = body[:n]
+	}
+	snippet := strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || !unicode.IsPrint(r) {
+			return '.'
+		}
+		return r
+	}, string(body))
+	if truncated {
+		snippet += "..."
+	}
+	return snippet
+}
+
+// reviewKind is the kind of the reviews the controller accepts, supportedReviewVersions are the API versions of the
+// reviews it accepts.
+const reviewKind = "AdmissionReview"
+
+var supportedReviewVersions = sets.New(
+	admissionV1.SchemeGroupVersion.String(),
+	admissionV1beta1.SchemeGroupVersion.String(),
+)
+
+// defaultReviewKind is the kind reviews sent without TypeMeta are decoded as.
+var defaultReviewKind = admissionV1.SchemeGroupVersion.WithKind(reviewKind)
+
+// checkReviewFields fails if the AdmissionReview has fields unknown to its type, e.g. misspelled ones. Only the
+// envelope is checked, not the objects of the request. Both supported versions have the same fields.
+func checkReviewFields(body []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(&admissionV1.AdmissionReview{})
+}
+
+// decodeReview decodes an AdmissionReview of any supported version. Reviews of older versions are converted to v1,
+// but retain the TypeMeta they were sent with, so the response can be returned in the same version. Reviews without
+// TypeMeta are decoded as v1 and get its TypeMeta.
+func decodeReview(body []byte) (*admissionV1.AdmissionReview, error) {
+	// Check the type before decoding, as the deserializer fails with confusing errors for unknown types.
+	var typeMeta metaV1.TypeMeta
+	if err := json.Unmarshal(body, &typeMeta); err != nil {
+		return nil, err
+	}
+	// Some clients omit the TypeMeta altogether, their reviews are taken to be of the current version.
+	omitted := typeMeta.Kind == "" && typeMeta.APIVersion == ""
+	if !omitted && (typeMeta.Kind != reviewKind || !supportedReviewVersions.Has(typeMeta.APIVersion)) {
+		return nil, fmt.Errorf("unsupported review version %q of kind %q, only %s of versions %s are supported",
+			typeMeta.APIVersion, typeMeta.Kind, reviewKind, strings.Join(sets.List(supportedReviewVersions), ", "))
+	}
+
+	obj, gvk, err := UniversalDeserializer.Decode(body, &defaultReviewKind, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch review := obj.(type) {
+	case *admissionV1.AdmissionReview:
+		review.SetGroupVersionKind(*gvk)
+		return review, nil
+	case *admissionV1beta1.AdmissionReview:
+		// The versions are structurally identical, so the request can be converted by its JSON representation.
+		converted := &admissionV1.AdmissionReview{}
+		converted.SetGroupVersionKind(*gvk)
+		if review.Request != nil {
+			b, err := json.Marshal(review.Request)
+			if err != nil {
+				return nil, err
+			}
+			converted.Request = &admissionV1.AdmissionRequest{}
+			if err := json.Unmarshal(b, converted.Request); err != nil {
+				return nil, err
+			}
+		}
+		return converted, nil
+	default:
+		return nil, fmt.Errorf("unexpected object %s", gvk.String())
+	}
+}
@@ -0,0 +1,470 @@
+package admit_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	admissionV1 "k8s.io/api/admission/v1"
+	admissionV1beta1 "k8s.io/api/admission/v1beta1"
+	appsV1 "k8s.io/api/apps/v1"
+	coreV1 "k8s.io/api/core/v1"
+	extensionsV1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// gadget is a custom resource of the kind Widget, whose Go type is named differently than its kind.
+type gadget struct {
+	metaV1.TypeMeta   `json:",inline"`
+	metaV1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              struct {
+		Size int `json:"size"`
+	} `json:"spec"`
+}
+
+func (g *gadget) DeepCopyObject() runtime.Object {
+	c := *g
+	g.ObjectMeta.DeepCopyInto(&c.ObjectMeta)
+	return &c
+}
+
+// widgetRequest returns a request creating a Widget of the given size.
+func widgetRequest(t testing.TB, size int) *admissionV1.AdmissionRequest {
+	t.Helper()
+	widget := &gadget{
+		TypeMeta:   metaV1.TypeMeta{APIVersion: "example.com/v1", Kind: "Widget"},
+		ObjectMeta: metaV1.ObjectMeta{Name: "web", Namespace: "default"},
+	}
+	widget.Spec.Size = size
+	return &admissionV1.AdmissionRequest{
+		UID:       "uid",
+		Operation: admissionV1.Create,
+		Kind:      metaV1.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"},
+		Resource:  metaV1.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"},
+		Name:      widget.Name,
+		Namespace: widget.Namespace,
+		Object:    runtime.RawExtension{Raw: mustMarshal(t, widget)},
+	}
+}
+
+func TestReviewVersions(t *testing.T) {
+	tests := []struct {
+		name       string
+		apiVersion string
+	}{
+		{name: "v1", apiVersion: "admission.k8s.io/v1"},
+		{name: "v1beta1", apiVersion: "admission.k8s.io/v1beta1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			ac.Register("label", patching("a"))
+
+			review := newReview(podRequest(t, testPod()))
+			review.APIVersion = tt.apiVersion
+			rec := post(t, ac, "/mutate", review)
+
+			var got metaV1.TypeMeta
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.APIVersion != tt.apiVersion || got.Kind != "AdmissionReview" {
+				t.Errorf("got %s %s, want %s AdmissionReview", got.APIVersion, got.Kind, tt.apiVersion)
+			}
+			// Both versions share the structure of the response.
+			res := responseOf(t, rec)
+			if !res.Allowed || res.UID != "uid" || len(patchesOf(t, res)) != 1 {
+				t.Errorf("got response %+v, want an allow with a patch for uid", res)
+			}
+		})
+	}
+}
+
+func TestV1beta1ReviewDecodesRequest(t *testing.T) {
+	ac := admit.New()
+	var got string
+	ac.Register("inspect", func(req *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+		got = req.Namespace + "/" + req.Name
+		return nil, nil
+	})
+
+	req := podRequest(t, testPod())
+	review := &admissionV1beta1.AdmissionReview{
+		TypeMeta: metaV1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"},
+		Request: &admissionV1beta1.AdmissionRequest{
+			UID: req.UID, Kind: req.Kind, Resource: req.Resource, Name: req.Name, Namespace: req.Namespace,
+			Operation: admissionV1beta1.Create, Object: req.Object,
+		},
+	}
+	if res := responseOf(t, post(t, ac, "/mutate", review)); !res.Allowed {
+		t.Fatalf("got denied: %s", messageOf(res))
+	}
+	if got != "default/web" {
+		t.Errorf("handler got %q, want default/web", got)
+	}
+}
+
+func TestUnsupportedReviewVersions(t *testing.T) {
+	tests := []struct {
+		name       string
+		apiVersion string
+		kind       string
+		wantError  string
+	}{
+		{
+			name:       "unsupported version",
+			apiVersion: "admission.k8s.io/v2",
+			kind:       "AdmissionReview",
+			wantError:  `unsupported review version "admission.k8s.io/v2" of kind "AdmissionReview"`,
+		},
+		{
+			name:       "unsupported kind",
+			apiVersion: "admission.k8s.io/v1",
+			kind:       "ConversionReview",
+			wantError:  `unsupported review version "admission.k8s.io/v1" of kind "ConversionReview"`,
+		},
+		{name: "omitted type", wantError: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			review := newReview(podRequest(t, testPod()))
+			review.APIVersion, review.Kind = tt.apiVersion, tt.kind
+			rec := post(t, ac, "/mutate", review)
+
+			if tt.wantError == "" {
+				if res := responseOf(t, rec); !res.Allowed {
+					t.Errorf("got denied: %s", messageOf(res))
+				}
+				return
+			}
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+			got := errorOf(t, rec.Body.Bytes())
+			if !strings.Contains(got, tt.wantError) || !strings.Contains(got, "admission.k8s.io/v1, admission.k8s.io/v1beta1") {
+				t.Errorf("got error %q, want it to contain %q and the supported versions", got, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestDecodeTarget(t *testing.T) {
+	current, previous := testPod(), testPod()
+	previous.Spec.Containers[0].Image = "nginx:old"
+	tests := []struct {
+		name      string
+		operation admissionV1.Operation
+		object    *coreV1.Pod
+		oldObject *coreV1.Pod
+		// wantImage is the image of the decoded target, empty if decoding fails.
+		wantImage string
+		// wantObject is set if DecodeObject succeeds.
+		wantObject bool
+	}{
+		{name: "create", operation: admissionV1.Create, object: current, wantImage: "nginx", wantObject: true},
+		{name: "update", operation: admissionV1.Update, object: current, oldObject: previous, wantImage: "nginx", wantObject: true},
+		{name: "delete", operation: admissionV1.Delete, oldObject: previous, wantImage: "nginx:old"},
+		{name: "connect without object", operation: admissionV1.Connect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			var image string
+			var targetErr, objectErr error
+			var raw []byte
+			ac.Register("inspect", func(req *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				raw = admit.RawObject(req)
+				pod := &coreV1.Pod{}
+				if targetErr = admit.DecodeTarget(req, pod); targetErr == nil {
+					image = pod.Spec.Containers[0].Image
+				}
+				objectErr = admit.DecodeObject(req, &coreV1.Pod{})
+				return nil, nil
+			})
+
+			req := podRequest(t, testPod())
+			req.Operation, req.Object = tt.operation, runtime.RawExtension{}
+			if tt.object != nil {
+				req.Object.Raw = mustMarshal(t, tt.object)
+			}
+			if tt.oldObject != nil {
+				req.OldObject.Raw = mustMarshal(t, tt.oldObject)
+			}
+			if res := responseOf(t, post(t, ac, "/mutate", newReview(req))); !res.Allowed {
+				t.Fatalf("got denied: %s", messageOf(res))
+			}
+			if image != tt.wantImage || (targetErr != nil) != (tt.wantImage == "") {
+				t.Errorf("got target image %q and error %v, want %q", image, targetErr, tt.wantImage)
+			}
+			if (len(raw) > 0) != (tt.wantImage != "") {
+				t.Errorf("got raw object %s", raw)
+			}
+			if (objectErr == nil) != tt.wantObject {
+				t.Errorf("got object decoded with error %v, want success %t", objectErr, tt.wantObject)
+			}
+		})
+	}
+}
+
+func TestAnnotationGate(t *testing.T) {
+	const key = "example.com/inject"
+	tests := []struct {
+		name string
+		// annotations of the pod, or none if nil.
+		annotations map[string]string
+		defaultOn   bool
+		// delete is set if the pod is deleted, so that it is in OldObject.
+		delete bool
+		// wantPatched is set if the gated handler is expected to run, wantDenied if the gate fails.
+		wantPatched, wantDenied bool
+	}{
+		{name: "on", annotations: map[string]string{key: "true"}, wantPatched: true},
+		{name: "off", annotations: map[string]string{key: "false"}, defaultOn: true},
+		{name: "on with spaces", annotations: map[string]string{key: " 1 "}, wantPatched: true},
+		{name: "absent default on", defaultOn: true, wantPatched: true},
+		{name: "absent default off"},
+		{name: "other annotation default on", annotations: map[string]string{"other": "false"}, defaultOn: true, wantPatched: true},
+		{name: "invalid", annotations: map[string]string{key: "maybe"}, defaultOn: true, wantDenied: true},
+		{name: "empty", annotations: map[string]string{key: ""}, wantDenied: true},
+		{name: "deleted object", annotations: map[string]string{key: "true"}, delete: true, wantPatched: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			ac.Register("gated", func(req *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				if on, err := admit.AnnotationGate(req, key, tt.defaultOn); err != nil || !on {
+					return nil, err
+				}
+				return []admit.PatchOperation{{Op: "add", Path: "/metadata/labels/injected", Value: "true"}}, nil
+			})
+
+			pod := testPod()
+			pod.Annotations = tt.annotations
+			req := podRequest(t, pod)
+			if tt.delete {
+				req.Operation, req.Object, req.OldObject = admissionV1.Delete, runtime.RawExtension{}, req.Object
+			}
+			res := responseOf(t, post(t, ac, "/mutate", newReview(req)))
+			if res.Allowed == tt.wantDenied {
+				t.Fatalf("got allowed %t with message %q, want denied %t", res.Allowed, messageOf(res), tt.wantDenied)
+			}
+			if tt.wantDenied {
+				if !strings.Contains(messageOf(res), key) {
+					t.Errorf("got message %q, want the annotation named", messageOf(res))
+				}
+				return
+			}
+			if patched := len(patchesOf(t, res)) > 0; patched != tt.wantPatched {
+				t.Errorf("got patched %t, want %t", patched, tt.wantPatched)
+			}
+		})
+	}
+}
+
+func TestResponseTypeMeta(t *testing.T) {
+	req := podRequest(t, testPod())
+	tests := []struct {
+		name     string
+		typeMeta metaV1.TypeMeta
+		wantCode int
+		want     metaV1.TypeMeta
+	}{
+		{name: "empty", wantCode: http.StatusOK, want: metaV1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"}},
+		{name: "v1", typeMeta: metaV1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"}, wantCode: http.StatusOK, want: metaV1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"}},
+		{name: "v1beta1", typeMeta: metaV1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"}, wantCode: http.StatusOK, want: metaV1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"}},
+		{name: "kind missing", typeMeta: metaV1.TypeMeta{APIVersion: "admission.k8s.io/v1"}, wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			rec := post(t, ac, "/mutate", admissionV1.AdmissionReview{TypeMeta: tt.typeMeta, Request: req})
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var got struct {
+				metaV1.TypeMeta
+				Response *admissionV1.AdmissionResponse
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.TypeMeta != tt.want {
+				t.Errorf("got type %+v, want %+v", got.TypeMeta, tt.want)
+			}
+			if got.Response == nil || got.Response.UID != req.UID {
+				t.Errorf("got response %+v, want one for %s", got.Response, req.UID)
+			}
+		})
+	}
+}
+
+func TestStrictDecoding(t *testing.T) {
+	// withField returns the review of a pod request with the field set at the given path of the envelope.
+	withField := func(t *testing.T, path ...string) []byte {
+		var review map[string]interface{}
+		if err := json.Unmarshal(mustMarshal(t, newReview(podRequest(t, testPod()))), &review); err != nil {
+			t.Fatal(err)
+		}
+		obj := review
+		for _, key := range path[:len(path)-1] {
+			obj = obj[key].(map[string]interface{})
+		}
+		obj[path[len(path)-1]] = "bogus"
+		return mustMarshal(t, review)
+	}
+	tests := []struct {
+		name      string
+		body      func(*testing.T) []byte
+		strict    bool
+		wantError string
+	}{
+		{name: "valid strict", body: func(t *testing.T) []byte { return mustMarshal(t, newReview(podRequest(t, testPod()))) }, strict: true},
+		{name: "top-level field lenient", body: func(t *testing.T) []byte { return withField(t, "bogus") }},
+		{name: "top-level field strict", body: func(t *testing.T) []byte { return withField(t, "bogus") }, strict: true, wantError: `unknown field \"bogus\"`},
+		{name: "request field strict", body: func(t *testing.T) []byte { return withField(t, "request", "uidd") }, strict: true, wantError: `unknown field \"uidd\"`},
+		{name: "object field strict", body: func(t *testing.T) []byte { return withField(t, "request", "object", "bogus") }, strict: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(admit.WithStrictDecoding(tt.strict))
+			rec := post(t, ac, "/mutate", tt.body(t))
+			if tt.wantError == "" {
+				if res := responseOf(t, rec); !res.Allowed {
+					t.Errorf("got denied: %s", messageOf(res))
+				}
+				return
+			}
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.wantError) {
+				t.Errorf("got status %d: %s, want a bad request for %s", rec.Code, rec.Body, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestDecodeObjectKinds(t *testing.T) {
+	deployment := func(t testing.TB, group, version string) *admissionV1.AdmissionRequest {
+		deploy := &appsV1.Deployment{
+			TypeMeta:   metaV1.TypeMeta{APIVersion: metaV1.GroupVersion{Group: group, Version: version}.String(), Kind: "Deployment"},
+			ObjectMeta: metaV1.ObjectMeta{Name: "web", Namespace: "default"},
+		}
+		return &admissionV1.AdmissionRequest{
+			UID:       "uid",
+			Operation: admissionV1.Create,
+			Kind:      metaV1.GroupVersionKind{Group: group, Version: version, Kind: "Deployment"},
+			Name:      deploy.Name,
+			Namespace: deploy.Namespace,
+			Object:    runtime.RawExtension{Raw: mustMarshal(t, deploy)},
+		}
+	}
+	podUpdate := func(t testing.TB) *admissionV1.AdmissionRequest {
+		req := podRequest(t, testPod())
+		req.Operation, req.OldObject = admissionV1.Update, req.Object
+		return req
+	}
+	tests := []struct {
+		name   string
+		req    func(testing.TB) *admissionV1.AdmissionRequest
+		decode func(*admissionV1.AdmissionRequest, runtime.Object) error
+		into   runtime.Object
+		// wantErr is the decoding error, the object is expected to be decoded if it is empty.
+		wantErr string
+	}{
+		{
+			name: "pod",
+			req:  func(t testing.TB) *admissionV1.AdmissionRequest { return podRequest(t, testPod()) },
+			into: &coreV1.Pod{},
+		},
+		{
+			name: "pod metadata",
+			req:  func(t testing.TB) *admissionV1.AdmissionRequest { return podRequest(t, testPod()) },
+			into: &metaV1.PartialObjectMetadata{},
+		},
+		{
+			name: "unstructured pod",
+			req:  func(t testing.TB) *admissionV1.AdmissionRequest { return podRequest(t, testPod()) },
+			into: &unstructured.Unstructured{},
+		},
+		{
+			name:    "pod into another kind",
+			req:     func(t testing.TB) *admissionV1.AdmissionRequest { return podRequest(t, testPod()) },
+			into:    &coreV1.ConfigMap{},
+			wantErr: "could not deserialize /v1, Kind=Pod object into *v1.ConfigMap",
+		},
+		{
+			name: "custom resource",
+			req:  func(t testing.TB) *admissionV1.AdmissionRequest { return widgetRequest(t, 1) },
+			into: &gadget{},
+		},
+		{
+			name: "deployment",
+			req:  func(t testing.TB) *admissionV1.AdmissionRequest { return deployment(t, "apps", "v1") },
+			into: &appsV1.Deployment{},
+		},
+		{
+			name:    "deployment of another group",
+			req:     func(t testing.TB) *admissionV1.AdmissionRequest { return deployment(t, "apps", "v1") },
+			into:    &extensionsV1beta1.Deployment{},
+			wantErr: "could not deserialize apps/v1, Kind=Deployment object into *v1beta1.Deployment",
+		},
+		{
+			name:    "deployment of another version",
+			req:     func(t testing.TB) *admissionV1.AdmissionRequest { return deployment(t, "extensions", "v1beta1") },
+			into:    &appsV1.Deployment{},
+			wantErr: "could not deserialize extensions/v1beta1, Kind=Deployment object into *v1.Deployment",
+		},
+		{
+			name:   "old pod",
+			req:    podUpdate,
+			decode: admit.DecodeOldObject,
+			into:   &coreV1.Pod{},
+		},
+		{
+			name:   "old pod metadata",
+			req:    podUpdate,
+			decode: admit.DecodeOldObject,
+			into:   &metaV1.PartialObjectMetadata{},
+		},
+		{
+			name:    "old pod into another kind",
+			req:     podUpdate,
+			decode:  admit.DecodeOldObject,
+			into:    &coreV1.ConfigMap{},
+			wantErr: "could not deserialize /v1, Kind=Pod object into *v1.ConfigMap",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decode := tt.decode
+			if decode == nil {
+				decode = admit.DecodeObject
+			}
+
+			err := decode(tt.req(t), tt.into)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			accessor, err := meta.Accessor(tt.into)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accessor.GetName() != "web" {
+				t.Errorf("got name %q, want web", accessor.GetName())
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package admit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	admissionV1 "k8s.io/api/admission/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DenyError is an error handlers can return to deny a request with a specific status code and reason instead of only
+// a message, e.g. DenyError{Code: http.StatusForbidden, Reason: metaV1.StatusReasonForbidden, Message: "..."}.
+type DenyError struct {
+	Code    int32
+	Reason  metaV1.StatusReason
+	Message string
+}
+
+func (e DenyError) Error() string {
+	return e.Message
+}
+
+// asDenyError finds the first DenyError in the chain of err, returned either as value or as pointer.
+func asDenyError(err error) (DenyError, bool) {
+	var deny DenyError
+	if errors.As(err, &deny) {
+		return deny, true
+	}
+	var denyPtr *DenyError
+	if errors.As(err, &denyPtr) && denyPtr != nil {
+		return *denyPtr, true
+	}
+	return DenyError{}, false
+}
+
+// RetriableError is an error handlers can return if they failed for a transient reason, e.g. an unavailable service
+// they depend on, rather than because the request violates a policy. Such requests are not denied, but answered with
+// http.StatusServiceUnavailable instead of an AdmissionReview. The apiserver then treats the call as failed and
+// applies the failurePolicy of the webhook: Fail rejects the request with an error clients may retry, Ignore admits
+// the object unchanged. The apiserver itself does not retry the call.
+type RetriableError struct {
+	Err error
+}
+
+func (e RetriableError) Error() string {
+	if e.Err == nil {
+		return "retriable error"
+	}
+	return e.Err.Error()
+}
+
+func (e RetriableError) Unwrap() error {
+	return e.Err
+}
+
+// isRetriable checks if the chain of err holds a RetriableError, returned either as value or as pointer.
+func isRetriable(err error) bool {
+	var retriable RetriableError
+	var retriablePtr *RetriableError
+	return errors.As(err, &retriable) || (errors.As(err, &retriablePtr) && retriablePtr != nil)
+}
+
+// statusOf returns the status a request denied by err is answered with.
+func statusOf(err error) *metaV1.Status {
+	if deny, ok := asDenyError(err); ok {
+		return &metaV1.Status{Code: deny.Code, Reason: deny.Reason, Message: deny.Message}
+	}
+	return &metaV1.Status{Message: err.Error()}
+}
+
+// objectContext describes the object of the request as "<kind> <namespace>/<name>", leaving out the namespace of
+// cluster-scoped objects. Objects yet to be named by generateName are described as "<kind> in <namespace>".
+func objectContext(req *admissionV1.AdmissionRequest) string {
+	kind := req.Kind.Kind
+	if kind == "" {
+		kind = "object"
+	}
+	switch {
+	case req.Name == "" && req.Namespace == "":
+		return kind
+	case req.Name == "":
+		return kind + " in " + req.Namespace
+	case req.Namespace == "":
+		return kind + " " + req.Name
+	default:
+		return kind + " " + req.Namespace + "/" + req.Name
+	}
+}
+
+// httpError is an error handling a webhook request, that is answered with its status code instead of an
+// AdmissionReview.
+type httpError struct {
+	code int
+	err  error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func (e *httpError) Unwrap() error {
+	return e.err
+}
+
+// httpErrorf creates an httpError with the given status code and formatted message.
+func httpErrorf(code int, format string, args ...interface{}) error {
+	return &httpError{code: code, err: fmt.Errorf(format, args...)}
+}
+
+// statusCodeOf returns the HTTP status code a request failing with err is answered with.
+func statusCodeOf(err error) int {
+	var httpErr *httpError
+	if errors.As(err, &httpErr) {
+		return httpErr.code
+	}
+	return http.StatusInternalServerError
+}
+
+// errorBody is the JSON body of requests answered with an error status.
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+// errorBodyOf returns the JSON body a request failing with err is answered with.
+func errorBodyOf(err error) []byte {
+	// Marshaling a struct of a string cannot fail.
+	body, _ := json.Marshal(errorBody{Error: err.Error()})
+	return body
+}
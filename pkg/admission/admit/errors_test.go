@@ -0,0 +1,254 @@
+package admit_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	admissionV1 "k8s.io/api/admission/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDenyError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantCode   int32
+		wantReason metaV1.StatusReason
+		wantMsg    string
+	}{
+		{
+			name:       "value",
+			err:        admit.DenyError{Code: http.StatusForbidden, Reason: metaV1.StatusReasonForbidden, Message: "not allowed"},
+			wantCode:   http.StatusForbidden,
+			wantReason: metaV1.StatusReasonForbidden,
+			wantMsg:    "not allowed",
+		},
+		{
+			name:       "pointer",
+			err:        &admit.DenyError{Code: http.StatusUnprocessableEntity, Reason: metaV1.StatusReasonInvalid, Message: "invalid"},
+			wantCode:   http.StatusUnprocessableEntity,
+			wantReason: metaV1.StatusReasonInvalid,
+			wantMsg:    "invalid",
+		},
+		{
+			name:       "wrapped",
+			err:        fmt.Errorf("checking: %w", admit.DenyError{Code: http.StatusForbidden, Reason: metaV1.StatusReasonForbidden, Message: "not allowed"}),
+			wantCode:   http.StatusForbidden,
+			wantReason: metaV1.StatusReasonForbidden,
+			wantMsg:    "not allowed",
+		},
+		{name: "plain error", err: errors.New("denied"), wantMsg: "denied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			ac.Register("test", func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				return nil, tt.err
+			})
+
+			res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+			if res.Allowed {
+				t.Fatal("got allowed, want denied")
+			}
+			if res.Result.Code != tt.wantCode || res.Result.Reason != tt.wantReason || res.Result.Message != tt.wantMsg {
+				t.Errorf("got status %d %s %q, want %d %s %q", res.Result.Code, res.Result.Reason, res.Result.Message,
+					tt.wantCode, tt.wantReason, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestErrorBody(t *testing.T) {
+	valid := mustMarshal(t, newReview(podRequest(t, testPod())))
+	tests := []struct {
+		name      string
+		method    string
+		header    http.Header
+		body      []byte
+		wantCode  int
+		wantError string
+	}{
+		{
+			name:      "malformed request",
+			body:      []byte(`{"request":`),
+			wantCode:  http.StatusBadRequest,
+			wantError: "could not deserialize request: unexpected end of JSON input",
+		},
+		{
+			name:      "unsupported content type",
+			header:    http.Header{"Content-Type": {"text/plain"}},
+			body:      valid,
+			wantCode:  http.StatusBadRequest,
+			wantError: "unsupported content type text/plain, only application/json and application/yaml are supported",
+		},
+		{
+			name:      "invalid method",
+			method:    http.MethodPut,
+			body:      valid,
+			wantCode:  http.StatusMethodNotAllowed,
+			wantError: "invalid method PUT, only POST requests are allowed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			method, header := tt.method, tt.header
+			if method == "" {
+				method = http.MethodPost
+			}
+			if header == nil {
+				header = http.Header{"Content-Type": {"application/json"}}
+			}
+			r := httptest.NewRequest(method, "/mutate", bytes.NewReader(tt.body))
+			r.Header = header
+			rec := httptest.NewRecorder()
+			ac.ServeHTTP(rec, r)
+
+			if rec.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantCode)
+			}
+			var body map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("got body %s, want a JSON object: %v", rec.Body, err)
+			}
+			if want := map[string]string{"error": tt.wantError}; !reflect.DeepEqual(body, want) {
+				t.Errorf("got body %v, want %v", body, want)
+			}
+		})
+	}
+}
+
+func TestRetriableError(t *testing.T) {
+	unavailable := errors.New("policy service unavailable")
+	tests := []struct {
+		name string
+		path string
+		err  error
+		// wantCode is the HTTP status, a deny review is expected if it is http.StatusOK.
+		wantCode int
+	}{
+		{name: "retriable", path: "/mutate", err: admit.RetriableError{Err: unavailable}, wantCode: http.StatusServiceUnavailable},
+		{name: "retriable pointer", path: "/mutate", err: &admit.RetriableError{Err: unavailable}, wantCode: http.StatusServiceUnavailable},
+		{name: "wrapped retriable", path: "/mutate", err: fmt.Errorf("looking up policy: %w", admit.RetriableError{Err: unavailable}), wantCode: http.StatusServiceUnavailable},
+		{name: "retriable validation", path: "/validate", err: admit.RetriableError{Err: unavailable}, wantCode: http.StatusServiceUnavailable},
+		{name: "policy violation", path: "/mutate", err: errors.New("privileged pods are not allowed"), wantCode: http.StatusOK},
+		{name: "policy validation", path: "/validate", err: admit.DenyError{Code: http.StatusForbidden, Message: "forbidden"}, wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			ac.Register("mutate", func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				return nil, tt.err
+			})
+			ac.RegisterValidator("validate", func(*admissionV1.AdmissionRequest) error {
+				return tt.err
+			})
+
+			rec := post(t, ac, tt.path, newReview(podRequest(t, testPod())))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.wantCode)
+			}
+			if tt.wantCode != http.StatusOK {
+				if !bytes.Contains(rec.Body.Bytes(), []byte(unavailable.Error())) {
+					t.Errorf("got body %s, want the cause", rec.Body)
+				}
+				return
+			}
+			if res := responseOf(t, rec); res.Allowed || res.Result == nil || res.Result.Message != tt.err.Error() {
+				t.Errorf("got response %+v, want a deny with message %q", res, tt.err)
+			}
+		})
+	}
+
+	t.Run("zero value", func(t *testing.T) {
+		ac := admit.New()
+		ac.Register("mutate", func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+			return nil, admit.RetriableError{}
+		})
+
+		rec := post(t, ac, "/mutate", newReview(podRequest(t, testPod())))
+		if rec.Code != http.StatusServiceUnavailable || !bytes.Contains(rec.Body.Bytes(), []byte("retriable error")) {
+			t.Errorf("got status %d with body %s, want %d", rec.Code, rec.Body, http.StatusServiceUnavailable)
+		}
+	})
+}
+
+func TestContextualDenyMessages(t *testing.T) {
+	tests := []struct {
+		name       string
+		disabled   bool
+		path       string
+		req        func(*testing.T) *admissionV1.AdmissionRequest
+		err        error
+		wantMsg    string
+		wantReason metaV1.StatusReason
+	}{
+		{
+			name:    "namespaced object",
+			path:    "/mutate",
+			req:     func(t *testing.T) *admissionV1.AdmissionRequest { return podRequest(t, testPod()) },
+			err:     errors.New("privileged containers are not allowed"),
+			wantMsg: "Pod default/web: privileged containers are not allowed",
+		},
+		{
+			name: "generated name",
+			path: "/validate",
+			req: func(t *testing.T) *admissionV1.AdmissionRequest {
+				req := podRequest(t, testPod())
+				req.Name = ""
+				return req
+			},
+			err:     errors.New("privileged containers are not allowed"),
+			wantMsg: "Pod in default: privileged containers are not allowed",
+		},
+		{
+			name:       "cluster-scoped object",
+			path:       "/mutate",
+			req:        clusterRoleRequest,
+			err:        admit.DenyError{Code: http.StatusForbidden, Reason: metaV1.StatusReasonForbidden, Message: "wildcard rules are not allowed"},
+			wantMsg:    "ClusterRole reader: wildcard rules are not allowed",
+			wantReason: metaV1.StatusReasonForbidden,
+		},
+		{
+			name: "unknown kind",
+			path: "/mutate",
+			req: func(t *testing.T) *admissionV1.AdmissionRequest {
+				req := podRequest(t, testPod())
+				req.Kind, req.Name, req.Namespace = metaV1.GroupVersionKind{}, "", ""
+				return req
+			},
+			err:     errors.New("denied"),
+			wantMsg: "object: denied",
+		},
+		{
+			name:     "disabled",
+			disabled: true,
+			path:     "/mutate",
+			req:      func(t *testing.T) *admissionV1.AdmissionRequest { return podRequest(t, testPod()) },
+			err:      errors.New("privileged containers are not allowed"),
+			wantMsg:  "privileged containers are not allowed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(admit.WithLogger(nil), admit.WithContextualDenyMessages(!tt.disabled))
+			ac.Register("policy", func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) { return nil, tt.err })
+			ac.RegisterValidator("policy", func(*admissionV1.AdmissionRequest) error { return tt.err })
+
+			res := responseOf(t, post(t, ac, tt.path, newReview(tt.req(t))))
+			if res.Allowed {
+				t.Fatal("got allowed, want denied")
+			}
+			if res.Result.Message != tt.wantMsg || res.Result.Reason != tt.wantReason {
+				t.Errorf("got message %q with reason %q, want %q with %q", res.Result.Message, res.Result.Reason, tt.wantMsg, tt.wantReason)
+			}
+		})
+	}
+}
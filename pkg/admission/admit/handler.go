@@ -0,0 +1,366 @@
+package admit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	admissionV1 "k8s.io/api/admission/v1"
+	admissionregistrationV1 "k8s.io/api/admissionregistration/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DispatchMode decides which of the matching handlers are run for a request.
+type DispatchMode int
+
+const (
+	// AllHandlers runs all matching handlers and applies the patches of all of them. This is the default.
+	AllHandlers DispatchMode = iota
+	// FirstMatch stops after the first handler producing patches, e.g. for mutually exclusive handlers. Handlers
+	// not producing patches do not stop the dispatch.
+	FirstMatch
+)
+
+// EnforcementMode decides whether denials of handlers take effect.
+type EnforcementMode int
+
+const (
+	// Enforce denies requests handlers return an error for. This is the default.
+	Enforce EnforcementMode = iota
+	// Warn allows requests handlers return an error for, returning the reason as warning instead, e.g. to roll out a
+	// policy without breaking clients. Patches of the denying handler are discarded.
+	Warn
+)
+
+// handler is a registered HandlerFunc along with the criteria selecting the requests it is run for.
+type handler struct {
+	name   string
+	handle HandlerFunc
+	// gvk restricts the handler to requests for objects of this kind. A nil gvk matches every request.
+	gvk *metaV1.GroupVersionKind
+	// ops restricts the handler to requests of these operations. A nil set matches every operation.
+	ops sets.Set[admissionV1.Operation]
+	// skipDryRun excludes the handler from dry-run requests.
+	skipDryRun bool
+	// selector restricts the handler to objects with matching labels. A nil selector matches every object.
+	selector labels.Selector
+	// resource restricts the handler to requests for this resource and subresource. A nil resource matches every
+	// request.
+	resource *resourceRef
+	// priority orders the handlers, lower priorities run first.
+	priority int
+	// allowedPaths restricts the patch operations of the handler to these paths and the paths below. A nil slice
+	// allows every path.
+	allowedPaths []string
+	// enforcement overrides the enforcement mode of the controller for the handler if set.
+	enforcement *EnforcementMode
+}
+
+// resourceRef names a resource, like pods, and optionally one of its subresources, like status.
+type resourceRef struct {
+	resource    string
+	subResource string
+}
+
+// HandlerOption configures a handler on registration.
+type HandlerOption func(*handler)
+
+// SkipDryRun excludes the handler from dry-run requests, e.g. because it has side effects. The object is admitted
+// unchanged by this handler instead.
+func SkipDryRun() HandlerOption {
+	return func(h *handler) {
+		h.skipDryRun = true
+	}
+}
+
+// ForOperations restricts the handler to requests of the given operations. Without operations, the handler never
+// runs, which is logged as warning on registration.
+func ForOperations(ops ...admissionV1.Operation) HandlerOption {
+	return func(h *handler) {
+		h.ops = sets.New(ops...)
+	}
+}
+
+// ForSelector restricts the handler to objects whose labels match the selector. Objects without labels only match
+// selectors without requirements. For DELETE requests, the labels of the old object are matched.
+func ForSelector(sel labels.Selector) HandlerOption {
+	return func(h *handler) {
+		h.selector = sel
+	}
+}
+
+// ForResource restricts the handler to requests for the given resource, e.g. pods, and subresource, e.g. status. With
+// an empty subresource, only requests for the main resource are matched.
+func ForResource(resource, subResource string) HandlerOption {
+	return func(h *handler) {
+		h.resource = &resourceRef{resource: resource, subResource: subResource}
+	}
+}
+
+// Priority sets the priority of the handler. Handlers with lower priorities run first, handlers with the same priority
+// run in the order they were registered in. The default priority is 0.
+func Priority(priority int) HandlerOption {
+	return func(h *handler) {
+		h.priority = priority
+	}
+}
+
+// AllowedPaths restricts the patch operations of the handler to the given JSON pointer paths and the paths below, e.g.
+// "/metadata/labels" allows "/metadata/labels/app". Requests the handler produces other operations for are denied, as
+// a guardrail against handlers patching parts of the object they are not meant to. Without prefixes, the handler may
+// not patch at all.
+func AllowedPaths(prefixes ...string) HandlerOption {
+	return func(h *handler) {
+		if h.allowedPaths == nil {
+			h.allowedPaths = []string{}
+		}
+		for _, prefix := range prefixes {
+			h.allowedPaths = append(h.allowedPaths, strings.TrimSuffix(prefix, "/"))
+		}
+	}
+}
+
+// checkPaths fails if one of the patch operations of the result targets a path the handler is not allowed to patch.
+// Raw patches are refused, as their targets are not known.
+func (h *handler) checkPaths(res *Result) error {
+	if h.allowedPaths == nil {
+		return nil
+	}
+	if len(res.Patch) > 0 {
+		return fmt.Errorf("handler %s returned a raw patch, which cannot be checked against its allowed paths", h.name)
+	}
+	for _, p := range res.Patches {
+		if len(h.allowedPaths) == 0 {
+			return fmt.Errorf("handler %s patched %s, but is not allowed to patch any path", h.name, p.Path)
+		}
+		if !underAny(p.Path, h.allowedPaths) {
+			return fmt.Errorf("handler %s patched %s outside its allowed paths %s", h.name, p.Path, strings.Join(h.allowedPaths, ", "))
+		}
+	}
+	return nil
+}
+
+// underAny checks if the path is one of the prefixes or below one of them.
+func underAny(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Enforcement sets the enforcement mode of the handler, overriding the one of the controller.
+func Enforcement(mode EnforcementMode) HandlerOption {
+	return func(h *handler) {
+		h.enforcement = &mode
+	}
+}
+
+// enforcementOf returns the enforcement mode of the handler.
+func (ac *admissionController) enforcementOf(h *handler) EnforcementMode {
+	if h.enforcement != nil {
+		return *h.enforcement
+	}
+	return ac.enforcement
+}
+
+// matches checks if the handler should be run for the given request.
+func (h *handler) matches(req *admissionV1.AdmissionRequest) bool {
+	if h.skipDryRun && req.DryRun != nil && *req.DryRun {
+		return false
+	}
+	if h.ops != nil && !h.ops.Has(req.Operation) {
+		return false
+	}
+	if h.gvk != nil && *h.gvk != req.Kind {
+		return false
+	}
+	if h.resource != nil && (h.resource.resource != req.Resource.Resource || h.resource.subResource != req.SubResource) {
+		return false
+	}
+	return h.selector == nil || h.selector.Matches(objectLabels(req))
+}
+
+// handlesKind checks if handlers are run for requests of the given kind, which must not be always allowed.
+func (ac *admissionController) handlesKind(kind metaV1.GroupVersionKind) bool {
+	return !ac.alwaysAllow.Has(kind)
+}
+
+// objectLabels returns the labels of the object of the request, or of the old object if there is none. Objects
+// whose metadata cannot be decoded have no labels.
+func objectLabels(req *admissionV1.AdmissionRequest) labels.Set {
+	var obj metaV1.PartialObjectMetadata
+	if err := json.Unmarshal(RawObject(req), &obj); err != nil {
+		return nil
+	}
+	return obj.Labels
+}
+
+// handlerRun records a handler run for a request and how long it took.
+type handlerRun struct {
+	name     string
+	duration time.Duration
+}
+
+// joinRuns returns the names of the runs separated by ",", with their durations if withDurations is set.
+func joinRuns(runs []handlerRun, withDurations bool) string {
+	parts := make([]string, len(runs))
+	for i, r := range runs {
+		parts[i] = r.name
+		if withDurations {
+			parts[i] += "=" + r.duration.String()
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// dispatch runs the matching handlers against the request and accumulates their results, which are returned along
+// with the handlers that ran. If a handler returns an error, dispatch stops and returns the error along
+// with a Result holding the warnings and audit annotations collected so far: patches of handlers that already ran are
+// discarded, a review is never partially applied.
+func (ac *admissionController) dispatch(ctx context.Context, handlers []*handler, req *admissionV1.AdmissionRequest) (*Result, []handlerRun, error) {
+	acc := &Result{}
+	// ran holds the handlers run for the request.
+	var ran []handlerRun
+	// owners holds the name of the handler of each accumulated patch.
+	var owners []string
+	for _, h := range handlers {
+		if !h.matches(req) {
+			continue
+		}
+
+		start := time.Now()
+		handlerCtx, span := ac.tracer.StartHandler(ctx, h.name)
+		res, err := ac.invoke(handlerCtx, h, req)
+		if err == nil && res != nil {
+			err = h.checkPaths(res)
+		}
+		if err != nil && !isRetriable(err) && ac.enforcementOf(h) == Warn {
+			ac.logger.Info("allowing admission request in warn mode", append(requestFields(req), "handler", h.name, "reason", err)...)
+			warned := &Result{Warnings: []string{fmt.Sprintf("%s would deny the request: %v", h.name, err)}}
+			if res != nil {
+				warned.Warnings = append(res.Warnings, warned.Warnings...)
+				warned.AuditAnnotations = res.AuditAnnotations
+			}
+			res, err = warned, nil
+		}
+		patches := 0
+		if err == nil && res != nil {
+			patches = len(res.Patches)
+		}
+		span.SetDecision(err == nil, patches)
+		span.End(nil)
+		duration := time.Since(start)
+		ran = append(ran, handlerRun{name: h.name, duration: duration})
+		ac.metrics.ObserveHandler(h.name, resultOf(err), duration)
+		if err != nil && isRetriable(err) {
+			ac.logger.Warn("handler failed transiently", append(requestFields(req), "handler", h.name, "error", err)...)
+			acc.Patches, acc.Patch = nil, nil
+			return acc, ran, err
+		} else if err != nil {
+			ac.logger.Info("denied admission request", append(requestFields(req), "handler", h.name, "reason", err)...)
+			ac.observeDenial(h.name, err)
+			if res != nil {
+				// Warnings are returned regardless of the decision, including those of the denying handler.
+				acc.Warnings = append(acc.Warnings, res.Warnings...)
+			}
+			acc.Patches, acc.Patch = nil, nil
+			return acc, ran, err
+		}
+
+		if res != nil {
+			if err = addRawPatch(acc, owners, h.name, res); err == nil {
+				owners, err = ac.appendPatches(acc, owners, h.name, res.Patches)
+			}
+			if err != nil {
+				ac.logger.Info("denied admission request", append(requestFields(req), "handler", h.name, "reason", err)...)
+				ac.observeDenial(h.name, err)
+				acc.Patches, acc.Patch = nil, nil
+				return acc, ran, err
+			}
+			acc.Warnings = append(acc.Warnings, res.Warnings...)
+			ac.addAuditAnnotations(acc, h.name, res.AuditAnnotations)
+			if ac.dispatchMode == FirstMatch && (len(res.Patches) > 0 || len(res.Patch) > 0) {
+				break
+			}
+		}
+	}
+	return acc, ran, nil
+}
+
+// addAuditAnnotations adds the audit annotations returned by a handler to acc, dropping those with invalid keys.
+func (ac *admissionController) addAuditAnnotations(acc *Result, name string, annotations map[string]string) {
+	for key, value := range annotations {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 || strings.Contains(key, "/") {
+			ac.logger.Warn("dropping invalid audit annotation", "handler", name, "key", key)
+			continue
+		}
+		if acc.AuditAnnotations == nil {
+			acc.AuditAnnotations = map[string]string{}
+		}
+		acc.AuditAnnotations[key] = value
+	}
+}
+
+// invoke runs the handler against the request. If a handler timeout is set, the handler is run under a context with
+// that deadline and abandoned once it passes, which is answered according to the timeout policy: with Fail the request
+// is denied, with Ignore the handler is treated as if it returned no result. Handlers respecting the context will
+// stop on their own then.
+func (ac *admissionController) invoke(ctx context.Context, h *handler, req *admissionV1.AdmissionRequest) (*Result, error) {
+	if ac.handlerTimeout <= 0 {
+		return ac.call(ctx, h, req)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ac.handlerTimeout)
+	defer cancel()
+
+	type outcome struct {
+		res *Result
+		err error
+	}
+	// The channel is buffered, so an abandoned handler does not block on completion.
+	done := make(chan outcome, 1)
+	go func() {
+		res, err := ac.call(ctx, h, req)
+		done <- outcome{res, err}
+	}()
+
+	select {
+	case o := <-done:
+		return o.res, o.err
+	case <-ctx.Done():
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("handler %s was canceled: %v", h.name, ctx.Err())
+		}
+		ac.logger.Warn("handler timed out", append(requestFields(req), "handler", h.name, "timeout", ac.handlerTimeout)...)
+		if ac.timeoutPolicy == admissionregistrationV1.Ignore {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("handler %s timed out after %s", h.name, ac.handlerTimeout)
+	}
+}
+
+// call runs the handler against the request, recovering from a panic according to the panic policy: with Fail the
+// request is denied, with Ignore the handler is treated as if it returned no result.
+func (ac *admissionController) call(ctx context.Context, h *handler, req *admissionV1.AdmissionRequest) (res *Result, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ac.logger.Error("recovered from panicking handler", fmt.Errorf("%v", r),
+				append(requestFields(req), "handler", h.name, "stack", string(debug.Stack()))...)
+			if ac.panicPolicy == admissionregistrationV1.Ignore {
+				res, err = nil, nil
+			} else {
+				res, err = nil, fmt.Errorf("handler %s failed: %v", h.name, r)
+			}
+		}
+	}()
+	return h.handle(ctx, req)
+}
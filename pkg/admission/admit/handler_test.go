@@ -0,0 +1,794 @@
+package admit_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	admissionV1 "k8s.io/api/admission/v1"
+	admissionregistrationV1 "k8s.io/api/admissionregistration/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// patching returns an AdmitFunc adding the label key.
+func patching(key string) admit.AdmitFunc {
+	return func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+		return new(admit.PatchBuilder).Add(admit.Pointer("metadata", "labels", key), "true").Build(), nil
+	}
+}
+
+// failing returns an AdmitFunc denying every request with the message.
+func failing(message string) admit.AdmitFunc {
+	return func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+		return nil, errors.New(message)
+	}
+}
+
+func TestDenialDiscardsPatches(t *testing.T) {
+	tests := []struct {
+		name        string
+		handlers    []admit.AdmitFunc
+		wantAllowed bool
+		wantPatches int
+	}{
+		{name: "all succeed", handlers: []admit.AdmitFunc{patching("a"), patching("b")}, wantAllowed: true, wantPatches: 2},
+		{name: "second fails", handlers: []admit.AdmitFunc{patching("a"), failing("denied")}},
+		{name: "first fails", handlers: []admit.AdmitFunc{failing("denied"), patching("b")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			for i, h := range tt.handlers {
+				ac.Register("handler-"+strconv.Itoa(i), h)
+			}
+
+			res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+			if res.Allowed != tt.wantAllowed {
+				t.Errorf("got allowed %t, want %t", res.Allowed, tt.wantAllowed)
+			}
+			if got := len(patchesOf(t, res)); got != tt.wantPatches {
+				t.Errorf("got %d patch operations, want %d", got, tt.wantPatches)
+			}
+			if !tt.wantAllowed && (res.Patch != nil || res.PatchType != nil) {
+				t.Errorf("denied response carries patch %s", res.Patch)
+			}
+		})
+	}
+}
+
+func TestRegisterForGVK(t *testing.T) {
+	deployment := metaV1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+	tests := []struct {
+		name    string
+		kind    metaV1.GroupVersionKind
+		wantRun bool
+	}{
+		{name: "matching kind", kind: deployment, wantRun: true},
+		{name: "other kind", kind: metaV1.GroupVersionKind{Version: "v1", Kind: "Pod"}},
+		{name: "other group", kind: metaV1.GroupVersionKind{Group: "extensions", Version: "v1beta1", Kind: "Deployment"}},
+		{name: "other version", kind: metaV1.GroupVersionKind{Group: "apps", Version: "v1beta2", Kind: "Deployment"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			ran := map[string]bool{}
+			ac.RegisterForGVK("deployments", deployment, recording(ran, "deployments"))
+			ac.Register("all", recording(ran, "all"))
+
+			req := podRequest(t, testPod())
+			req.Kind = tt.kind
+			if res := responseOf(t, post(t, ac, "/mutate", newReview(req))); !res.Allowed {
+				t.Fatalf("got denied: %s", messageOf(res))
+			}
+			if ran["deployments"] != tt.wantRun {
+				t.Errorf("got deployment handler run %t, want %t", ran["deployments"], tt.wantRun)
+			}
+			if !ran["all"] {
+				t.Error("handler registered for all kinds did not run")
+			}
+		})
+	}
+}
+
+func TestSkipDryRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		dryRun  *bool
+		opts    []admit.HandlerOption
+		wantRun bool
+	}{
+		{name: "not dry-run", dryRun: boolPtr(false), opts: []admit.HandlerOption{admit.SkipDryRun()}, wantRun: true},
+		{name: "unset dry-run", opts: []admit.HandlerOption{admit.SkipDryRun()}, wantRun: true},
+		{name: "dry-run skipped", dryRun: boolPtr(true), opts: []admit.HandlerOption{admit.SkipDryRun()}},
+		{name: "dry-run not opted out", dryRun: boolPtr(true), wantRun: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			ran := false
+			ac.Register("side-effect", func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				ran = true
+				return patching("a")(nil)
+			}, tt.opts...)
+
+			req := podRequest(t, testPod())
+			req.DryRun = tt.dryRun
+			res := responseOf(t, post(t, ac, "/mutate", newReview(req)))
+			if ran != tt.wantRun {
+				t.Errorf("got handler run %t, want %t", ran, tt.wantRun)
+			}
+			if !res.Allowed {
+				t.Errorf("got denied: %s", messageOf(res))
+			}
+			if got := len(patchesOf(t, res)) > 0; got != tt.wantRun {
+				t.Errorf("got patched %t, want %t", got, tt.wantRun)
+			}
+		})
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// recording returns an AdmitFunc recording in ran that the handler of the name ran.
+func recording(ran map[string]bool, name string) admit.AdmitFunc {
+	return func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+		ran[name] = true
+		return nil, nil
+	}
+}
+
+// annotating returns a HandlerFunc returning the audit annotations.
+func annotating(annotations map[string]string) admit.HandlerFunc {
+	return func(context.Context, *admissionV1.AdmissionRequest) (*admit.Result, error) {
+		return &admit.Result{AuditAnnotations: annotations}, nil
+	}
+}
+
+func TestAuditAnnotations(t *testing.T) {
+	tests := []struct {
+		name     string
+		handlers []admit.HandlerFunc
+		want     map[string]string
+	}{
+		{
+			name:     "single handler",
+			handlers: []admit.HandlerFunc{annotating(map[string]string{"mutation-reason": "sidecar injected"})},
+			want:     map[string]string{"mutation-reason": "sidecar injected"},
+		},
+		{
+			name: "merged",
+			handlers: []admit.HandlerFunc{
+				annotating(map[string]string{"a": "1", "shared": "first"}),
+				annotating(map[string]string{"b": "2", "shared": "second"}),
+			},
+			want: map[string]string{"a": "1", "b": "2", "shared": "second"},
+		},
+		{
+			name:     "invalid keys dropped",
+			handlers: []admit.HandlerFunc{annotating(map[string]string{"example.com/reason": "x", "not valid": "y", "valid": "z"})},
+			want:     map[string]string{"valid": "z"},
+		},
+		{name: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			for i, h := range tt.handlers {
+				ac.RegisterHandler("handler-"+strconv.Itoa(i), h)
+			}
+
+			res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+			if !reflect.DeepEqual(res.AuditAnnotations, tt.want) {
+				t.Errorf("got audit annotations %v, want %v", res.AuditAnnotations, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterForOps(t *testing.T) {
+	tests := []struct {
+		name    string
+		ops     []admissionV1.Operation
+		op      admissionV1.Operation
+		wantRun bool
+		// wantWarning is set if registering the handler is logged as warning.
+		wantWarning bool
+	}{
+		{name: "matching operation", ops: []admissionV1.Operation{admissionV1.Create}, op: admissionV1.Create, wantRun: true},
+		{name: "other operation", ops: []admissionV1.Operation{admissionV1.Create}, op: admissionV1.Update},
+		{name: "one of several", ops: []admissionV1.Operation{admissionV1.Create, admissionV1.Update}, op: admissionV1.Update, wantRun: true},
+		{name: "no operations", op: admissionV1.Create, wantWarning: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, buf := bufferLogger(admit.LevelWarn)
+			ac := admit.New(admit.WithLogger(logger))
+			ran := map[string]bool{}
+			ac.RegisterForOps("filtered", tt.ops, recording(ran, "filtered"))
+			ac.Register("all", recording(ran, "all"))
+			if warned := strings.Contains(buf.String(), "never runs"); warned != tt.wantWarning {
+				t.Errorf("got warning logged %t, want %t: %q", warned, tt.wantWarning, buf)
+			}
+
+			req := podRequest(t, testPod())
+			req.Operation = tt.op
+			responseOf(t, post(t, ac, "/mutate", newReview(req)))
+			if ran["filtered"] != tt.wantRun {
+				t.Errorf("got filtered handler run %t, want %t", ran["filtered"], tt.wantRun)
+			}
+			if !ran["all"] {
+				t.Error("handler registered for all operations did not run")
+			}
+		})
+	}
+}
+
+func TestPanicPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        []admit.Option
+		wantAllowed bool
+		wantPatches int
+	}{
+		{name: "default fails"},
+		{name: "fail", opts: []admit.Option{admit.WithPanicPolicy(admissionregistrationV1.Fail)}},
+		{name: "ignore", opts: []admit.Option{admit.WithPanicPolicy(admissionregistrationV1.Ignore)}, wantAllowed: true, wantPatches: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, buf := bufferLogger(admit.LevelError)
+			ac := admit.New(append([]admit.Option{admit.WithLogger(logger)}, tt.opts...)...)
+			ac.Register("label", patching("a"))
+			ac.Register("panicking", func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				panic("boom")
+			})
+
+			res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+			if res.Allowed != tt.wantAllowed {
+				t.Errorf("got allowed %t, want %t", res.Allowed, tt.wantAllowed)
+			}
+			if !tt.wantAllowed && messageOf(res) != "handler panicking failed: boom" {
+				t.Errorf("got message %q", messageOf(res))
+			}
+			if got := len(patchesOf(t, res)); got != tt.wantPatches {
+				t.Errorf("got %d patch operations, want %d", got, tt.wantPatches)
+			}
+			if log := buf.String(); !strings.Contains(log, "recovered from panicking handler: boom") || !strings.Contains(log, "stack=") {
+				t.Errorf("got log %q, want the panic logged with its stack", log)
+			}
+		})
+	}
+}
+
+func TestRegisterWithSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		labels   map[string]string
+		op       admissionV1.Operation
+		wantRun  bool
+	}{
+		{name: "match", selector: "inject=true", labels: map[string]string{"inject": "true"}, wantRun: true},
+		{name: "no match", selector: "inject=true", labels: map[string]string{"inject": "false"}},
+		{name: "no labels", selector: "inject=true"},
+		{name: "no labels with not-in selector", selector: "inject notin (false)", wantRun: true},
+		{name: "everything", selector: "", wantRun: true},
+		{name: "old object on delete", selector: "inject=true", labels: map[string]string{"inject": "true"}, op: admissionV1.Delete, wantRun: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sel, err := labels.Parse(tt.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ac := admit.New()
+			ran := map[string]bool{}
+			ac.RegisterWithSelector("selected", sel, recording(ran, "selected"))
+
+			pod := testPod()
+			pod.Labels = tt.labels
+			req := podRequest(t, pod)
+			if tt.op == admissionV1.Delete {
+				req.Operation = tt.op
+				req.OldObject, req.Object = req.Object, runtime.RawExtension{}
+			}
+			responseOf(t, post(t, ac, "/mutate", newReview(req)))
+			if ran["selected"] != tt.wantRun {
+				t.Errorf("got handler run %t, want %t", ran["selected"], tt.wantRun)
+			}
+		})
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		sleep       time.Duration
+		opts        []admit.Option
+		wantAllowed bool
+		wantPatches int
+		wantMessage string
+	}{
+		{name: "fast handler", sleep: 0, wantAllowed: true, wantPatches: 2},
+		{name: "fail", sleep: time.Minute, wantMessage: "handler sleeping timed out after 20ms"},
+		{
+			name:        "ignore",
+			sleep:       time.Minute,
+			opts:        []admit.Option{admit.WithTimeoutPolicy(admissionregistrationV1.Ignore)},
+			wantAllowed: true,
+			wantPatches: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(append([]admit.Option{admit.WithHandlerTimeout(20 * time.Millisecond)}, tt.opts...)...)
+			stopped := make(chan error, 1)
+			ac.Register("label", patching("a"))
+			ac.RegisterCtx("sleeping", func(ctx context.Context, req *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				select {
+				case <-time.After(tt.sleep):
+					stopped <- nil
+					return patching("b")(req)
+				case <-ctx.Done():
+					stopped <- ctx.Err()
+					return nil, ctx.Err()
+				}
+			})
+
+			res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+			if res.Allowed != tt.wantAllowed {
+				t.Errorf("got allowed %t, want %t", res.Allowed, tt.wantAllowed)
+			}
+			if messageOf(res) != tt.wantMessage {
+				t.Errorf("got message %q, want %q", messageOf(res), tt.wantMessage)
+			}
+			if got := len(patchesOf(t, res)); got != tt.wantPatches {
+				t.Errorf("got %d patch operations, want %d", got, tt.wantPatches)
+			}
+			// The handler has to be canceled instead of sleeping on in the background.
+			select {
+			case err := <-stopped:
+				if tt.sleep > 0 && !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("got handler stopped with %v, want the deadline exceeded", err)
+				}
+			case <-time.After(time.Second):
+				t.Error("handler was not canceled")
+			}
+		})
+	}
+}
+
+func TestRegisterForResource(t *testing.T) {
+	tests := []struct {
+		name        string
+		resource    string
+		subResource string
+		want        []string
+	}{
+		{name: "main resource", resource: "pods", want: []string{"all", "pods"}},
+		{name: "status subresource", resource: "pods", subResource: "status", want: []string{"all", "pods/status"}},
+		{name: "other subresource", resource: "pods", subResource: "binding", want: []string{"all"}},
+		{name: "other resource", resource: "deployments", subResource: "status", want: []string{"all"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			ran := map[string]bool{}
+			ac.RegisterForResource("pods", "pods", "", recording(ran, "pods"))
+			ac.RegisterForResource("pods/status", "pods", "status", recording(ran, "pods/status"))
+			ac.Register("all", recording(ran, "all"))
+
+			req := podRequest(t, testPod())
+			req.Resource.Resource, req.SubResource = tt.resource, tt.subResource
+			responseOf(t, post(t, ac, "/mutate", newReview(req)))
+			var got []string
+			for _, name := range []string{"all", "pods", "pods/status"} {
+				if ran[name] {
+					got = append(got, name)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got handlers %v run, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// appending returns an AdmitFunc appending the name to order when run.
+func appending(order *[]string, name string) admit.AdmitFunc {
+	return func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+		*order = append(*order, name)
+		return nil, nil
+	}
+}
+
+func TestRegisterWithPriority(t *testing.T) {
+	tests := []struct {
+		name       string
+		priorities []int
+		want       []string
+	}{
+		{name: "out of order", priorities: []int{10, -5, 0}, want: []string{"handler-1", "handler-2", "handler-0"}},
+		{name: "ties in registration order", priorities: []int{1, 0, 1, 0}, want: []string{"handler-1", "handler-3", "handler-0", "handler-2"}},
+		{name: "same priority", priorities: []int{0, 0}, want: []string{"handler-0", "handler-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			var order []string
+			for i, priority := range tt.priorities {
+				name := "handler-" + strconv.Itoa(i)
+				ac.RegisterWithPriority(name, priority, appending(&order, name))
+			}
+
+			responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+			if !reflect.DeepEqual(order, tt.want) {
+				t.Errorf("got handlers run in order %v, want %v", order, tt.want)
+			}
+		})
+	}
+}
+
+func TestDispatchMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    admit.DispatchMode
+		want    []string
+		wantOps int
+	}{
+		{name: "all handlers", mode: admit.AllHandlers, want: []string{"empty", "first", "second"}, wantOps: 2},
+		{name: "first match", mode: admit.FirstMatch, want: []string{"empty", "first"}, wantOps: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(admit.WithDispatchMode(tt.mode))
+			var order []string
+			track := func(name string, adm admit.AdmitFunc) admit.AdmitFunc {
+				return func(req *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+					order = append(order, name)
+					return adm(req)
+				}
+			}
+			// A handler not producing patches does not stop the dispatch.
+			ac.Register("empty", track("empty", returning()))
+			ac.Register("first", track("first", patching("a")))
+			ac.Register("second", track("second", patching("b")))
+
+			res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+			if !reflect.DeepEqual(order, tt.want) {
+				t.Errorf("got handlers %v run, want %v", order, tt.want)
+			}
+			if got := len(patchesOf(t, res)); got != tt.wantOps {
+				t.Errorf("got %d patch operations, want %d", got, tt.wantOps)
+			}
+		})
+	}
+}
+
+func TestAlwaysAllowKinds(t *testing.T) {
+	lease := metaV1.GroupVersionKind{Group: "coordination.k8s.io", Version: "v1", Kind: "Lease"}
+	event := metaV1.GroupVersionKind{Version: "v1", Kind: "Event"}
+	tests := []struct {
+		name    string
+		kind    metaV1.GroupVersionKind
+		path    string
+		wantRan bool
+	}{
+		{name: "lease mutation", kind: lease, path: "/mutate"},
+		{name: "lease validation", kind: lease, path: "/validate"},
+		{name: "event", kind: event, path: "/mutate"},
+		{name: "other lease version", kind: metaV1.GroupVersionKind{Group: "coordination.k8s.io", Version: "v1beta1", Kind: "Lease"}, path: "/mutate", wantRan: true},
+		{name: "pod", kind: metaV1.GroupVersionKind{Version: "v1", Kind: "Pod"}, path: "/mutate", wantRan: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(admit.WithAlwaysAllowKinds(lease, event))
+			var ran bool
+			ac.Register("mutate", func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				ran = true
+				return patching("a")(nil)
+			})
+			ac.RegisterValidator("validate", func(*admissionV1.AdmissionRequest) error {
+				ran = true
+				return errors.New("denied")
+			})
+
+			req := podRequest(t, testPod())
+			req.Kind = tt.kind
+			res := responseOf(t, post(t, ac, tt.path, newReview(req)))
+			if ran != tt.wantRan {
+				t.Fatalf("got handlers run %t, want %t", ran, tt.wantRan)
+			}
+			if !tt.wantRan && (!res.Allowed || len(patchesOf(t, res)) > 0) {
+				t.Errorf("got response %+v, want an allow without patch", res)
+			}
+		})
+	}
+}
+
+func TestDuplicateHandlerNames(t *testing.T) {
+	nop := func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) { return nil, nil }
+	valid := func(*admissionV1.AdmissionRequest) error { return nil }
+	tests := []struct {
+		name     string
+		register func(admit.AdmissionController)
+		// wantWarned are the names warned about as duplicates.
+		wantWarned []string
+		want       []string
+	}{
+		{
+			name: "distinct names",
+			register: func(ac admit.AdmissionController) {
+				ac.Register("inject", nop)
+				ac.Register("labels", nop)
+			},
+			want: []string{"inject", "labels"},
+		},
+		{
+			name: "duplicate handlers",
+			register: func(ac admit.AdmissionController) {
+				ac.Register("inject", nop)
+				ac.Register("inject", nop)
+			},
+			wantWarned: []string{"inject"},
+			want:       []string{"inject", "inject"},
+		},
+		{
+			name: "handler and validator",
+			register: func(ac admit.AdmissionController) {
+				ac.Register("policy", nop)
+				ac.RegisterValidator("policy", valid)
+			},
+			wantWarned: []string{"policy"},
+			want:       []string{"policy", "policy"},
+		},
+		{
+			name: "unregistered name reused",
+			register: func(ac admit.AdmissionController) {
+				ac.Register("inject", nop)
+				ac.Unregister("inject")
+				ac.Register("inject", nop)
+			},
+			want: []string{"inject"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &recordingLogger{}
+			ac := admit.New(admit.WithLogger(logger))
+			tt.register(ac)
+
+			var warned []string
+			for _, fields := range logger.logged("registering duplicate handler name, handlers of this name cannot be told apart") {
+				warned = append(warned, fields["name"])
+			}
+			if !reflect.DeepEqual(warned, tt.wantWarned) {
+				t.Errorf("got warnings about %q, want %q", warned, tt.wantWarned)
+			}
+			if got := ac.Handlers(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got handlers %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnregisterAndReset(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove func(admit.AdmissionController)
+		// want are the handlers and validators still run, in order.
+		want []string
+	}{
+		{name: "nothing removed", remove: func(admit.AdmissionController) {}, want: []string{"inject", "labels", "inject", "policy"}},
+		{name: "unregister handler", remove: func(ac admit.AdmissionController) { ac.Unregister("labels") }, want: []string{"inject", "inject", "policy"}},
+		{name: "unregister all of a name", remove: func(ac admit.AdmissionController) { ac.Unregister("inject") }, want: []string{"labels", "policy"}},
+		{name: "unregister validator", remove: func(ac admit.AdmissionController) { ac.Unregister("policy") }, want: []string{"inject", "labels", "inject"}},
+		{name: "unregister unknown", remove: func(ac admit.AdmissionController) { ac.Unregister("unknown") }, want: []string{"inject", "labels", "inject", "policy"}},
+		{name: "reset", remove: func(ac admit.AdmissionController) { ac.Reset() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			var ran []string
+			ac.Register("inject", appending(&ran, "inject"))
+			ac.Register("labels", appending(&ran, "labels"))
+			ac.Register("inject", appending(&ran, "inject"))
+			ac.RegisterValidator("policy", func(*admissionV1.AdmissionRequest) error {
+				ran = append(ran, "policy")
+				return nil
+			})
+			tt.remove(ac)
+
+			for _, path := range []string{"/mutate", "/validate"} {
+				if res := responseOf(t, post(t, ac, path, newReview(podRequest(t, testPod())))); !res.Allowed {
+					t.Fatalf("got %s denied: %s", path, messageOf(res))
+				}
+			}
+			if !reflect.DeepEqual(ran, tt.want) {
+				t.Errorf("got %q run, want %q", ran, tt.want)
+			}
+		})
+	}
+}
+
+func TestMutatedAuditAnnotation(t *testing.T) {
+	const key = "mutated"
+	labelPatch := new(admit.PatchBuilder).Add("/metadata/labels/a", "true").Build()
+	tests := []struct {
+		name   string
+		path   string
+		result *admit.Result
+		opts   []admit.Option
+		// want is the value of the annotation, which is expected to be absent if empty.
+		want string
+	}{
+		{name: "patched", path: "/mutate", result: &admit.Result{Patches: labelPatch}, want: "true"},
+		{name: "merge patched", path: "/mutate", result: &admit.Result{Patch: []byte(`{"metadata":{"labels":{"a":"true"}}}`), PatchType: admissionV1.PatchType("MergePatch")}, want: "true"},
+		{name: "unchanged", path: "/mutate", result: &admit.Result{}, want: "false"},
+		{name: "handler annotations kept", path: "/mutate", result: &admit.Result{AuditAnnotations: map[string]string{"owner": "team"}}, want: "false"},
+		{name: "validation", path: "/validate", result: &admit.Result{}},
+		{name: "disabled", path: "/mutate", result: &admit.Result{Patches: labelPatch}, opts: []admit.Option{admit.WithMutatedAuditAnnotation("")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(append([]admit.Option{admit.WithMutatedAuditAnnotation(key)}, tt.opts...)...)
+			ac.RegisterHandler("mutate", func(context.Context, *admissionV1.AdmissionRequest) (*admit.Result, error) {
+				return tt.result, nil
+			})
+			ac.RegisterValidator("validate", func(*admissionV1.AdmissionRequest) error { return nil })
+
+			res := responseOf(t, post(t, ac, tt.path, newReview(podRequest(t, testPod()))))
+			got, ok := res.AuditAnnotations[key]
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("got annotation %q present %t, want %q", got, ok, tt.want)
+			}
+			if owner := tt.result.AuditAnnotations["owner"]; owner != "" && res.AuditAnnotations["owner"] != owner {
+				t.Errorf("got annotations %v, want the handler annotation kept", res.AuditAnnotations)
+			}
+		})
+	}
+}
+
+func TestRegisterWithAllowedPaths(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes []string
+		result   *admit.Result
+		// wantDenial is the reason of the denial, the request is expected to be allowed if it is empty.
+		wantDenial string
+	}{
+		{
+			name:     "below prefix",
+			prefixes: []string{"/metadata/labels", "/metadata/annotations"},
+			result:   &admit.Result{Patches: new(admit.PatchBuilder).Add("/metadata/labels/app", "web").Add("/metadata/annotations", map[string]string{}).Build()},
+		},
+		{
+			name:     "prefix with trailing slash",
+			prefixes: []string{"/metadata/labels/"},
+			result:   &admit.Result{Patches: new(admit.PatchBuilder).Add("/metadata/labels/app", "web").Build()},
+		},
+		{
+			name:       "outside prefixes",
+			prefixes:   []string{"/metadata/labels"},
+			result:     &admit.Result{Patches: new(admit.PatchBuilder).Add("/metadata/labels/app", "web").Add("/spec/securityContext", map[string]bool{"runAsNonRoot": false}).Build()},
+			wantDenial: "handler guarded patched /spec/securityContext outside its allowed paths /metadata/labels",
+		},
+		{
+			name:       "sibling of prefix",
+			prefixes:   []string{"/metadata/labels"},
+			result:     &admit.Result{Patches: new(admit.PatchBuilder).Add("/metadata/labelsExtra", "x").Build()},
+			wantDenial: "handler guarded patched /metadata/labelsExtra outside its allowed paths /metadata/labels",
+		},
+		{
+			name:       "raw patch",
+			prefixes:   []string{"/metadata/labels"},
+			result:     &admit.Result{Patch: []byte(`{"metadata":{"labels":{"app":"web"}}}`), PatchType: "MergePatch"},
+			wantDenial: "handler guarded returned a raw patch, which cannot be checked against its allowed paths",
+		},
+		{
+			name:       "no prefixes",
+			prefixes:   []string{},
+			result:     &admit.Result{Patches: new(admit.PatchBuilder).Add("/metadata/labels/app", "web").Build()},
+			wantDenial: "handler guarded patched /metadata/labels/app, but is not allowed to patch any path",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &recordingLogger{}
+			ac := admit.New(admit.WithLogger(logger))
+			ac.RegisterHandler("guarded", func(context.Context, *admissionV1.AdmissionRequest) (*admit.Result, error) {
+				return tt.result, nil
+			}, admit.AllowedPaths(tt.prefixes...))
+
+			res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+			if res.Allowed != (tt.wantDenial == "") {
+				t.Fatalf("got allowed %t with message %q, want denial %q", res.Allowed, messageOf(res), tt.wantDenial)
+			}
+			var reasons []string
+			for _, fields := range logger.logged("denied admission request") {
+				reasons = append(reasons, fields["reason"])
+			}
+			if want := nonEmpty(tt.wantDenial); !reflect.DeepEqual(reasons, want) {
+				t.Errorf("got logged denials %q, want %q", reasons, want)
+			}
+			if tt.wantDenial != "" && messageOf(res) != tt.wantDenial {
+				t.Errorf("got message %q, want %q", messageOf(res), tt.wantDenial)
+			}
+		})
+	}
+
+	t.Run("register", func(t *testing.T) {
+		ac := admit.New()
+		ac.RegisterWithAllowedPaths("guarded", []string{"/spec/containers"}, patching("a"))
+		if res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod())))); res.Allowed {
+			t.Errorf("got labels patched, want a denial")
+		}
+	})
+}
+
+func TestEnforcementMode(t *testing.T) {
+	const warning = "policy would deny the request: privileged pods are not allowed"
+	tests := []struct {
+		name string
+		path string
+		mode admit.EnforcementMode
+		// handlerMode overrides the mode for the mutating handler if set.
+		handlerMode  *admit.EnforcementMode
+		err          error
+		wantCode     int
+		wantAllowed  bool
+		wantWarnings []string
+	}{
+		{name: "validator enforced", path: "/validate", mode: admit.Enforce, err: errors.New("privileged pods are not allowed"), wantCode: http.StatusOK},
+		{name: "validator warned", path: "/validate", mode: admit.Warn, err: errors.New("privileged pods are not allowed"), wantCode: http.StatusOK, wantAllowed: true, wantWarnings: []string{warning}},
+		{name: "validator allowing in warn mode", path: "/validate", mode: admit.Warn, wantCode: http.StatusOK, wantAllowed: true},
+		{name: "handler warned", path: "/mutate", mode: admit.Warn, err: errors.New("privileged pods are not allowed"), wantCode: http.StatusOK, wantAllowed: true, wantWarnings: []string{warning}},
+		{name: "handler overriding to warn", path: "/mutate", mode: admit.Enforce, handlerMode: enforcementPtr(admit.Warn), err: errors.New("privileged pods are not allowed"), wantCode: http.StatusOK, wantAllowed: true, wantWarnings: []string{warning}},
+		{name: "handler overriding to enforce", path: "/mutate", mode: admit.Warn, handlerMode: enforcementPtr(admit.Enforce), err: errors.New("privileged pods are not allowed"), wantCode: http.StatusOK},
+		{name: "transient failure in warn mode", path: "/validate", mode: admit.Warn, err: admit.RetriableError{Err: errors.New("unavailable")}, wantCode: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(admit.WithEnforcementMode(tt.mode))
+			var opts []admit.HandlerOption
+			if tt.handlerMode != nil {
+				opts = append(opts, admit.Enforcement(*tt.handlerMode))
+			}
+			ac.Register("policy", func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				return nil, tt.err
+			}, opts...)
+			ac.RegisterValidator("policy", func(*admissionV1.AdmissionRequest) error {
+				return tt.err
+			})
+
+			rec := post(t, ac, tt.path, newReview(podRequest(t, testPod())))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			res := responseOf(t, rec)
+			if res.Allowed != tt.wantAllowed {
+				t.Errorf("got allowed %t with message %q, want %t", res.Allowed, messageOf(res), tt.wantAllowed)
+			}
+			if !reflect.DeepEqual(res.Warnings, tt.wantWarnings) {
+				t.Errorf("got warnings %q, want %q", res.Warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func enforcementPtr(mode admit.EnforcementMode) *admit.EnforcementMode {
+	return &mode
+}
@@ -0,0 +1,32 @@
+package admit
+
+import (
+	"net/http"
+)
+
+// Probe paths
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// SetReady marks the controller as (not) prepared to serve admission requests, as reported by /readyz.
+func (ac *admissionController) SetReady(ready bool) {
+	ac.ready.Store(ready)
+}
+
+// serveHealthz reports the controller as alive whenever it is able to respond.
+func (ac *admissionController) serveHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// serveReadyz reports if the controller was marked ready and the caches of its listers, if any, synced.
+func (ac *admissionController) serveReadyz(w http.ResponseWriter, _ *http.Request) {
+	if !ac.ready.Load() || (ac.listers != nil && !ac.listers.hasSynced()) {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
@@ -0,0 +1,39 @@
+package admit_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+)
+
+func TestProbes(t *testing.T) {
+	tests := []struct {
+		name string
+		// ready are the readiness states the controller is marked with in turn, none if it is empty.
+		ready       []bool
+		wantHealthz int
+		wantReadyz  int
+	}{
+		{name: "not marked", wantHealthz: http.StatusOK, wantReadyz: http.StatusServiceUnavailable},
+		{name: "ready", ready: []bool{true}, wantHealthz: http.StatusOK, wantReadyz: http.StatusOK},
+		{name: "no longer ready", ready: []bool{true, false}, wantHealthz: http.StatusOK, wantReadyz: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			for _, ready := range tt.ready {
+				ac.SetReady(ready)
+			}
+
+			for path, want := range map[string]int{"/healthz": tt.wantHealthz, "/readyz": tt.wantReadyz} {
+				rec := httptest.NewRecorder()
+				ac.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+				if rec.Code != want {
+					t.Errorf("got status %d at %s, want %d", rec.Code, path, want)
+				}
+			}
+		})
+	}
+}
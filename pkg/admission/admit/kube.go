@@ -0,0 +1,114 @@
+package admit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	admissionV1 "k8s.io/api/admission/v1"
+	coreV1 "k8s.io/api/core/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersCoreV1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// kubeClientKey and listersKey are the context keys of the Kubernetes client and listers passed to handlers.
+type (
+	kubeClientKey struct{}
+	listersKey    struct{}
+)
+
+// listers are the informer-backed listers passed to handlers.
+type listers struct {
+	namespaces listersCoreV1.NamespaceLister
+	configMaps listersCoreV1.ConfigMapLister
+	// synced report if the caches of the listers are synced.
+	synced []cache.InformerSynced
+}
+
+// newListers requests the informers of the listers from the factory.
+func newListers(factory informers.SharedInformerFactory) *listers {
+	namespaces := factory.Core().V1().Namespaces()
+	configMaps := factory.Core().V1().ConfigMaps()
+	return &listers{
+		namespaces: namespaces.Lister(),
+		configMaps: configMaps.Lister(),
+		synced:     []cache.InformerSynced{namespaces.Informer().HasSynced, configMaps.Informer().HasSynced},
+	}
+}
+
+// hasSynced checks if the caches of all listers are synced.
+func (l *listers) hasSynced() bool {
+	for _, synced := range l.synced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+// KubeClient returns the Kubernetes client the controller was configured with by WithKubeClient from the context
+// passed to a handler, or nil if there is none. Requests to the apiserver count against the timeout of the webhook,
+// so handlers should keep them few and bound them by the context.
+func KubeClient(ctx context.Context) kubernetes.Interface {
+	client, _ := ctx.Value(kubeClientKey{}).(kubernetes.Interface)
+	return client
+}
+
+// NamespaceLister returns the cached namespaces from the context passed to a handler, if the controller was
+// configured with WithInformerFactory, or nil otherwise.
+func NamespaceLister(ctx context.Context) listersCoreV1.NamespaceLister {
+	if l, ok := ctx.Value(listersKey{}).(*listers); ok {
+		return l.namespaces
+	}
+	return nil
+}
+
+// ConfigMapLister returns the cached config maps from the context passed to a handler, if the controller was
+// configured with WithInformerFactory, or nil otherwise.
+func ConfigMapLister(ctx context.Context) listersCoreV1.ConfigMapLister {
+	if l, ok := ctx.Value(listersKey{}).(*listers); ok {
+		return l.configMaps
+	}
+	return nil
+}
+
+// NamespaceLabels returns the labels of the namespace of the request from the context passed to a handler. The
+// namespace is looked up by the NamespaceLister if available, and by the KubeClient otherwise. Missing namespaces
+// and requests for cluster-scoped objects have no labels.
+func NamespaceLabels(ctx context.Context, req *admissionV1.AdmissionRequest) (map[string]string, error) {
+	if req.Namespace == "" {
+		return nil, nil
+	}
+
+	var ns *coreV1.Namespace
+	var err error
+	if lister := NamespaceLister(ctx); lister != nil {
+		ns, err = lister.Get(req.Namespace)
+	} else if client := KubeClient(ctx); client != nil {
+		ns, err = client.CoreV1().Namespaces().Get(ctx, req.Namespace, metaV1.GetOptions{})
+	} else {
+		return nil, errors.New("neither a Kubernetes client nor an informer factory is configured")
+	}
+
+	if apiErrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not get namespace %s: %v", req.Namespace, err)
+	}
+	return ns.Labels, nil
+}
+
+// handlerContext enriches the context of a request with the dependencies available to handlers.
+func (ac *admissionController) handlerContext(ctx context.Context) context.Context {
+	if ac.kubeClient != nil {
+		ctx = context.WithValue(ctx, kubeClientKey{}, ac.kubeClient)
+	}
+	if ac.listers != nil {
+		ctx = context.WithValue(ctx, listersKey{}, ac.listers)
+	}
+	return ctx
+}
@@ -0,0 +1,206 @@
+package admit_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	admissionV1 "k8s.io/api/admission/v1"
+	coreV1 "k8s.io/api/core/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// configMap returns a config map in the default namespace holding the data.
+func configMap(name string, data map[string]string) *coreV1.ConfigMap {
+	return &coreV1.ConfigMap{ObjectMeta: metaV1.ObjectMeta{Name: name, Namespace: "default"}, Data: data}
+}
+
+func TestKubeClient(t *testing.T) {
+	tests := []struct {
+		name        string
+		objects     []runtime.Object
+		wantPatches int
+	}{
+		{name: "enabled", objects: []runtime.Object{configMap("sidecar", map[string]string{"inject": "true"})}, wantPatches: 1},
+		{name: "disabled", objects: []runtime.Object{configMap("sidecar", map[string]string{"inject": "false"})}},
+		{name: "missing config map"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(admit.WithKubeClient(fake.NewSimpleClientset(tt.objects...)))
+			ac.RegisterCtx("sidecar", func(ctx context.Context, req *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				cm, err := admit.KubeClient(ctx).CoreV1().ConfigMaps(req.Namespace).Get(ctx, "sidecar", metaV1.GetOptions{})
+				if apiErrors.IsNotFound(err) {
+					return nil, nil
+				} else if err != nil {
+					return nil, err
+				}
+				if cm.Data["inject"] != "true" {
+					return nil, nil
+				}
+				return patching("injected")(req)
+			})
+
+			res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+			if !res.Allowed {
+				t.Fatalf("got denied: %s", messageOf(res))
+			}
+			if got := len(patchesOf(t, res)); got != tt.wantPatches {
+				t.Errorf("got %d patch operations, want %d", got, tt.wantPatches)
+			}
+		})
+	}
+}
+
+func TestKubeClientUnset(t *testing.T) {
+	ac := admit.New()
+	configured := true
+	ac.RegisterCtx("lookup", func(ctx context.Context, _ *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+		configured = admit.KubeClient(ctx) != nil
+		return nil, nil
+	})
+	responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+	if configured {
+		t.Error("got a client without WithKubeClient")
+	}
+}
+
+// namespace returns a namespace with the labels.
+func namespace(name string, labels map[string]string) *coreV1.Namespace {
+	return &coreV1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: name, Labels: labels}}
+}
+
+// readyz returns the status of the readiness probe of the controller.
+func readyz(ac admit.AdmissionController) int {
+	rec := httptest.NewRecorder()
+	ac.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	return rec.Code
+}
+
+func TestInformerFactory(t *testing.T) {
+	client := fake.NewSimpleClientset(namespace("default", map[string]string{"team": "web"}), configMap("sidecar", nil))
+	factory := informers.NewSharedInformerFactory(client, 0)
+	ac := admit.New(admit.WithInformerFactory(factory))
+	var team string
+	var found bool
+	ac.RegisterCtx("lookup", func(ctx context.Context, req *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+		ns, err := admit.NamespaceLister(ctx).Get(req.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		team = ns.Labels["team"]
+		_, err = admit.ConfigMapLister(ctx).ConfigMaps(req.Namespace).Get("sidecar")
+		found = err == nil
+		return nil, nil
+	})
+
+	ac.SetReady(true)
+	if got := readyz(ac); got != http.StatusServiceUnavailable {
+		t.Errorf("got readiness %d before the caches synced, want %d", got, http.StatusServiceUnavailable)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	for typ, synced := range factory.WaitForCacheSync(stop) {
+		if !synced {
+			t.Fatalf("cache of %v did not sync", typ)
+		}
+	}
+	if got := readyz(ac); got != http.StatusOK {
+		t.Errorf("got readiness %d after the caches synced, want %d", got, http.StatusOK)
+	}
+
+	if res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod())))); !res.Allowed {
+		t.Fatalf("got denied: %s", messageOf(res))
+	}
+	if team != "web" || !found {
+		t.Errorf("got namespace label %q and config map found %t, want web and true", team, found)
+	}
+}
+
+func TestNamespaceLabels(t *testing.T) {
+	objects := []runtime.Object{
+		namespace("prod", map[string]string{"env": "prod"}),
+		namespace("dev", map[string]string{"env": "dev"}),
+	}
+	backends := []struct {
+		name string
+		// setup returns the option making the namespaces available to handlers, and a function to call once the
+		// controller was created.
+		setup func(t *testing.T) (admit.Option, func())
+	}{
+		{
+			name: "client",
+			setup: func(*testing.T) (admit.Option, func()) {
+				return admit.WithKubeClient(fake.NewSimpleClientset(objects...)), func() {}
+			},
+		},
+		{
+			name: "lister",
+			setup: func(t *testing.T) (admit.Option, func()) {
+				factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(objects...), 0)
+				return admit.WithInformerFactory(factory), func() {
+					stop := make(chan struct{})
+					t.Cleanup(func() { close(stop) })
+					factory.Start(stop)
+					factory.WaitForCacheSync(stop)
+				}
+			},
+		},
+	}
+	tests := []struct {
+		name        string
+		namespace   string
+		wantPatches int
+	}{
+		{name: "prod namespace", namespace: "prod", wantPatches: 1},
+		{name: "dev namespace", namespace: "dev"},
+		{name: "missing namespace", namespace: "staging"},
+		{name: "cluster-scoped object"},
+	}
+	for _, backend := range backends {
+		for _, tt := range tests {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				opt, start := backend.setup(t)
+				ac := admit.New(opt)
+				ac.RegisterCtx("prod-only", prodOnly)
+				start()
+
+				pod := testPod()
+				pod.Namespace = tt.namespace
+				res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, pod))))
+				if !res.Allowed {
+					t.Fatalf("got denied: %s", messageOf(res))
+				}
+				if got := len(patchesOf(t, res)); got != tt.wantPatches {
+					t.Errorf("got %d patch operations, want %d", got, tt.wantPatches)
+				}
+			})
+		}
+	}
+
+	t.Run("unconfigured", func(t *testing.T) {
+		ac := admit.New()
+		ac.RegisterCtx("prod-only", prodOnly)
+		res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+		if want := "neither a Kubernetes client nor an informer factory is configured"; res.Allowed || messageOf(res) != want {
+			t.Errorf("got allowed %t with message %q, want a denial with %q", res.Allowed, messageOf(res), want)
+		}
+	})
+}
+
+// prodOnly is an AdmitFuncCtx adding a label to objects in namespaces labeled env=prod.
+func prodOnly(ctx context.Context, req *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+	labels, err := admit.NamespaceLabels(ctx, req)
+	if err != nil || labels["env"] != "prod" {
+		return nil, err
+	}
+	return patching("prod")(req)
+}
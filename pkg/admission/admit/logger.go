@@ -0,0 +1,106 @@
+package admit
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	admissionV1 "k8s.io/api/admission/v1"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// ParseLevel parses the name of a level, one of "debug", "info", "warn" or "error".
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level %s", name)
+	}
+}
+
+// Logger is the logging interface of the admission controller, e.g. implemented by an adapter to zap or slog.
+// keysAndValues are alternating keys and values adding structured context to the message.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, err error, keysAndValues ...interface{})
+}
+
+// stdLogger is a Logger writing messages with at least its level to a standard logger, the context is appended as
+// key=value pairs.
+type stdLogger struct {
+	logger *log.Logger
+	level  Level
+}
+
+// NewStdLogger creates a Logger writing messages of the given level or above to l, or to the standard logger if l is
+// nil. At LevelDebug, the patches sent to the apiserver are logged as well.
+func NewStdLogger(l *log.Logger, level Level) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return &stdLogger{logger: l, level: level}
+}
+
+func (l *stdLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.log(LevelDebug, msg, keysAndValues)
+}
+
+func (l *stdLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.log(LevelInfo, msg, keysAndValues)
+}
+
+func (l *stdLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.log(LevelWarn, msg, keysAndValues)
+}
+
+func (l *stdLogger) Error(msg string, err error, keysAndValues ...interface{}) {
+	l.log(LevelError, fmt.Sprintf("%s: %v", msg, err), keysAndValues)
+}
+
+func (l *stdLogger) log(level Level, msg string, keysAndValues []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i+1 < len(keysAndValues) {
+			fmt.Fprintf(&sb, " %v=%v", keysAndValues[i], keysAndValues[i+1])
+		} else {
+			fmt.Fprintf(&sb, " %v", keysAndValues[i])
+		}
+	}
+	l.logger.Print(sb.String())
+}
+
+// discardLogger is a Logger dropping all messages.
+type discardLogger struct{}
+
+func (discardLogger) Debug(string, ...interface{})        {}
+func (discardLogger) Info(string, ...interface{})         {}
+func (discardLogger) Warn(string, ...interface{})         {}
+func (discardLogger) Error(string, error, ...interface{}) {}
+
+// requestFields returns the logging context identifying the request.
+func requestFields(req *admissionV1.AdmissionRequest) []interface{} {
+	return []interface{}{"uid", req.UID, "namespace", req.Namespace, "kind", req.Kind.String()}
+}
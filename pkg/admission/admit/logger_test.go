@@ -0,0 +1,358 @@
+package admit_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	admissionV1 "k8s.io/api/admission/v1"
+)
+
+// logEntry is a message logged at a recordingLogger along with its context.
+type logEntry struct {
+	msg    string
+	fields map[string]string
+}
+
+// recordingLogger is a Logger recording the messages logged at info and warn level.
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) Debug(string, ...interface{}) {}
+
+func (l *recordingLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.record(msg, keysAndValues)
+}
+
+func (l *recordingLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.record(msg, keysAndValues)
+}
+
+func (l *recordingLogger) Error(string, error, ...interface{}) {}
+
+// record records the message along with its context.
+func (l *recordingLogger) record(msg string, keysAndValues []interface{}) {
+	fields := map[string]string{}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields[fmt.Sprint(keysAndValues[i])] = fmt.Sprint(keysAndValues[i+1])
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, logEntry{msg: msg, fields: fields})
+}
+
+// logged returns the context of the messages logged with msg.
+func (l *recordingLogger) logged(msg string) []map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var fields []map[string]string
+	for _, e := range l.entries {
+		if e.msg == msg {
+			fields = append(fields, e.fields)
+		}
+	}
+	return fields
+}
+
+func TestLoggerContext(t *testing.T) {
+	logger := &recordingLogger{}
+	ac := admit.New(admit.WithLogger(logger))
+	ac.Register("deny", failing("not allowed"))
+
+	req := podRequest(t, testPod())
+	if res := responseOf(t, post(t, ac, "/mutate", newReview(req))); res.Allowed {
+		t.Fatal("got allowed")
+	}
+	if got, want := logger.logged("registering handler"), []map[string]string{{"name": "deny", "path": "/mutate"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got registrations logged with %v, want %v", got, want)
+	}
+	want := []map[string]string{{
+		"uid": "uid", "namespace": "default", "kind": "/v1, Kind=Pod", "handler": "deny", "reason": "not allowed",
+	}}
+	if got := logger.logged("denied admission request"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got denials logged with %v, want %v", got, want)
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	tests := []struct {
+		name  string
+		level admit.Level
+		log   func(admit.Logger)
+		want  string
+	}{
+		{
+			name:  "context",
+			level: admit.LevelInfo,
+			log:   func(l admit.Logger) { l.Info("reviewed", "uid", "a", "allowed", true) },
+			want:  "reviewed uid=a allowed=true\n",
+		},
+		{
+			name:  "odd context",
+			level: admit.LevelInfo,
+			log:   func(l admit.Logger) { l.Warn("reviewed", "uid", "a", "dangling") },
+			want:  "reviewed uid=a dangling\n",
+		},
+		{
+			name:  "error",
+			level: admit.LevelInfo,
+			log: func(l admit.Logger) {
+				l.Error("could not write response", errors.New("broken pipe"), "path", "/mutate")
+			},
+			want: "could not write response: broken pipe path=/mutate\n",
+		},
+		{
+			name:  "below level",
+			level: admit.LevelWarn,
+			log: func(l admit.Logger) {
+				l.Debug("debug")
+				l.Info("info")
+			},
+		},
+		{
+			name:  "at level",
+			level: admit.LevelWarn,
+			log:   func(l admit.Logger) { l.Warn("warn") },
+			want:  "warn\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sb strings.Builder
+			tt.log(admit.NewStdLogger(log.New(&sb, "", 0), tt.level))
+			if sb.String() != tt.want {
+				t.Errorf("got %q, want %q", sb.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestReviewSummaryLog(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []admit.Option
+		handlers map[string]admit.AdmitFunc
+		// wantCode is the status of the response, http.StatusOK if not set.
+		wantCode int
+		want     map[string]string
+	}{
+		{
+			name:     "allowed with patch",
+			handlers: map[string]admit.AdmitFunc{"a": patching("a"), "b": patching("b")},
+			want: map[string]string{
+				"uid": "uid", "namespace": "default", "kind": "/v1, Kind=Pod", "operation": "CREATE",
+				"handlers": "a,b", "allowed": "true", "patchOperations": "2",
+			},
+		},
+		{
+			name:     "denied",
+			handlers: map[string]admit.AdmitFunc{"a": failing("denied")},
+			want: map[string]string{
+				"uid": "uid", "namespace": "default", "kind": "/v1, Kind=Pod", "operation": "CREATE",
+				"handlers": "a", "allowed": "false", "patchOperations": "0",
+			},
+		},
+		{
+			name: "retriable",
+			handlers: map[string]admit.AdmitFunc{"a": func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				return nil, admit.RetriableError{Err: errors.New("unavailable")}
+			}},
+			wantCode: http.StatusServiceUnavailable,
+			want: map[string]string{
+				"uid": "uid", "namespace": "default", "kind": "/v1, Kind=Pod", "operation": "CREATE",
+				"handlers": "a", "allowed": "false", "patchOperations": "0", "error": "unavailable",
+			},
+		},
+		{
+			name:     "exceeding the patch limit",
+			opts:     []admit.Option{admit.WithMaxPatchOps(1)},
+			handlers: map[string]admit.AdmitFunc{"a": patching("a"), "b": patching("b")},
+			wantCode: http.StatusInternalServerError,
+			want: map[string]string{
+				"uid": "uid", "namespace": "default", "kind": "/v1, Kind=Pod", "operation": "CREATE",
+				"handlers": "a,b", "allowed": "false", "patchOperations": "0",
+				"error": "handlers produced 2 patch operations, exceeding the limit of 1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &recordingLogger{}
+			ac := admit.New(append([]admit.Option{admit.WithLogger(logger)}, tt.opts...)...)
+			for _, name := range []string{"a", "b"} {
+				if h, ok := tt.handlers[name]; ok {
+					ac.Register(name, h)
+				}
+			}
+
+			wantCode := tt.wantCode
+			if wantCode == 0 {
+				wantCode = http.StatusOK
+			}
+			if rec := post(t, ac, "/mutate", newReview(podRequest(t, testPod()))); rec.Code != wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, wantCode, rec.Body)
+			}
+			got := logger.logged("reviewed admission request")
+			if len(got) != 1 {
+				t.Fatalf("got %d summary lines, want one", len(got))
+			}
+			if !reflect.DeepEqual(got[0], tt.want) {
+				t.Errorf("got summary %v, want %v", got[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestBodySnippetLog(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		opts []admit.Option
+		// want is the logged snippet, none is expected if it is empty.
+		want string
+	}{
+		{name: "invalid JSON", body: `{"request":{"uid":`, want: `{"request":{"uid":`},
+		{name: "truncated", body: `{"request":{"uid":"secret",`, opts: []admit.Option{admit.WithBodySnippetBytes(12)}, want: `{"request":{...`},
+		{name: "sanitized", body: "{\"request\":\n\x00\xff", want: `{"request":...`},
+		{name: "disabled", body: `{"request":`, opts: []admit.Option{admit.WithBodySnippetBytes(0)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &recordingLogger{}
+			ac := admit.New(append([]admit.Option{admit.WithLogger(logger)}, tt.opts...)...)
+			rec := post(t, ac, "/mutate", []byte(tt.body))
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+
+			var got []string
+			for _, fields := range logger.logged("received malformed admission review") {
+				got = append(got, fields["body"])
+			}
+			if want := nonEmpty(tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("got logged bodies %q, want %q", got, want)
+			}
+			if tt.want != "" && strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("got response %s leaking the body", rec.Body)
+			}
+		})
+	}
+}
+
+func TestSlowRequestLog(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		delay     time.Duration
+		wantSlow  bool
+	}{
+		{name: "slow handler", threshold: 20 * time.Millisecond, delay: 50 * time.Millisecond, wantSlow: true},
+		{name: "fast handler", threshold: time.Second},
+		{name: "disabled", delay: 20 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &recordingLogger{}
+			ac := admit.New(admit.WithLogger(logger), admit.WithSlowRequestThreshold(tt.threshold))
+			ac.Register("fast", patching("a"))
+			ac.Register("slow", func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				time.Sleep(tt.delay)
+				return nil, nil
+			})
+			if res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod())))); !res.Allowed {
+				t.Fatalf("got denied: %s", messageOf(res))
+			}
+
+			logged := logger.logged("slow admission request")
+			if len(logged) != btoi(tt.wantSlow) {
+				t.Fatalf("got %d slow request logs, want slow %t", len(logged), tt.wantSlow)
+			}
+			if !tt.wantSlow {
+				return
+			}
+			fields := logged[0]
+			if fields["threshold"] != tt.threshold.String() {
+				t.Errorf("got threshold %s, want %s", fields["threshold"], tt.threshold)
+			}
+			if d, err := time.ParseDuration(fields["duration"]); err != nil || d < tt.delay {
+				t.Errorf("got duration %s, want at least %s", fields["duration"], tt.delay)
+			}
+			runs := strings.Split(fields["handlers"], ",")
+			if len(runs) != 2 || !strings.HasPrefix(runs[0], "fast=") || !strings.HasPrefix(runs[1], "slow=") {
+				t.Fatalf("got handlers %q, want the timings of fast and slow", fields["handlers"])
+			}
+			if d, err := time.ParseDuration(strings.TrimPrefix(runs[1], "slow=")); err != nil || d < tt.delay {
+				t.Errorf("got slow handler timing %s, want at least %s", runs[1], tt.delay)
+			}
+		})
+	}
+}
+
+// btoi returns 1 if b is set and 0 otherwise.
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestNilLogger(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []admit.Option
+	}{
+		{name: "nil logger", opts: []admit.Option{admit.WithLogger(nil)}},
+		{name: "standard logger for nil log.Logger", opts: []admit.Option{admit.WithLogger(admit.NewStdLogger(nil, admit.LevelDebug))}},
+		{name: "default logger"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The standard logger is the fallback for a nil log.Logger and the default of the controller.
+			defer log.SetOutput(log.Writer())
+			log.SetOutput(io.Discard)
+
+			// Register and serve requests logging at every level: duplicate names, denials, transient failures, malformed
+			// and slow requests.
+			ac := admit.New(append(tt.opts, admit.WithSlowRequestThreshold(time.Nanosecond))...)
+			ac.Register("label", patching("a"))
+			ac.Register("label", patching("b"))
+			ac.RegisterValidator("policy", func(*admissionV1.AdmissionRequest) error { return errors.New("denied") })
+			ac.Register("transient", func(req *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				if req.Namespace == "flaky" {
+					return nil, admit.RetriableError{Err: errors.New("unavailable")}
+				}
+				return nil, nil
+			})
+
+			flaky := testPod()
+			flaky.Namespace = "flaky"
+			requests := []struct {
+				path     string
+				body     interface{}
+				wantCode int
+			}{
+				{path: "/mutate", body: newReview(podRequest(t, testPod())), wantCode: http.StatusOK},
+				{path: "/validate", body: newReview(podRequest(t, testPod())), wantCode: http.StatusOK},
+				{path: "/mutate", body: newReview(podRequest(t, flaky)), wantCode: http.StatusServiceUnavailable},
+				{path: "/mutate", body: []byte("{"), wantCode: http.StatusBadRequest},
+			}
+			for _, r := range requests {
+				if rec := post(t, ac, r.path, r.body); rec.Code != r.wantCode {
+					t.Errorf("got status %d for %s, want %d: %s", rec.Code, r.path, r.wantCode, rec.Body)
+				}
+			}
+			ac.Unregister("label")
+			ac.Reset()
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package admit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// MergePatchToOperations converts a JSON merge patch (see https://tools.ietf.org/html/rfc7386) into the equivalent
+// JSON patch operations for the raw original object, as admission responses only support JSON patches. Keys set to
+// null are removed if present, objects are merged recursively and any other value is added or replaced.
+func MergePatchToOperations(original, mergePatch []byte) ([]PatchOperation, error) {
+	var doc, patch interface{}
+	if err := json.Unmarshal(original, &doc); err != nil {
+		return nil, fmt.Errorf("could not unmarshal original object: %v", err)
+	}
+	if err := json.Unmarshal(mergePatch, &patch); err != nil {
+		return nil, fmt.Errorf("could not unmarshal merge patch: %v", err)
+	}
+
+	docObj, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("original object is not a JSON object")
+	}
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("merge patch is not a JSON object")
+	}
+
+	var b PatchBuilder
+	mergeOperations(&b, "", docObj, patchObj)
+	return b.Build(), nil
+}
+
+// mergeOperations appends the operations merging patch into the object doc at the given path.
+func mergeOperations(b *PatchBuilder, path string, doc, patch map[string]interface{}) {
+	// Keys are sorted for deterministic operations.
+	keys := make([]string, 0, len(patch))
+	for key := range patch {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := patch[key]
+		current, exists := doc[key]
+		keyPath := path + "/" + EscapePointer(key)
+
+		switch {
+		case value == nil:
+			if exists {
+				b.Remove(keyPath)
+			}
+		case !exists:
+			b.Add(keyPath, withoutNulls(value))
+		default:
+			currentObj, currentIsObj := current.(map[string]interface{})
+			valueObj, valueIsObj := value.(map[string]interface{})
+			if currentIsObj && valueIsObj {
+				mergeOperations(b, keyPath, currentObj, valueObj)
+			} else if !reflect.DeepEqual(current, value) {
+				b.Replace(keyPath, withoutNulls(value))
+			}
+		}
+	}
+}
+
+// withoutNulls removes null members from objects of a merge patch value, as a merge patch does not create them.
+func withoutNulls(value interface{}) interface{} {
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	cleaned := make(map[string]interface{}, len(obj))
+	for key, v := range obj {
+		if v != nil {
+			cleaned[key] = withoutNulls(v)
+		}
+	}
+	return cleaned
+}
@@ -0,0 +1,87 @@
+package admit_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	jsonpatch "github.com/evanphx/json-patch/v5"
+)
+
+func TestMergePatchToOperations(t *testing.T) {
+	original := `{"metadata":{"name":"web","labels":{"app":"web","tier":"front"}},"spec":{"replicas":1}}`
+	tests := []struct {
+		name    string
+		patch   string
+		want    []admit.PatchOperation
+		wantErr bool
+	}{
+		{
+			name:  "add",
+			patch: `{"metadata":{"annotations":{"example.com/a":"b"}}}`,
+			want:  []admit.PatchOperation{{Op: "add", Path: "/metadata/annotations", Value: map[string]interface{}{"example.com/a": "b"}}},
+		},
+		{
+			name:  "replace",
+			patch: `{"spec":{"replicas":3}}`,
+			want:  []admit.PatchOperation{{Op: "replace", Path: "/spec/replicas", Value: float64(3)}},
+		},
+		{
+			name:  "remove",
+			patch: `{"metadata":{"labels":{"tier":null}}}`,
+			want:  []admit.PatchOperation{{Op: "remove", Path: "/metadata/labels/tier"}},
+		},
+		{
+			name:  "remove missing key",
+			patch: `{"metadata":{"labels":{"missing":null}}}`,
+		},
+		{
+			name:  "unchanged",
+			patch: `{"metadata":{"labels":{"app":"web"}}}`,
+		},
+		{
+			name:  "mixed",
+			patch: `{"metadata":{"labels":{"app":"api","tier":null,"new":"x"}},"spec":{"paused":true}}`,
+			want: []admit.PatchOperation{
+				{Op: "replace", Path: "/metadata/labels/app", Value: "api"},
+				{Op: "add", Path: "/metadata/labels/new", Value: "x"},
+				{Op: "remove", Path: "/metadata/labels/tier"},
+				{Op: "add", Path: "/spec/paused", Value: true},
+			},
+		},
+		{
+			name:  "nulls in added objects",
+			patch: `{"spec":{"template":{"a":1,"b":null}}}`,
+			want:  []admit.PatchOperation{{Op: "add", Path: "/spec/template", Value: map[string]interface{}{"a": float64(1)}}},
+		},
+		{name: "not an object", patch: `[1]`, wantErr: true},
+		{name: "malformed", patch: `{`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops, err := admit.MergePatchToOperations([]byte(original), []byte(tt.patch))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(ops) != len(tt.want) || len(ops) > 0 && !reflect.DeepEqual(ops, tt.want) {
+				t.Errorf("got %v, want %v", ops, tt.want)
+			}
+
+			// The operations have to yield the object the merge patch would.
+			patched, err := admit.ApplyPatches([]byte(original), ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			merged, err := jsonpatch.MergePatch([]byte(original), []byte(tt.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !jsonpatch.Equal(patched, merged) {
+				t.Errorf("got %s after applying the operations, want %s", patched, merged)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package admit
+
+import (
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EnsureAnnotation returns the patch operations setting the annotation key to value on the given object. The
+// annotations map is initialized first if the object has none. No operations are returned if the annotation is
+// already set to value.
+func EnsureAnnotation(obj metaV1.Object, key, value string) []PatchOperation {
+	return ensureMapEntry(obj.GetAnnotations(), "annotations", key, value)
+}
+
+// EnsureLabel returns the patch operations setting the label key to value on the given object. The labels map is
+// initialized first if the object has none. No operations are returned if the label is already set to value.
+func EnsureLabel(obj metaV1.Object, key, value string) []PatchOperation {
+	return ensureMapEntry(obj.GetLabels(), "labels", key, value)
+}
+
+// ensureMapEntry returns the patch operations setting key to value in the metadata map of the given field.
+func ensureMapEntry(m map[string]string, field, key, value string) []PatchOperation {
+	if current, ok := m[key]; ok && current == value {
+		return nil
+	}
+
+	var b PatchBuilder
+	if m == nil {
+		// Adding a key into a missing map fails, so the map has to be created first. Other handlers creating it as
+		// well do not discard the key unless conflicts are ignored, see ConflictPolicy.
+		b.Add(Pointer("metadata", field), map[string]string{})
+	}
+	return b.Add(Pointer("metadata", field, key), value).Build()
+}
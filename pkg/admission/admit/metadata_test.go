@@ -0,0 +1,91 @@
+package admit_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEnsureLabelAndAnnotation(t *testing.T) {
+	tests := []struct {
+		name   string
+		meta   metaV1.ObjectMeta
+		ensure func(metaV1.Object, string, string) []admit.PatchOperation
+		want   []admit.PatchOperation
+	}{
+		{
+			name:   "nil labels",
+			ensure: admit.EnsureLabel,
+			want: []admit.PatchOperation{
+				{Op: "add", Path: "/metadata/labels", Value: map[string]interface{}{}},
+				{Op: "add", Path: "/metadata/labels/example.com~1inject", Value: "true"},
+			},
+		},
+		{
+			name:   "existing labels",
+			meta:   metaV1.ObjectMeta{Labels: map[string]string{"app": "web"}},
+			ensure: admit.EnsureLabel,
+			want:   []admit.PatchOperation{{Op: "add", Path: "/metadata/labels/example.com~1inject", Value: "true"}},
+		},
+		{
+			name:   "label already set",
+			meta:   metaV1.ObjectMeta{Labels: map[string]string{"example.com/inject": "true"}},
+			ensure: admit.EnsureLabel,
+		},
+		{
+			name:   "label set to another value",
+			meta:   metaV1.ObjectMeta{Labels: map[string]string{"example.com/inject": "false"}},
+			ensure: admit.EnsureLabel,
+			want:   []admit.PatchOperation{{Op: "add", Path: "/metadata/labels/example.com~1inject", Value: "true"}},
+		},
+		{
+			name:   "nil annotations",
+			ensure: admit.EnsureAnnotation,
+			want: []admit.PatchOperation{
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]interface{}{}},
+				{Op: "add", Path: "/metadata/annotations/example.com~1inject", Value: "true"},
+			},
+		},
+		{
+			name:   "existing annotations",
+			meta:   metaV1.ObjectMeta{Annotations: map[string]string{"note": "x"}},
+			ensure: admit.EnsureAnnotation,
+			want:   []admit.PatchOperation{{Op: "add", Path: "/metadata/annotations/example.com~1inject", Value: "true"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := testPod()
+			tt.meta.Name, tt.meta.Namespace = pod.Name, pod.Namespace
+			pod.ObjectMeta = tt.meta
+
+			ops := tt.ensure(pod, "example.com/inject", "true")
+			// Compare the JSON representation, the map values are of different types.
+			var got []admit.PatchOperation
+			if err := json.Unmarshal(mustMarshal(t, ops), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// applyToPod applies the patch operations to the pod and returns the patched pod.
+func applyToPod(t testing.TB, pod *coreV1.Pod, ops []admit.PatchOperation) *coreV1.Pod {
+	t.Helper()
+	raw, err := admit.ApplyPatches(mustMarshal(t, pod), ops)
+	if err != nil {
+		t.Fatalf("applying %v: %v", ops, err)
+	}
+	patched := &coreV1.Pod{}
+	if err := json.Unmarshal(raw, patched); err != nil {
+		t.Fatal(err)
+	}
+	return patched
+}
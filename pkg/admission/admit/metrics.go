@@ -0,0 +1,91 @@
+package admit
+
+import (
+	"time"
+)
+
+// Metrics path
+const (
+	metricsPath = "/metrics"
+)
+
+// Handler results as reported to the MetricsRecorder, handlers failing with a RetriableError neither allow nor deny
+const (
+	ResultAllowed = "allowed"
+	ResultDenied  = "denied"
+	ResultFailed  = "failed"
+)
+
+// MetricsRecorder records metrics of the admission handlers, see package metrics for a Prometheus implementation. If
+// the recorder is also a http.Handler, it is served at /metrics.
+type MetricsRecorder interface {
+	// ObserveHandler records the result and duration of a single handler invocation.
+	ObserveHandler(handler, result string, duration time.Duration)
+}
+
+// DenialRecorder is a MetricsRecorder that also records the reasons of denials. Recorders implementing it are told
+// about every denied request in addition to the handler invocation.
+type DenialRecorder interface {
+	MetricsRecorder
+	// ObserveDenial records that the handler denied a request for the reason.
+	ObserveDenial(handler, reason string)
+}
+
+// RequestRecorder is a MetricsRecorder that also records the outcome and duration of whole webhook requests. Unlike
+// the handler invocations, these include the requests no handler ran for, e.g. those for exempt namespaces or
+// malformed ones.
+type RequestRecorder interface {
+	MetricsRecorder
+	// ObserveRequest records the outcome and duration of a webhook request.
+	ObserveRequest(outcome string, duration time.Duration)
+}
+
+// Request outcomes as reported to the RequestRecorder, requests not answered with an AdmissionReview are errors
+const (
+	OutcomeAllowed = "allowed"
+	OutcomeDenied  = "denied"
+	OutcomeError   = "error"
+)
+
+// Reason reported to the DenialRecorder for handlers not returning a DenyError with a reason
+const (
+	ReasonUnknown = "unknown"
+)
+
+// nopMetricsRecorder discards all metrics.
+type nopMetricsRecorder struct{}
+
+func (nopMetricsRecorder) ObserveHandler(string, string, time.Duration) {}
+
+// resultOf returns the result reported for a handler that returned err.
+func resultOf(err error) string {
+	if isRetriable(err) {
+		return ResultFailed
+	} else if err != nil {
+		return ResultDenied
+	}
+	return ResultAllowed
+}
+
+// reasonOf returns the reason reported for a handler that denied a request with err.
+func reasonOf(err error) string {
+	if deny, ok := asDenyError(err); ok && deny.Reason != "" {
+		return string(deny.Reason)
+	}
+	return ReasonUnknown
+}
+
+// observeDenial reports the denial of a request by the handler to the metrics recorder, if it records denials.
+func (ac *admissionController) observeDenial(handler string, err error) {
+	if r, ok := ac.metrics.(DenialRecorder); ok {
+		r.ObserveDenial(handler, reasonOf(err))
+	}
+}
+
+// observeRequest reports the outcome and duration of a webhook request to the metrics recorder, if it records
+// requests.
+func (ac *admissionController) observeRequest(outcome string, duration time.Duration) {
+	if r, ok := ac.metrics.(RequestRecorder); ok {
+		r.ObserveRequest(outcome, duration)
+	}
+}
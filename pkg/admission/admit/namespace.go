@@ -0,0 +1,55 @@
+package admit
+
+import (
+	"strings"
+
+	"github.com/52north/admission-webhook-server/pkg/utils"
+	admissionV1 "k8s.io/api/admission/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Additional namespaces handlers are never run for, separated by ","
+const (
+	ENV_EXEMPT_NAMESPACES = "EXEMPT_NAMESPACES"
+	namespaceSeparator    = ","
+)
+
+// kubeNamespaces are the Kubernetes-owned namespaces, which are always exempt.
+var kubeNamespaces = []string{metaV1.NamespacePublic, metaV1.NamespaceSystem}
+
+// Get additionally exempt namespaces
+func GetExemptNamespaces() []string {
+	var namespaces []string
+	for _, ns := range strings.Split(utils.GetEnvVal(ENV_EXEMPT_NAMESPACES, ""), namespaceSeparator) {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return namespaces
+}
+
+// handlesNamespace checks if handlers are run for requests in the given namespace: it must not be exempt and, if
+// namespaces are included explicitly, be one of them. Requests of cluster-scoped objects have no namespace, they are
+// handled unless disabled or namespaces are included explicitly.
+func (ac *admissionController) handlesNamespace(ns string) bool {
+	if ns == "" && !ac.handleClusterScoped {
+		return false
+	}
+	if ac.exempt.Has(ns) {
+		return false
+	}
+	return ac.include == nil || ac.include.Has(ns)
+}
+
+// namespaceKind is the kind of Namespace objects.
+var namespaceKind = metaV1.GroupVersionKind{Group: "", Version: "v1", Kind: "Namespace"}
+
+// scopeOf returns the namespace the exemptions are checked against for the request. Namespaces are cluster-scoped,
+// but the apiserver sets the namespace of their requests to their own name, so creating a namespace named like an
+// exempt one would skip the handlers. Their requests are therefore treated like those of other cluster-scoped objects.
+func scopeOf(req *admissionV1.AdmissionRequest) string {
+	if req.Kind.Group == namespaceKind.Group && req.Kind.Kind == namespaceKind.Kind {
+		return ""
+	}
+	return req.Namespace
+}
@@ -0,0 +1,177 @@
+package admit_test
+
+import (
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	admissionV1 "k8s.io/api/admission/v1"
+	coreV1 "k8s.io/api/core/v1"
+	rbacV1 "k8s.io/api/rbac/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// ranIn posts a pod request in the namespace to a controller with the options and a patching handler, and reports
+// whether the handler patched the pod. Requests not handled must be allowed.
+func ranIn(t *testing.T, namespace string, opts ...admit.Option) bool {
+	t.Helper()
+	pod := testPod()
+	pod.Namespace = namespace
+	return ranFor(t, podRequest(t, pod), opts...)
+}
+
+// ranFor posts the request to a controller with the options and a patching handler, and reports whether the handler
+// patched the object. Requests not handled must be allowed.
+func ranFor(t *testing.T, req *admissionV1.AdmissionRequest, opts ...admit.Option) bool {
+	t.Helper()
+	ac := admit.New(opts...)
+	ac.Register("label", patching("a"))
+
+	res := responseOf(t, post(t, ac, "/mutate", newReview(req)))
+	if !res.Allowed {
+		t.Fatalf("got denied: %s", messageOf(res))
+	}
+	return len(patchesOf(t, res)) > 0
+}
+
+func TestExemptNamespaces(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		env       string
+		opts      []admit.Option
+		wantRun   bool
+	}{
+		{name: "regular namespace", namespace: "default", wantRun: true},
+		{name: "kube-system", namespace: "kube-system"},
+		{name: "kube-public", namespace: "kube-public"},
+		{name: "option", namespace: "istio-system", opts: []admit.Option{admit.WithExemptNamespaces("istio-system", "monitoring")}},
+		{name: "option keeps defaults", namespace: "kube-system", opts: []admit.Option{admit.WithExemptNamespaces("monitoring")}},
+		{name: "environment", namespace: "monitoring", env: "istio-system, monitoring"},
+		{name: "environment and option", namespace: "istio-system", env: "monitoring", opts: []admit.Option{admit.WithExemptNamespaces("istio-system")}},
+		{name: "not exempt", namespace: "default", env: "monitoring", opts: []admit.Option{admit.WithExemptNamespaces("istio-system")}, wantRun: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(admit.ENV_EXEMPT_NAMESPACES, tt.env)
+			if got := ranIn(t, tt.namespace, tt.opts...); got != tt.wantRun {
+				t.Errorf("got handler run %t, want %t", got, tt.wantRun)
+			}
+		})
+	}
+}
+
+func TestIncludeNamespaces(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		opts      []admit.Option
+		wantRun   bool
+	}{
+		{name: "included", namespace: "team-a", opts: []admit.Option{admit.WithIncludeNamespaces("team-a", "team-b")}, wantRun: true},
+		{name: "not included", namespace: "default", opts: []admit.Option{admit.WithIncludeNamespaces("team-a", "team-b")}},
+		{name: "included and exempt", namespace: "team-a", opts: []admit.Option{admit.WithIncludeNamespaces("team-a"), admit.WithExemptNamespaces("team-a")}},
+		{name: "included kube namespace", namespace: "kube-system", opts: []admit.Option{admit.WithIncludeNamespaces("kube-system")}},
+		{name: "no include list", namespace: "default", wantRun: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ranIn(t, tt.namespace, tt.opts...); got != tt.wantRun {
+				t.Errorf("got handler run %t, want %t", got, tt.wantRun)
+			}
+		})
+	}
+}
+
+// clusterRoleRequest returns a request creating a cluster-scoped ClusterRole.
+func clusterRoleRequest(t *testing.T) *admissionV1.AdmissionRequest {
+	t.Helper()
+	role := &rbacV1.ClusterRole{
+		TypeMeta:   metaV1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+		ObjectMeta: metaV1.ObjectMeta{Name: "reader"},
+	}
+	return &admissionV1.AdmissionRequest{
+		UID:       "uid",
+		Operation: admissionV1.Create,
+		Kind:      metaV1.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRole"},
+		Resource:  metaV1.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"},
+		Name:      role.Name,
+		Object:    runtime.RawExtension{Raw: mustMarshal(t, role)},
+	}
+}
+
+func TestHandleClusterScoped(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     func(*testing.T) *admissionV1.AdmissionRequest
+		opts    []admit.Option
+		wantRun bool
+	}{
+		{name: "cluster-scoped by default", req: clusterRoleRequest, wantRun: true},
+		{name: "cluster-scoped handled", req: clusterRoleRequest, opts: []admit.Option{admit.WithHandleClusterScoped(true)}, wantRun: true},
+		{name: "cluster-scoped skipped", req: clusterRoleRequest, opts: []admit.Option{admit.WithHandleClusterScoped(false)}},
+		{name: "cluster-scoped with included namespaces", req: clusterRoleRequest, opts: []admit.Option{admit.WithIncludeNamespaces("team-a")}},
+		{
+			name:    "namespaced while skipping cluster-scoped",
+			req:     func(t *testing.T) *admissionV1.AdmissionRequest { return podRequest(t, testPod()) },
+			opts:    []admit.Option{admit.WithHandleClusterScoped(false)},
+			wantRun: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ranFor(t, tt.req(t), tt.opts...); got != tt.wantRun {
+				t.Errorf("got handler run %t, want %t", got, tt.wantRun)
+			}
+		})
+	}
+}
+
+// namespaceRequest returns a request creating the Namespace, whose namespace the apiserver sets to its name.
+func namespaceRequest(name string) func(*testing.T) *admissionV1.AdmissionRequest {
+	return func(t *testing.T) *admissionV1.AdmissionRequest {
+		ns := &coreV1.Namespace{
+			TypeMeta:   metaV1.TypeMeta{APIVersion: "v1", Kind: "Namespace"},
+			ObjectMeta: metaV1.ObjectMeta{Name: name},
+		}
+		return &admissionV1.AdmissionRequest{
+			UID:       "uid",
+			Operation: admissionV1.Create,
+			Kind:      metaV1.GroupVersionKind{Version: "v1", Kind: "Namespace"},
+			Resource:  metaV1.GroupVersionResource{Version: "v1", Resource: "namespaces"},
+			Name:      name,
+			Namespace: name,
+			Object:    runtime.RawExtension{Raw: mustMarshal(t, ns)},
+		}
+	}
+}
+
+func TestNamespaceRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     func(*testing.T) *admissionV1.AdmissionRequest
+		opts    []admit.Option
+		wantRun bool
+	}{
+		{name: "normal namespace", req: namespaceRequest("team-a"), wantRun: true},
+		{name: "kube-prefixed namespace", req: namespaceRequest("kube-system"), wantRun: true},
+		{name: "exempt name", req: namespaceRequest("monitoring"), opts: []admit.Option{admit.WithExemptNamespaces("monitoring")}, wantRun: true},
+		{name: "included name", req: namespaceRequest("team-a"), opts: []admit.Option{admit.WithIncludeNamespaces("team-a")}},
+		{name: "cluster-scoped skipped", req: namespaceRequest("team-a"), opts: []admit.Option{admit.WithHandleClusterScoped(false)}},
+		{
+			name: "pod in kube-system",
+			req: func(t *testing.T) *admissionV1.AdmissionRequest {
+				pod := testPod()
+				pod.Namespace = "kube-system"
+				return podRequest(t, pod)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ranFor(t, tt.req(t), tt.opts...); got != tt.wantRun {
+				t.Errorf("got handler run %t, want %t", got, tt.wantRun)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package admit
+
+import (
+	"time"
+
+	admissionV1 "k8s.io/api/admission/v1"
+	admissionregistrationV1 "k8s.io/api/admissionregistration/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Option configures an AdmissionController on creation. Without options, the controller is configured by the
+// environment variables and logs to the standard logger.
+type Option func(*admissionController)
+
+// WithBasePath sets the path mutations are served at, overriding the BASE_PATH environment variable.
+func WithBasePath(path string) Option {
+	return func(ac *admissionController) {
+		ac.basePath = path
+	}
+}
+
+// WithValidatePath sets the path validations are served at, overriding the VALIDATE_PATH environment variable.
+func WithValidatePath(path string) Option {
+	return func(ac *admissionController) {
+		ac.validatePath = path
+	}
+}
+
+// WithLogger makes the controller log through the given logger instead of the standard logger. A nil logger
+// discards all messages.
+func WithLogger(l Logger) Option {
+	return func(ac *admissionController) {
+		if l == nil {
+			l = discardLogger{}
+		}
+		ac.logger = l
+	}
+}
+
+// WithMaxBodyBytes limits the size of request bodies, larger requests are rejected with 413 Request Entity Too
+// Large. It overrides the MAX_BODY_BYTES environment variable.
+func WithMaxBodyBytes(n int64) Option {
+	return func(ac *admissionController) {
+		ac.maxBodyBytes = n
+	}
+}
+
+// WithBodySnippetBytes sets the number of bytes of the body of malformed requests that are logged to help debugging
+// them, defaulting to 256. Zero disables logging the body.
+func WithBodySnippetBytes(n int) Option {
+	return func(ac *admissionController) {
+		ac.snippetBytes = n
+	}
+}
+
+// WithMetrics makes the controller report metrics to the given recorder.
+func WithMetrics(m MetricsRecorder) Option {
+	return func(ac *admissionController) {
+		ac.metrics = m
+	}
+}
+
+// WithExemptNamespaces adds namespaces handlers are never run for, in addition to the Kubernetes-owned ones and
+// those set by the EXEMPT_NAMESPACES environment variable.
+func WithExemptNamespaces(namespaces ...string) Option {
+	return func(ac *admissionController) {
+		ac.exempt.Insert(namespaces...)
+	}
+}
+
+// WithIncludeNamespaces restricts the handlers to requests in the given namespaces, all other requests are allowed
+// unchanged. Exempt namespaces are not handled even if included.
+func WithIncludeNamespaces(namespaces ...string) Option {
+	return func(ac *admissionController) {
+		if ac.include == nil {
+			ac.include = sets.New[string]()
+		}
+		ac.include.Insert(namespaces...)
+	}
+}
+
+// WithHandleClusterScoped sets whether handlers are run for requests of cluster-scoped objects like ClusterRoles or
+// Namespaces. By default they are, if disabled these requests are allowed unchanged.
+func WithHandleClusterScoped(enabled bool) Option {
+	return func(ac *admissionController) {
+		ac.handleClusterScoped = enabled
+	}
+}
+
+// WithAlwaysAllowKinds makes the controller allow requests for objects of the given kinds unchanged without running
+// any handler, e.g. for high-volume kinds like Events or Leases the webhook configuration cannot exclude.
+func WithAlwaysAllowKinds(kinds ...metaV1.GroupVersionKind) Option {
+	return func(ac *admissionController) {
+		if ac.alwaysAllow == nil {
+			ac.alwaysAllow = sets.New[metaV1.GroupVersionKind]()
+		}
+		ac.alwaysAllow.Insert(kinds...)
+	}
+}
+
+// WithPatchValidation enables applying the produced patches to the object before responding, so a patch that does
+// not apply fails the request with a descriptive error instead of being rejected by the apiserver. It costs CPU, as
+// the object is patched an additional time.
+func WithPatchValidation(enabled bool) Option {
+	return func(ac *admissionController) {
+		ac.validatePatches = enabled
+	}
+}
+
+// WithPanicPolicy sets how requests are answered if a handler panics: admissionregistrationV1.Fail denies the
+// request, admissionregistrationV1.Ignore continues as if the handler returned no result. It defaults to Fail.
+func WithPanicPolicy(policy admissionregistrationV1.FailurePolicyType) Option {
+	return func(ac *admissionController) {
+		ac.panicPolicy = policy
+	}
+}
+
+// WithHandlerTimeout limits the time each handler may take to admit a request. Handlers are passed a context with that
+// deadline. By default, handlers are only bound by the deadline of the request.
+func WithHandlerTimeout(d time.Duration) Option {
+	return func(ac *admissionController) {
+		ac.handlerTimeout = d
+	}
+}
+
+// WithTimeoutPolicy sets how requests are answered if a handler times out: admissionregistrationV1.Fail denies the
+// request, admissionregistrationV1.Ignore continues as if the handler returned no result. It defaults to Fail.
+func WithTimeoutPolicy(policy admissionregistrationV1.FailurePolicyType) Option {
+	return func(ac *admissionController) {
+		ac.timeoutPolicy = policy
+	}
+}
+
+// WithRequireHandlers makes the controller fail requests to paths no handlers are registered for with an error
+// status, instead of admitting them unchanged, to surface misconfigured deployments. The validation path is only
+// checked once a validator was registered, so deployments without a validating webhook are not affected.
+func WithRequireHandlers(require bool) Option {
+	return func(ac *admissionController) {
+		ac.requireHandlers = require
+	}
+}
+
+// WithConflictPolicy sets how patch operations of different handlers with the same op and path are treated. It
+// defaults to ConflictIgnore.
+func WithConflictPolicy(policy ConflictPolicy) Option {
+	return func(ac *admissionController) {
+		ac.conflictPolicy = policy
+	}
+}
+
+// WithKubeClient makes the Kubernetes client available to handlers through KubeClient, so they can look up objects
+// related to the one under review.
+func WithKubeClient(client kubernetes.Interface) Option {
+	return func(ac *admissionController) {
+		ac.kubeClient = client
+	}
+}
+
+// WithInformerFactory makes listers of namespaces and config maps backed by informers of the factory available to
+// handlers through NamespaceLister and ConfigMapLister, which are faster than requests to the apiserver. The factory
+// has to be started after creating the controller. The controller is not reported as ready before the caches synced.
+func WithInformerFactory(factory informers.SharedInformerFactory) Option {
+	return func(ac *admissionController) {
+		ac.listers = newListers(factory)
+	}
+}
+
+// WithResponseInterceptor adds a function that is passed each AdmissionReview right before it is marshaled as
+// response, e.g. to add warnings or adjust the TypeMeta when proxying. Interceptors run in the order they were added.
+func WithResponseInterceptor(intercept func(*admissionV1.AdmissionReview)) Option {
+	return func(ac *admissionController) {
+		ac.interceptors = append(ac.interceptors, intercept)
+	}
+}
+
+// WithAuthToken makes the controller reject admission requests that do not carry the token in an
+// "Authorization: Bearer" header. The probes and metrics are not protected.
+func WithAuthToken(token string) Option {
+	return func(ac *admissionController) {
+		ac.authToken = token
+	}
+}
+
+// WithRateLimit limits the admission requests to rps per second with bursts of up to burst requests. Requests
+// exceeding the limit are answered with 429 Too Many Requests, which the apiserver treats according to the failure
+// policy of the webhook. Their bodies are not read.
+func WithRateLimit(rps float64, burst int) Option {
+	return func(ac *admissionController) {
+		ac.rateLimiter = newRateLimiter(rps, burst, false)
+	}
+}
+
+// WithNamespaceRateLimit is like WithRateLimit, but limits the requests for each namespace separately, so a single
+// busy namespace does not exhaust the limit of the others. The bodies of requests have to be decoded to tell their
+// namespace. The limits of namespaces without recent requests are dropped, and beyond 10000 namespaces with recent
+// requests, the further ones share a single limit.
+func WithNamespaceRateLimit(rps float64, burst int) Option {
+	return func(ac *admissionController) {
+		ac.rateLimiter = newRateLimiter(rps, burst, true)
+	}
+}
+
+// WithTracer makes the controller record spans for admission requests and the handlers run for them with the tracer,
+// see package tracing for OpenTelemetry. The spans are passed to the handlers through their context. Without this
+// option, no spans are recorded.
+func WithTracer(tracer Tracer) Option {
+	return func(ac *admissionController) {
+		ac.tracer = tracer
+	}
+}
+
+// WithSortedPatches makes the controller order the patch operations by path and op, so the patch does not depend on
+// the order the handlers were registered in, e.g. for comparison with golden files. Operations on list items by index
+// or appending to a list, and those on the list itself, cannot be reordered safely: they keep the order they were
+// returned in relative to each other, so their order still depends on the order of the handlers. Sorting also
+// changes the result if handlers return operations on the same path that depend on their order, e.g. an add
+// followed by a remove.
+func WithSortedPatches(sorted bool) Option {
+	return func(ac *admissionController) {
+		ac.sortPatches = sorted
+	}
+}
+
+// WithMaxPatchOps limits the number of patch operations the handlers may produce for a request. Requests exceeding
+// the limit are failed with an error status, which the apiserver treats according to the failure policy of the
+// webhook. The operations of raw JSON patches count as well. By default, the number is unlimited.
+func WithMaxPatchOps(n int) Option {
+	return func(ac *admissionController) {
+		ac.maxPatchOps = n
+	}
+}
+
+// WithDispatchMode sets which of the matching handlers are run for a request. It defaults to AllHandlers.
+func WithDispatchMode(mode DispatchMode) Option {
+	return func(ac *admissionController) {
+		ac.dispatchMode = mode
+	}
+}
+
+// WithPprof enables serving the runtime profiling data of net/http/pprof under /debug/pprof/. The endpoints are not
+// authenticated, so they should only be enabled temporarily; serving PprofHandler by a separate listener bound to
+// localhost is safer.
+func WithPprof(enabled bool) Option {
+	return func(ac *admissionController) {
+		ac.pprof = enabled
+	}
+}
+
+// WithDebugHandlers enables serving the names of the registered handlers by the path they are served at under
+// /debug/handlers. Like the profiling data, the list is not authenticated, so it is not served by default.
+func WithDebugHandlers(enabled bool) Option {
+	return func(ac *admissionController) {
+		ac.debugHandlers = enabled
+	}
+}
+
+// WithMutatedAuditAnnotation makes the controller add an audit annotation with the given key to the responses of
+// mutations, which is "true" if the handlers produced patches and "false" otherwise, so that changed objects can be
+// told apart from unchanged ones in the audit log. The apiserver prefixes the key with the name of the webhook, so it
+// must not contain a "/".
+func WithMutatedAuditAnnotation(key string) Option {
+	return func(ac *admissionController) {
+		ac.mutatedAnnotation = key
+	}
+}
+
+// WithPatchMarshaler sets the function encoding the patch operations of responses, which defaults to json.Marshal.
+// The default output is already stable, as json.Marshal orders map keys, but values with custom MarshalJSON methods
+// may not be; a marshaler normalizing them keeps golden tests of responses byte-identical.
+func WithPatchMarshaler(marshal func(v interface{}) ([]byte, error)) Option {
+	return func(ac *admissionController) {
+		ac.marshalPatch = marshal
+	}
+}
+
+// WithSlowRequestThreshold makes the controller log a warning with the durations of the handlers for requests whose
+// processing takes longer than d, to find slow handlers without scraping metrics. By default, no requests are logged
+// as slow.
+func WithSlowRequestThreshold(d time.Duration) Option {
+	return func(ac *admissionController) {
+		ac.slowThreshold = d
+	}
+}
+
+// WithStrictDecoding enables rejecting admission reviews with fields unknown to the AdmissionReview type, e.g.
+// misspelled ones, to catch bugs of clients. Only the envelope is checked, not the objects of the request. By default,
+// unknown fields are ignored.
+func WithStrictDecoding(strict bool) Option {
+	return func(ac *admissionController) {
+		ac.strictDecoding = strict
+	}
+}
+
+// WithEnforcementMode sets whether denials of handlers and validators take effect. In Warn mode, requests are allowed
+// with the reasons of the denials as warnings. Handlers may override the mode with the Enforcement option. It defaults
+// to Enforce.
+func WithEnforcementMode(mode EnforcementMode) Option {
+	return func(ac *admissionController) {
+		ac.enforcement = mode
+	}
+}
+
+// WithContextualDenyMessages enables prefixing the messages of denials with the kind, namespace and name of the
+// object, e.g. "Pod default/web: ...", so denials are easier to attribute in cluster-wide logs and events. It is
+// disabled by default, as the names of objects end up in the responses.
+func WithContextualDenyMessages(enabled bool) Option {
+	return func(ac *admissionController) {
+		ac.contextualDeny = enabled
+	}
+}
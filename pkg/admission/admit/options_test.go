@@ -0,0 +1,110 @@
+package admit_test
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+)
+
+// countingRecorder is a MetricsRecorder counting the observed handler results.
+type countingRecorder struct {
+	mu      sync.Mutex
+	results map[string]int
+}
+
+func (r *countingRecorder) ObserveHandler(handler, result string, _ time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.results == nil {
+		r.results = map[string]int{}
+	}
+	r.results[handler+"/"+result]++
+}
+
+// bufferLogger returns a Logger writing messages of the level and above to the returned buffer.
+func bufferLogger(level admit.Level) (admit.Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	return admit.NewStdLogger(log.New(&buf, "", 0), level), &buf
+}
+
+func TestOptions(t *testing.T) {
+	body := mustMarshal(t, newReview(podRequest(t, testPod())))
+	tests := []struct {
+		name string
+		// setup returns the option and the check that it was applied.
+		setup func() (admit.Option, func(t *testing.T, ac admit.AdmissionController))
+	}{
+		{
+			name: "WithBasePath",
+			setup: func() (admit.Option, func(t *testing.T, ac admit.AdmissionController)) {
+				return admit.WithBasePath("/hook"), func(t *testing.T, ac admit.AdmissionController) {
+					if rec := post(t, ac, "/hook", body); rec.Code != http.StatusOK {
+						t.Errorf("got status %d at /hook", rec.Code)
+					}
+					if rec := post(t, ac, "/mutate", body); rec.Code != http.StatusNotFound {
+						t.Errorf("got status %d at /mutate, want 404", rec.Code)
+					}
+				}
+			},
+		},
+		{
+			name: "WithValidatePath",
+			setup: func() (admit.Option, func(t *testing.T, ac admit.AdmissionController)) {
+				return admit.WithValidatePath("/check"), func(t *testing.T, ac admit.AdmissionController) {
+					if rec := post(t, ac, "/check", body); rec.Code != http.StatusOK {
+						t.Errorf("got status %d at /check", rec.Code)
+					}
+				}
+			},
+		},
+		{
+			name: "WithLogger",
+			setup: func() (admit.Option, func(t *testing.T, ac admit.AdmissionController)) {
+				logger, buf := bufferLogger(admit.LevelInfo)
+				return admit.WithLogger(logger), func(t *testing.T, ac admit.AdmissionController) {
+					post(t, ac, "/mutate", body)
+					if !strings.Contains(buf.String(), "reviewed admission request") {
+						t.Errorf("got log %q, want the review logged", buf)
+					}
+				}
+			},
+		},
+		{
+			name: "WithMaxBodyBytes",
+			setup: func() (admit.Option, func(t *testing.T, ac admit.AdmissionController)) {
+				return admit.WithMaxBodyBytes(10), func(t *testing.T, ac admit.AdmissionController) {
+					if rec := post(t, ac, "/mutate", body); rec.Code != http.StatusRequestEntityTooLarge {
+						t.Errorf("got status %d, want 413", rec.Code)
+					}
+				}
+			},
+		},
+		{
+			name: "WithMetrics",
+			setup: func() (admit.Option, func(t *testing.T, ac admit.AdmissionController)) {
+				recorder := &countingRecorder{}
+				return admit.WithMetrics(recorder), func(t *testing.T, ac admit.AdmissionController) {
+					post(t, ac, "/mutate", body)
+					if got := recorder.results["label/allowed"]; got != 1 {
+						t.Errorf("got %d observed allows, want 1", got)
+					}
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt, check := tt.setup()
+			// Options are applied in order, so the discarding logger is overridden by WithLogger.
+			ac := admit.New(opt)
+			ac.Register("label", patching("a"))
+			check(t, ac)
+		})
+	}
+}
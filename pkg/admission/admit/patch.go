@@ -0,0 +1,236 @@
+package admit
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	admissionV1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// EscapePointer escapes a single reference token of a JSON pointer, see https://tools.ietf.org/html/rfc6901 .
+func EscapePointer(segment string) string {
+	return pointerEscaper.Replace(segment)
+}
+
+// Pointer builds a JSON pointer from the given unescaped segments, e.g. Pointer("metadata", "annotations",
+// "example.com/foo") yields "/metadata/annotations/example.com~1foo".
+func Pointer(segments ...string) string {
+	var sb strings.Builder
+	for _, segment := range segments {
+		sb.WriteString("/")
+		sb.WriteString(EscapePointer(segment))
+	}
+	return sb.String()
+}
+
+var pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+// RemoveIfPresent returns the remove operation for the JSON pointer path if the target exists in the given object,
+// e.g. a decoded Pod, and nil otherwise, as removing a missing target makes the whole patch fail. Objects that cannot
+// be marshaled to JSON have no targets.
+func RemoveIfPresent(obj interface{}, path string) []PatchOperation {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil || !hasTarget(doc, path) {
+		return nil
+	}
+	return new(PatchBuilder).Remove(path).Build()
+}
+
+// hasTarget checks if the JSON pointer path references a value in the unmarshaled JSON document. The root of the
+// document is never considered a target, as it cannot be removed.
+func hasTarget(doc interface{}, path string) bool {
+	if !strings.HasPrefix(path, "/") {
+		return false
+	}
+	for _, token := range strings.Split(path[1:], "/") {
+		token = pointerUnescaper.Replace(token)
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return false
+			}
+			doc = value
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(node) {
+				return false
+			}
+			doc = node[index]
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// PatchBuilder collects patch operations. Paths are JSON pointers, use Pointer to build them from keys that may
+// contain "/" or "~". The zero value is ready to use.
+type PatchBuilder struct {
+	ops []PatchOperation
+}
+
+// Add appends an add operation.
+func (b *PatchBuilder) Add(path string, value interface{}) *PatchBuilder {
+	b.ops = append(b.ops, PatchOperation{Op: "add", Path: path, Value: value})
+	return b
+}
+
+// Replace appends a replace operation.
+func (b *PatchBuilder) Replace(path string, value interface{}) *PatchBuilder {
+	b.ops = append(b.ops, PatchOperation{Op: "replace", Path: path, Value: value})
+	return b
+}
+
+// Remove appends a remove operation.
+func (b *PatchBuilder) Remove(path string) *PatchBuilder {
+	b.ops = append(b.ops, PatchOperation{Op: "remove", Path: path})
+	return b
+}
+
+// Build returns the collected patch operations.
+func (b *PatchBuilder) Build() []PatchOperation {
+	return append([]PatchOperation(nil), b.ops...)
+}
+
+// sortPatches orders the patch operations by their path and op. Parents sort before their children, so e.g. a map is
+// still added before its keys. Operations referencing list items by index or appending to a list with "/-" depend on
+// their order, as do operations on the list itself, like initializing it before appending: these are sorted as one
+// group at the path of the list, keeping their relative order within it. Other operations on the same path are
+// ordered by op, test operations first.
+func sortPatches(ops []PatchOperation) {
+	type entry struct {
+		op PatchOperation
+		// key is the path the operation is sorted by.
+		key string
+	}
+	entries := make([]entry, len(ops))
+	lists := sets.New[string]()
+	for i, op := range ops {
+		entries[i] = entry{op: op, key: op.Path}
+		if list, ok := listPath(op.Path); ok {
+			entries[i].key = list
+			lists.Insert(list)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.key != b.key {
+			return a.key < b.key
+		}
+		return !lists.Has(a.key) && opRank(a.op.Op) < opRank(b.op.Op)
+	})
+	for i, e := range entries {
+		ops[i] = e.op
+	}
+}
+
+// listPath returns the path of the first list the JSON pointer path references an item of by index or by "-", e.g.
+// /spec/containers for /spec/containers/0/env/-.
+func listPath(path string) (string, bool) {
+	tokens := strings.Split(path, "/")
+	for i, token := range tokens {
+		if i > 0 && (token == "-" || isIndex(token)) {
+			return strings.Join(tokens[:i], "/"), true
+		}
+	}
+	return "", false
+}
+
+// opRanks orders the operations on the same path when sorting.
+var opRanks = map[string]int{"test": 0, "remove": 1, "add": 2, "replace": 3, "move": 4, "copy": 5}
+
+// opRank returns the rank of the op when sorting, unknown ones are ranked last.
+func opRank(op string) int {
+	if rank, ok := opRanks[op]; ok {
+		return rank
+	}
+	return len(opRanks)
+}
+
+// ApplyPatches applies the patch operations to the raw JSON object and returns the patched object, as the apiserver
+// would. It is meant for tooling and tests that need the mutated object instead of the patch.
+func ApplyPatches(raw []byte, ops []PatchOperation) ([]byte, error) {
+	patchBytes, err := json.Marshal(ops)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal JSON patch: %v", err)
+	}
+	return applyPatch(raw, patchBytes)
+}
+
+// validatePatch checks that the JSON patch applies cleanly to the raw object.
+func validatePatch(raw, patchBytes []byte) error {
+	_, err := applyPatch(raw, patchBytes)
+	return err
+}
+
+// applyPatch applies the JSON patch to the raw object.
+func applyPatch(raw, patchBytes []byte) ([]byte, error) {
+	patch, err := jsonpatch.DecodePatch(patchBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON patch: %v", err)
+	}
+	patched, err := patch.Apply(raw)
+	if err != nil {
+		return nil, fmt.Errorf("JSON patch does not apply to the object: %v", err)
+	}
+	return patched, nil
+}
+
+// addRawPatch adds the raw patch returned by the named handler to acc. Raw patches cannot be merged, so a handler
+// returning one must be the only one patching the object. owners holds the name of the handler of each accumulated
+// patch operation.
+func addRawPatch(acc *Result, owners []string, name string, res *Result) error {
+	switch {
+	case len(res.Patch) == 0 && len(acc.Patch) == 0:
+		return nil
+	case len(res.Patch) > 0 && len(res.Patches) > 0:
+		return fmt.Errorf("handler %s returned both patch operations and a raw patch", name)
+	case len(res.Patch) > 0 && len(acc.Patches) > 0:
+		return fmt.Errorf("raw patch of handler %s cannot be combined with the patch operations of handler %s", name, owners[0])
+	case len(res.Patch) > 0 && len(acc.Patch) > 0:
+		return fmt.Errorf("raw patch of handler %s cannot be combined with the raw patch of another handler", name)
+	case len(res.Patches) > 0:
+		return fmt.Errorf("patch operations of handler %s cannot be combined with the raw patch of another handler", name)
+	}
+	if len(res.Patch) > 0 {
+		acc.Patch, acc.PatchType = res.Patch, res.PatchType
+	}
+	return nil
+}
+
+// patchTypeOf returns the type of the raw patch of the result.
+func patchTypeOf(res *Result) admissionV1.PatchType {
+	if res.PatchType == "" {
+		return admissionV1.PatchTypeJSONPatch
+	}
+	return res.PatchType
+}
+
+// checkRawPatch fails if the raw patch is not of the given type: JSON patches must be lists of operations, other
+// patches like strategic merge patches are JSON objects. It returns the number of operations of JSON patches.
+func checkRawPatch(patchType admissionV1.PatchType, patch []byte) (int, error) {
+	if patchType == admissionV1.PatchTypeJSONPatch {
+		ops, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return 0, fmt.Errorf("invalid JSON patch: %v", err)
+		}
+		return len(ops), nil
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(patch, &obj); err != nil {
+		return 0, fmt.Errorf("invalid %s patch, expected a JSON object: %v", patchType, err)
+	}
+	return 0, nil
+}
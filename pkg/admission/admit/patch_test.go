@@ -0,0 +1,475 @@
+package admit_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	admissionV1 "k8s.io/api/admission/v1"
+	coreV1 "k8s.io/api/core/v1"
+)
+
+// returning returns an AdmitFunc returning the patch operations.
+func returning(ops ...admit.PatchOperation) admit.AdmitFunc {
+	return func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+		return ops, nil
+	}
+}
+
+// errorOf decodes the error of a JSON error body.
+func errorOf(t testing.TB, body []byte) string {
+	t.Helper()
+	var e struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &e); err != nil {
+		t.Fatalf("decoding error body %s: %v", body, err)
+	}
+	return e.Error
+}
+
+func TestEscapePointer(t *testing.T) {
+	tests := []struct {
+		segment string
+		want    string
+	}{
+		{segment: "app", want: "app"},
+		{segment: "~", want: "~0"},
+		{segment: "/", want: "~1"},
+		{segment: "~/", want: "~0~1"},
+		{segment: "~1", want: "~01"},
+		{segment: "example.com/foo", want: "example.com~1foo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.segment, func(t *testing.T) {
+			if got := admit.EscapePointer(tt.segment); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPointerRoundTrip(t *testing.T) {
+	// unescape decodes a reference token, replacing ~1 before ~0 as required by RFC 6901.
+	unescape := func(token string) string {
+		return strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	for _, key := range []string{"example.com/foo", "example.com/~team", "a~1b", "~0~1", "plain"} {
+		t.Run(key, func(t *testing.T) {
+			segments := []string{"metadata", "annotations", key}
+			pointer := admit.Pointer(segments...)
+			tokens := strings.Split(pointer, "/")
+			if len(tokens) != len(segments)+1 || tokens[0] != "" {
+				t.Fatalf("got pointer %q, want %d reference tokens", pointer, len(segments))
+			}
+			for i, token := range tokens[1:] {
+				if got := unescape(token); got != segments[i] {
+					t.Errorf("got segment %q of %q, want %q", got, pointer, segments[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPatchValidation(t *testing.T) {
+	valid := admit.PatchOperation{Op: "add", Path: "/metadata/labels", Value: map[string]string{"a": "b"}}
+	missingParent := admit.PatchOperation{Op: "add", Path: "/metadata/labels/a", Value: "b"}
+	tests := []struct {
+		name     string
+		validate bool
+		op       admit.PatchOperation
+		wantCode int
+		wantErr  string
+	}{
+		{name: "valid patch", validate: true, op: valid, wantCode: http.StatusOK},
+		{name: "missing parent", validate: true, op: missingParent, wantCode: http.StatusInternalServerError, wantErr: "JSON patch does not apply to the object"},
+		{name: "bad path", validate: true, op: admit.PatchOperation{Op: "replace", Path: "/spec/missing", Value: 1}, wantCode: http.StatusInternalServerError, wantErr: "JSON patch does not apply to the object"},
+		{name: "unvalidated", op: missingParent, wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(admit.WithPatchValidation(tt.validate))
+			ac.Register("patch", returning(tt.op))
+
+			rec := post(t, ac, "/mutate", newReview(podRequest(t, testPod())))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantErr != "" && !strings.Contains(errorOf(t, rec.Body.Bytes()), tt.wantErr) {
+				t.Errorf("got error %s, want it to contain %q", rec.Body, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRemoveIfPresent(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		annotations map[string]string
+		wantRemove  bool
+		// wantAnnotations are the annotations of the patched pod.
+		wantAnnotations map[string]string
+	}{
+		{
+			name:            "present annotation",
+			path:            "/metadata/annotations/example.com~1deprecated",
+			annotations:     map[string]string{"example.com/deprecated": "true", "keep": "x"},
+			wantRemove:      true,
+			wantAnnotations: map[string]string{"keep": "x"},
+		},
+		{
+			name:            "absent annotation",
+			path:            "/metadata/annotations/example.com~1deprecated",
+			annotations:     map[string]string{"keep": "x"},
+			wantAnnotations: map[string]string{"keep": "x"},
+		},
+		{name: "absent annotations", path: "/metadata/annotations/example.com~1deprecated"},
+		{name: "present list item", path: "/spec/containers/0", wantRemove: true},
+		{name: "absent list item", path: "/spec/containers/1"},
+		{name: "list end", path: "/spec/containers/-"},
+		{name: "root", path: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			ac.RegisterPod("strip", func(pod *coreV1.Pod, _ *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				return admit.RemoveIfPresent(pod, tt.path), nil
+			})
+
+			pod := testPod()
+			pod.Annotations = tt.annotations
+			res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, pod))))
+			if !res.Allowed {
+				t.Fatalf("got denied: %s", messageOf(res))
+			}
+			ops := patchesOf(t, res)
+			var want []admit.PatchOperation
+			if tt.wantRemove {
+				want = []admit.PatchOperation{{Op: "remove", Path: tt.path}}
+			}
+			if !reflect.DeepEqual(ops, want) {
+				t.Fatalf("got %v, want %v", ops, want)
+			}
+			if patched := applyToPod(t, pod, ops); tt.wantAnnotations != nil && !reflect.DeepEqual(patched.Annotations, tt.wantAnnotations) {
+				t.Errorf("got annotations %v, want %v", patched.Annotations, tt.wantAnnotations)
+			}
+		})
+	}
+}
+
+func TestSortedPatches(t *testing.T) {
+	// handlers are registered in every order, each returning the ops in the order given.
+	tests := []struct {
+		name     string
+		handlers [][]admit.PatchOperation
+		want     []string
+	}{
+		{
+			name: "paths and ops",
+			handlers: [][]admit.PatchOperation{
+				{{Op: "add", Path: "/metadata/labels", Value: map[string]string{}}, {Op: "add", Path: "/metadata/labels/b", Value: "1"}},
+				{{Op: "replace", Path: "/metadata/name", Value: "web"}, {Op: "add", Path: "/metadata/annotations", Value: map[string]string{"a": "1"}}},
+				{{Op: "test", Path: "/metadata/name", Value: "web"}, {Op: "add", Path: "/metadata/finalizers", Value: []string{"x"}}},
+			},
+			want: []string{
+				"add /metadata/annotations", "add /metadata/finalizers", "add /metadata/labels", "add /metadata/labels/b",
+				"test /metadata/name", "replace /metadata/name",
+			},
+		},
+		{
+			name: "list initialized before appending",
+			handlers: [][]admit.PatchOperation{
+				{
+					{Op: "add", Path: "/spec/volumes", Value: []interface{}{}},
+					{Op: "add", Path: "/spec/volumes/-", Value: map[string]string{"name": "b"}},
+					{Op: "add", Path: "/spec/volumes/-", Value: map[string]string{"name": "a"}},
+				},
+				{{Op: "add", Path: "/metadata/labels", Value: map[string]string{"a": "1"}}},
+				{{Op: "add", Path: "/spec/restartPolicy", Value: "Never"}},
+			},
+			want: []string{
+				"add /metadata/labels", "add /spec/restartPolicy", "add /spec/volumes", "add /spec/volumes/-",
+				"add /spec/volumes/-",
+			},
+		},
+		{
+			name: "index operations keep their order",
+			handlers: [][]admit.PatchOperation{
+				{
+					{Op: "add", Path: "/spec/containers/1", Value: map[string]string{"name": "proxy", "image": "envoy"}},
+					{Op: "remove", Path: "/spec/containers/0"},
+					{Op: "add", Path: "/spec/containers/0/env", Value: []interface{}{}},
+					{Op: "add", Path: "/spec/containers/0/env/-", Value: map[string]string{"name": "A"}},
+				},
+				{{Op: "add", Path: "/metadata/labels", Value: map[string]string{"a": "1"}}},
+			},
+			want: []string{
+				"add /metadata/labels", "add /spec/containers/1", "remove /spec/containers/0", "add /spec/containers/0/env",
+				"add /spec/containers/0/env/-",
+			},
+		},
+	}
+	for _, tt := range tests {
+		for _, order := range permutations(len(tt.handlers)) {
+			t.Run(tt.name+"/"+strings.Trim(strings.Join(strings.Fields(fmt.Sprint(order)), ","), "[]"), func(t *testing.T) {
+				ac := admit.New(admit.WithSortedPatches(true), admit.WithPatchValidation(true))
+				for _, i := range order {
+					ac.Register("handler-"+strconv.Itoa(i), returning(tt.handlers[i]...))
+				}
+
+				res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+				if !res.Allowed {
+					t.Fatalf("got denied: %s", messageOf(res))
+				}
+				var got []string
+				for _, op := range patchesOf(t, res) {
+					got = append(got, op.Op+" "+op.Path)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("got operations %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+// permutations returns all orders of the numbers 0 to n-1.
+func permutations(n int) [][]int {
+	if n == 0 {
+		return [][]int{{}}
+	}
+	var perms [][]int
+	for _, perm := range permutations(n - 1) {
+		for i := 0; i <= len(perm); i++ {
+			p := append(append(append([]int{}, perm[:i]...), n-1), perm[i:]...)
+			perms = append(perms, p)
+		}
+	}
+	return perms
+}
+
+func TestApplyPatches(t *testing.T) {
+	raw := []byte(`{"metadata":{"name":"web","labels":{"app":"web","tier":"front"}},"spec":{"containers":[{"name":"app","image":"nginx"}]}}`)
+	tests := []struct {
+		name    string
+		ops     []admit.PatchOperation
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "add",
+			ops:  new(admit.PatchBuilder).Add("/metadata/labels/env", "prod").Build(),
+			want: `{"metadata":{"name":"web","labels":{"app":"web","env":"prod","tier":"front"}},"spec":{"containers":[{"name":"app","image":"nginx"}]}}`,
+		},
+		{
+			name: "replace",
+			ops:  new(admit.PatchBuilder).Replace("/spec/containers/0/image", "mirror/nginx").Build(),
+			want: `{"metadata":{"name":"web","labels":{"app":"web","tier":"front"}},"spec":{"containers":[{"name":"app","image":"mirror/nginx"}]}}`,
+		},
+		{
+			name: "remove",
+			ops:  new(admit.PatchBuilder).Remove("/metadata/labels/tier").Build(),
+			want: `{"metadata":{"name":"web","labels":{"app":"web"}},"spec":{"containers":[{"name":"app","image":"nginx"}]}}`,
+		},
+		{name: "missing target", ops: new(admit.PatchBuilder).Remove("/metadata/annotations").Build(), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := admit.ApplyPatches(raw, tt.ops)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var gotObj, wantObj interface{}
+			if err := json.Unmarshal(got, &gotObj); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &wantObj); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotObj, wantObj) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxPatchOps(t *testing.T) {
+	// labels returns a handler adding n labels.
+	labels := func(n int) admit.AdmitFunc {
+		b := new(admit.PatchBuilder)
+		for i := 0; i < n; i++ {
+			b.Add(admit.Pointer("metadata", "labels", "l"+strconv.Itoa(i)), "true")
+		}
+		return returning(b.Build()...)
+	}
+	tests := []struct {
+		name      string
+		opts      []admit.Option
+		ops       int
+		wantError string
+	}{
+		{name: "within limit", opts: []admit.Option{admit.WithMaxPatchOps(3)}, ops: 3},
+		{name: "exceeding limit", opts: []admit.Option{admit.WithMaxPatchOps(3)}, ops: 5, wantError: "handlers produced 5 patch operations, exceeding the limit of 3"},
+		{name: "unlimited by default", ops: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(tt.opts...)
+			ac.Register("labels", labels(tt.ops))
+
+			pod := testPod()
+			pod.Labels = map[string]string{}
+			rec := post(t, ac, "/mutate", newReview(podRequest(t, pod)))
+			if tt.wantError != "" {
+				if rec.Code != http.StatusInternalServerError || errorOf(t, rec.Body.Bytes()) != tt.wantError {
+					t.Errorf("got status %d with %s, want %q", rec.Code, rec.Body, tt.wantError)
+				}
+				return
+			}
+			if got := len(patchesOf(t, responseOf(t, rec))); got != tt.ops {
+				t.Errorf("got %d patch operations, want %d", got, tt.ops)
+			}
+		})
+	}
+}
+
+func TestPatchMarshaler(t *testing.T) {
+	labels := map[string]interface{}{"zone": "b", "app": "web", "tier": "frontend", "env": "prod", "team": "x"}
+	ops := []admit.PatchOperation{{Op: "add", Path: "/metadata/labels", Value: labels}}
+	tests := []struct {
+		name string
+		opts []admit.Option
+		want string
+	}{
+		{
+			name: "default",
+			want: `[{"op":"add","path":"/metadata/labels","value":{"app":"web","env":"prod","team":"x","tier":"frontend","zone":"b"}}]`,
+		},
+		{
+			name: "custom",
+			opts: []admit.Option{admit.WithPatchMarshaler(func(v interface{}) ([]byte, error) {
+				return json.MarshalIndent(v, "", " ")
+			})},
+			want: "[\n {\n  \"op\": \"add\",\n  \"path\": \"/metadata/labels\",\n  \"value\": {\n   \"app\": \"web\",\n" +
+				"   \"env\": \"prod\",\n   \"team\": \"x\",\n   \"tier\": \"frontend\",\n   \"zone\": \"b\"\n  }\n }\n]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(tt.opts...)
+			ac.Register("labels", returning(ops...))
+
+			// Map iteration is randomized, so repeated runs would tell unstable encodings apart.
+			for i := 0; i < 20; i++ {
+				res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, testPod()))))
+				if string(res.Patch) != tt.want {
+					t.Fatalf("got patch %s in run %d, want %s", res.Patch, i, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRawPatchType(t *testing.T) {
+	strategic := admissionV1.PatchType("StrategicMergePatch")
+	tests := []struct {
+		name   string
+		opts   []admit.Option
+		result *admit.Result
+		// wantType is the patch type of the response, wantCode and wantError are the status and error if the patch is
+		// refused.
+		wantType  admissionV1.PatchType
+		wantPatch string
+		wantCode  int
+		wantError string
+	}{
+		{
+			name:      "strategic merge patch",
+			result:    &admit.Result{Patch: []byte(`{"spec":{"containers":[{"name":"app","image":"nginx:2"}]}}`), PatchType: strategic},
+			wantType:  strategic,
+			wantPatch: `{"spec":{"containers":[{"name":"app","image":"nginx:2"}]}}`,
+		},
+		{
+			name:      "raw JSON patch by default",
+			result:    &admit.Result{Patch: []byte(`[{"op":"add","path":"/metadata/labels/a","value":"true"}]`)},
+			wantType:  admissionV1.PatchTypeJSONPatch,
+			wantPatch: `[{"op":"add","path":"/metadata/labels/a","value":"true"}]`,
+		},
+		{
+			name:      "patch operations",
+			result:    &admit.Result{Patches: new(admit.PatchBuilder).Add("/metadata/labels/a", "true").Build()},
+			wantType:  admissionV1.PatchTypeJSONPatch,
+			wantPatch: `[{"op":"add","path":"/metadata/labels/a","value":"true"}]`,
+		},
+		{
+			name:      "strategic merge patch of a list",
+			result:    &admit.Result{Patch: []byte(`[{"op":"add","path":"/metadata/labels/a","value":"true"}]`), PatchType: strategic},
+			wantCode:  http.StatusInternalServerError,
+			wantError: "invalid StrategicMergePatch patch, expected a JSON object",
+		},
+		{
+			name:      "JSON patch of an object",
+			result:    &admit.Result{Patch: []byte(`{"metadata":{}}`), PatchType: admissionV1.PatchTypeJSONPatch},
+			wantCode:  http.StatusInternalServerError,
+			wantError: "invalid JSON patch",
+		},
+		{
+			name: "raw JSON patch exceeding the limit",
+			opts: []admit.Option{admit.WithMaxPatchOps(1)},
+			result: &admit.Result{Patch: []byte(`[{"op":"add","path":"/metadata/labels","value":{}},` +
+				`{"op":"add","path":"/metadata/labels/a","value":"true"}]`)},
+			wantCode:  http.StatusInternalServerError,
+			wantError: "handlers produced 2 patch operations, exceeding the limit of 1",
+		},
+		{
+			name:      "raw JSON patch not applying",
+			opts:      []admit.Option{admit.WithPatchValidation(true)},
+			result:    &admit.Result{Patch: []byte(`[{"op":"remove","path":"/metadata/annotations"}]`)},
+			wantCode:  http.StatusInternalServerError,
+			wantError: "JSON patch does not apply to the object",
+		},
+		{
+			name:      "strategic merge patch not counted",
+			opts:      []admit.Option{admit.WithMaxPatchOps(1), admit.WithPatchValidation(true)},
+			result:    &admit.Result{Patch: []byte(`{"metadata":{"labels":{"a":"true","b":"true"}}}`), PatchType: strategic},
+			wantType:  strategic,
+			wantPatch: `{"metadata":{"labels":{"a":"true","b":"true"}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(tt.opts...)
+			ac.RegisterHandler("raw", func(context.Context, *admissionV1.AdmissionRequest) (*admit.Result, error) {
+				return tt.result, nil
+			})
+
+			rec := post(t, ac, "/mutate", newReview(podRequest(t, testPod())))
+			if tt.wantCode != 0 {
+				if rec.Code != tt.wantCode {
+					t.Errorf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+				}
+				if msg := errorOf(t, rec.Body.Bytes()); !strings.Contains(msg, tt.wantError) {
+					t.Errorf("got error %q, want %q", msg, tt.wantError)
+				}
+				return
+			}
+			res := responseOf(t, rec)
+			if res.PatchType == nil || *res.PatchType != tt.wantType {
+				t.Errorf("got patch type %v, want %s", res.PatchType, tt.wantType)
+			}
+			if string(res.Patch) != tt.wantPatch {
+				t.Errorf("got patch %s, want %s", res.Patch, tt.wantPatch)
+			}
+		})
+	}
+}
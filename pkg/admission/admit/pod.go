@@ -0,0 +1,123 @@
+package admit
+
+import (
+	"fmt"
+	"strconv"
+
+	admissionV1 "k8s.io/api/admission/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// podKind is the kind of the requests pod handlers are run for.
+var podKind = metaV1.GroupVersionKind{Version: "v1", Kind: "Pod"}
+
+// PodAdmitFunc is an AdmitFunc for pods, which is passed the decoded pod along with the request. For DELETE
+// requests, the pod is decoded from the old object.
+type PodAdmitFunc func(*coreV1.Pod, *admissionV1.AdmissionRequest) ([]PatchOperation, error)
+
+// admitFunc adapts the PodAdmitFunc to an AdmitFunc decoding the pod of the request.
+func (adm PodAdmitFunc) admitFunc() AdmitFunc {
+	return func(req *admissionV1.AdmissionRequest) ([]PatchOperation, error) {
+		pod := &coreV1.Pod{}
+		if err := DecodeTarget(req, pod); err != nil {
+			return nil, fmt.Errorf("could not decode pod: %v", err)
+		}
+		return adm(pod, req)
+	}
+}
+
+// RegisterPod registers a new PodAdmitFunc at this controller that is only run for requests of pods.
+func (ac *admissionController) RegisterPod(name string, adm PodAdmitFunc, opts ...HandlerOption) {
+	ac.register(&handler{name: name, handle: adm.admitFunc().handlerFunc(), gvk: &podKind}, opts)
+}
+
+// InjectContainer returns the patch operations appending the container to the containers of the pod, which are
+// initialized first if the pod has none.
+func InjectContainer(pod *coreV1.Pod, c coreV1.Container) []PatchOperation {
+	return appendToList(len(pod.Spec.Containers), Pointer("spec", "containers"), c)
+}
+
+// InjectVolume returns the patch operations appending the volume to the volumes of the pod, which are initialized
+// first if the pod has none.
+func InjectVolume(pod *coreV1.Pod, v coreV1.Volume) []PatchOperation {
+	return appendToList(len(pod.Spec.Volumes), Pointer("spec", "volumes"), v)
+}
+
+// appendToList returns the patch operations appending the values to the list at path holding n items.
+func appendToList(n int, path string, values ...interface{}) []PatchOperation {
+	var b PatchBuilder
+	if n == 0 {
+		// Appending to a missing list fails, and empty lists are usually omitted from the object, so it is created
+		// first. Other handlers creating it as well do not discard the values unless conflicts are ignored, see
+		// ConflictPolicy.
+		b.Add(path, []interface{}{})
+	}
+	for _, value := range values {
+		b.Add(path+"/-", value)
+	}
+	return b.Build()
+}
+
+// InjectEnv returns the patch operations adding the environment variables to each container of the pod, except for
+// the variables a container already defines. Init containers are not modified.
+func InjectEnv(pod *coreV1.Pod, env []coreV1.EnvVar) []PatchOperation {
+	var ops []PatchOperation
+	for i, c := range pod.Spec.Containers {
+		defined := sets.New[string]()
+		for _, e := range c.Env {
+			defined.Insert(e.Name)
+		}
+
+		var missing []interface{}
+		for _, e := range env {
+			if !defined.Has(e.Name) {
+				defined.Insert(e.Name)
+				missing = append(missing, e)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		ops = append(ops, appendToList(len(c.Env), Pointer("spec", "containers", strconv.Itoa(i), "env"), missing...)...)
+	}
+	return ops
+}
+
+// RewriteImages returns the patch operations replacing the image of every container and init container of the pod
+// with the result of rewrite, e.g. to pull from a mirror registry. Containers whose image rewrite returns unchanged
+// are not patched.
+func RewriteImages(pod *coreV1.Pod, rewrite func(string) string) []PatchOperation {
+	return rewriteImages(pod, rewrite, false)
+}
+
+// RewriteAllImages returns the patch operations of RewriteImages, also rewriting the images of the ephemeral
+// containers of the pod. These can only be patched by handlers for the ephemeralcontainers subresource.
+func RewriteAllImages(pod *coreV1.Pod, rewrite func(string) string) []PatchOperation {
+	return rewriteImages(pod, rewrite, true)
+}
+
+// rewriteImages returns the patch operations replacing the images of the containers of the pod rewrite changes,
+// including those of the ephemeral containers if ephemeral is set.
+func rewriteImages(pod *coreV1.Pod, rewrite func(string) string, ephemeral bool) []PatchOperation {
+	var b PatchBuilder
+	replace := func(path, image string) {
+		if rewritten := rewrite(image); rewritten != image {
+			b.Replace(path, rewritten)
+		}
+	}
+	for i, c := range pod.Spec.InitContainers {
+		replace(Pointer("spec", "initContainers", strconv.Itoa(i), "image"), c.Image)
+	}
+	for i, c := range pod.Spec.Containers {
+		replace(Pointer("spec", "containers", strconv.Itoa(i), "image"), c.Image)
+	}
+	if ephemeral {
+		for i, c := range pod.Spec.EphemeralContainers {
+			replace(Pointer("spec", "ephemeralContainers", strconv.Itoa(i), "image"), c.Image)
+		}
+	}
+	return b.Build()
+}
@@ -0,0 +1,302 @@
+package admit_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	admissionV1 "k8s.io/api/admission/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestRegisterPod(t *testing.T) {
+	tests := []struct {
+		name string
+		// modify adapts the request of the test pod.
+		modify      func(req *admissionV1.AdmissionRequest)
+		wantRun     bool
+		wantAllowed bool
+		wantMessage string
+	}{
+		{name: "pod", wantRun: true, wantAllowed: true},
+		{
+			name: "deleted pod",
+			modify: func(req *admissionV1.AdmissionRequest) {
+				req.Operation = admissionV1.Delete
+				req.OldObject, req.Object = req.Object, runtime.RawExtension{}
+			},
+			wantRun:     true,
+			wantAllowed: true,
+		},
+		{
+			name: "other kind",
+			modify: func(req *admissionV1.AdmissionRequest) {
+				req.Kind = metaV1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+			},
+			wantAllowed: true,
+		},
+		{
+			name:        "malformed pod",
+			modify:      func(req *admissionV1.AdmissionRequest) { req.Object.Raw = []byte(`{"spec":{"containers":5}}`) },
+			wantMessage: "could not decode pod",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			var got *coreV1.Pod
+			ac.RegisterPod("sidecar", func(pod *coreV1.Pod, _ *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				got = pod
+				return admit.EnsureAnnotation(pod, "example.com/sidecar", "injected"), nil
+			})
+
+			pod := testPod()
+			req := podRequest(t, pod)
+			if tt.modify != nil {
+				tt.modify(req)
+			}
+			res := responseOf(t, post(t, ac, "/mutate", newReview(req)))
+			if res.Allowed != tt.wantAllowed {
+				t.Errorf("got allowed %t, want %t", res.Allowed, tt.wantAllowed)
+			}
+			if !strings.HasPrefix(messageOf(res), tt.wantMessage) {
+				t.Errorf("got message %q, want %q", messageOf(res), tt.wantMessage)
+			}
+			if (got != nil) != tt.wantRun {
+				t.Fatalf("got handler run %t, want %t", got != nil, tt.wantRun)
+			}
+			if !tt.wantRun {
+				return
+			}
+			if got.Name != pod.Name || got.Spec.Containers[0].Image != "nginx" {
+				t.Errorf("handler got pod %+v", got)
+			}
+			patched := applyToPod(t, pod, patchesOf(t, res))
+			if want := map[string]string{"example.com/sidecar": "injected"}; !reflect.DeepEqual(patched.Annotations, want) {
+				t.Errorf("got annotations %v, want %v", patched.Annotations, want)
+			}
+		})
+	}
+}
+
+func TestInjectContainerAndVolume(t *testing.T) {
+	sidecar := coreV1.Container{Name: "proxy", Image: "envoy"}
+	volume := coreV1.Volume{Name: "config", VolumeSource: coreV1.VolumeSource{EmptyDir: &coreV1.EmptyDirVolumeSource{}}}
+	tests := []struct {
+		name       string
+		containers []coreV1.Container
+		volumes    []coreV1.Volume
+		wantOps    []string
+	}{
+		{
+			name:       "absent volumes",
+			containers: []coreV1.Container{{Name: "app", Image: "nginx"}},
+			wantOps:    []string{"add /spec/containers/-", "add /spec/volumes", "add /spec/volumes/-"},
+		},
+		{
+			name:       "existing volumes",
+			containers: []coreV1.Container{{Name: "app", Image: "nginx"}},
+			volumes:    []coreV1.Volume{{Name: "data"}},
+			wantOps:    []string{"add /spec/containers/-", "add /spec/volumes/-"},
+		},
+		{
+			name:    "absent containers",
+			wantOps: []string{"add /spec/containers", "add /spec/containers/-", "add /spec/volumes", "add /spec/volumes/-"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(admit.WithPatchValidation(true))
+			ac.RegisterPod("sidecar", func(pod *coreV1.Pod, _ *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				return append(admit.InjectContainer(pod, sidecar), admit.InjectVolume(pod, volume)...), nil
+			})
+
+			pod := testPod()
+			pod.Spec.Containers, pod.Spec.Volumes = tt.containers, tt.volumes
+			res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, pod))))
+			if !res.Allowed {
+				t.Fatalf("got denied: %s", messageOf(res))
+			}
+			ops := patchesOf(t, res)
+			var got []string
+			for _, op := range ops {
+				got = append(got, op.Op+" "+op.Path)
+			}
+			if !reflect.DeepEqual(got, tt.wantOps) {
+				t.Errorf("got operations %v, want %v", got, tt.wantOps)
+			}
+
+			patched := applyToPod(t, pod, ops)
+			if want := append(tt.containers, sidecar); !reflect.DeepEqual(patched.Spec.Containers, want) {
+				t.Errorf("got containers %v, want %v", patched.Spec.Containers, want)
+			}
+			if want := append(tt.volumes, volume); !reflect.DeepEqual(patched.Spec.Volumes, want) {
+				t.Errorf("got volumes %v, want %v", patched.Spec.Volumes, want)
+			}
+		})
+	}
+}
+
+func TestInjectEnv(t *testing.T) {
+	env := []coreV1.EnvVar{{Name: "REGION", Value: "eu"}, {Name: "ZONE", Value: "a"}}
+	tests := []struct {
+		name       string
+		containers []coreV1.Container
+		wantEnv    [][]coreV1.EnvVar
+		wantOps    int
+	}{
+		{
+			name:       "without env",
+			containers: []coreV1.Container{{Name: "app"}},
+			wantEnv:    [][]coreV1.EnvVar{env},
+			wantOps:    3,
+		},
+		{
+			name:       "with env",
+			containers: []coreV1.Container{{Name: "app", Env: []coreV1.EnvVar{{Name: "DEBUG", Value: "1"}}}},
+			wantEnv:    [][]coreV1.EnvVar{{{Name: "DEBUG", Value: "1"}, env[0], env[1]}},
+			wantOps:    2,
+		},
+		{
+			name:       "name collision",
+			containers: []coreV1.Container{{Name: "app", Env: []coreV1.EnvVar{{Name: "ZONE", Value: "b"}}}},
+			wantEnv:    [][]coreV1.EnvVar{{{Name: "ZONE", Value: "b"}, env[0]}},
+			wantOps:    1,
+		},
+		{
+			name:       "all defined",
+			containers: []coreV1.Container{{Name: "app", Env: env}},
+			wantEnv:    [][]coreV1.EnvVar{env},
+		},
+		{
+			name: "several containers",
+			containers: []coreV1.Container{
+				{Name: "app", Env: []coreV1.EnvVar{{Name: "REGION", Value: "us"}}},
+				{Name: "sidecar"},
+			},
+			wantEnv: [][]coreV1.EnvVar{{{Name: "REGION", Value: "us"}, env[1]}, env},
+			wantOps: 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(admit.WithPatchValidation(true))
+			ac.RegisterPod("env", func(pod *coreV1.Pod, _ *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				return admit.InjectEnv(pod, env), nil
+			})
+
+			pod := testPod()
+			pod.Spec.Containers = tt.containers
+			res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, pod))))
+			if !res.Allowed {
+				t.Fatalf("got denied: %s", messageOf(res))
+			}
+			ops := patchesOf(t, res)
+			if len(ops) != tt.wantOps {
+				t.Errorf("got %d patch operations, want %d: %v", len(ops), tt.wantOps, ops)
+			}
+			patched := applyToPod(t, pod, ops)
+			for i, c := range patched.Spec.Containers {
+				if !reflect.DeepEqual(c.Env, tt.wantEnv[i]) {
+					t.Errorf("got env %v of container %s, want %v", c.Env, c.Name, tt.wantEnv[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRewriteImages(t *testing.T) {
+	// mirroring pulls images of docker.io from a mirror registry.
+	mirroring := func(image string) string {
+		if rest, ok := strings.CutPrefix(image, "docker.io/"); ok {
+			return "mirror.example.com/" + rest
+		}
+		return image
+	}
+	tests := []struct {
+		name      string
+		spec      coreV1.PodSpec
+		ephemeral bool
+		// wantImages are the images of the init, regular and ephemeral containers after patching.
+		wantImages []string
+		wantOps    int
+	}{
+		{
+			name: "mixed containers",
+			spec: coreV1.PodSpec{
+				InitContainers: []coreV1.Container{{Name: "init", Image: "docker.io/busybox"}},
+				Containers:     []coreV1.Container{{Name: "app", Image: "quay.io/app"}, {Name: "proxy", Image: "docker.io/envoy"}},
+			},
+			wantImages: []string{"mirror.example.com/busybox", "quay.io/app", "mirror.example.com/envoy"},
+			wantOps:    2,
+		},
+		{
+			name:       "unchanged",
+			spec:       coreV1.PodSpec{Containers: []coreV1.Container{{Name: "app", Image: "quay.io/app"}}},
+			wantImages: []string{"quay.io/app"},
+		},
+		{
+			name: "ephemeral excluded",
+			spec: coreV1.PodSpec{
+				Containers:          []coreV1.Container{{Name: "app", Image: "docker.io/app"}},
+				EphemeralContainers: []coreV1.EphemeralContainer{{EphemeralContainerCommon: coreV1.EphemeralContainerCommon{Name: "debug", Image: "docker.io/busybox"}}},
+			},
+			wantImages: []string{"mirror.example.com/app", "docker.io/busybox"},
+			wantOps:    1,
+		},
+		{
+			name: "ephemeral included",
+			spec: coreV1.PodSpec{
+				Containers:          []coreV1.Container{{Name: "app", Image: "docker.io/app"}},
+				EphemeralContainers: []coreV1.EphemeralContainer{{EphemeralContainerCommon: coreV1.EphemeralContainerCommon{Name: "debug", Image: "docker.io/busybox"}}},
+			},
+			ephemeral:  true,
+			wantImages: []string{"mirror.example.com/app", "mirror.example.com/busybox"},
+			wantOps:    2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(admit.WithPatchValidation(true))
+			ac.RegisterPod("mirror", func(pod *coreV1.Pod, _ *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				if tt.ephemeral {
+					return admit.RewriteAllImages(pod, mirroring), nil
+				}
+				return admit.RewriteImages(pod, mirroring), nil
+			})
+
+			pod := testPod()
+			pod.Spec = tt.spec
+			res := responseOf(t, post(t, ac, "/mutate", newReview(podRequest(t, pod))))
+			if !res.Allowed {
+				t.Fatalf("got denied: %s", messageOf(res))
+			}
+			ops := patchesOf(t, res)
+			if len(ops) != tt.wantOps {
+				t.Errorf("got %d patch operations, want %d: %v", len(ops), tt.wantOps, ops)
+			}
+			for _, op := range ops {
+				if op.Op != "replace" || !strings.HasSuffix(op.Path, "/image") {
+					t.Errorf("got %s %s, want image replacements only", op.Op, op.Path)
+				}
+			}
+			patched := applyToPod(t, pod, ops)
+			var images []string
+			for _, c := range patched.Spec.InitContainers {
+				images = append(images, c.Image)
+			}
+			for _, c := range patched.Spec.Containers {
+				images = append(images, c.Image)
+			}
+			for _, c := range patched.Spec.EphemeralContainers {
+				images = append(images, c.Image)
+			}
+			if !reflect.DeepEqual(images, tt.wantImages) {
+				t.Errorf("got images %q, want %q", images, tt.wantImages)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package admit
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maxLimiters bounds the number of namespaces with a token bucket of their own. Requests for further namespaces share
+// a single bucket until the buckets of idle namespaces are evicted.
+const maxLimiters = 10000
+
+// rateLimiter limits the rate of admission requests by token buckets, either a single one for all requests or one
+// per namespace.
+type rateLimiter struct {
+	limit        rate.Limit
+	burst        int
+	perNamespace bool
+	// idle is how long a bucket has to be unused to be full again, so that evicting it does not change which requests
+	// are allowed. It is negative if buckets never refill, which are never evicted.
+	idle time.Duration
+
+	mu        sync.Mutex
+	limiters  map[string]*namespaceLimiter
+	overflow  *rate.Limiter
+	lastSweep time.Time
+}
+
+// namespaceLimiter is the token bucket of a namespace along with the time it was last used.
+type namespaceLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newRateLimiter creates a rateLimiter allowing rps requests per second with bursts of burst requests.
+func newRateLimiter(rps float64, burst int, perNamespace bool) *rateLimiter {
+	idle := time.Duration(-1)
+	if rps > 0 {
+		idle = time.Duration(float64(burst) / rps * float64(time.Second))
+	}
+	return &rateLimiter{
+		limit:        rate.Limit(rps),
+		burst:        burst,
+		perNamespace: perNamespace,
+		idle:         idle,
+		limiters:     map[string]*namespaceLimiter{},
+		overflow:     rate.NewLimiter(rate.Limit(rps), burst),
+	}
+}
+
+// allow checks if a request for the namespace may be handled now, consuming a token if so.
+func (l *rateLimiter) allow(namespace string) bool {
+	key := ""
+	if l.perNamespace {
+		key = namespace
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	l.evictIdle(now)
+	limiter := l.overflow
+	if entry, ok := l.limiters[key]; ok {
+		entry.lastSeen = now
+		limiter = entry.limiter
+	} else if len(l.limiters) < maxLimiters {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[key] = &namespaceLimiter{limiter: limiter, lastSeen: now}
+	}
+	l.mu.Unlock()
+	return limiter.AllowN(now, 1)
+}
+
+// evictIdle drops the buckets that were not used for long enough to be full again. The buckets are swept at most once
+// per idle period, so the cost of a sweep is spread over the requests in between. The caller has to hold mu.
+func (l *rateLimiter) evictIdle(now time.Time) {
+	if l.idle < 0 || now.Sub(l.lastSweep) < l.idle {
+		return
+	}
+	l.lastSweep = now
+	for key, entry := range l.limiters {
+		if now.Sub(entry.lastSeen) >= l.idle {
+			delete(l.limiters, key)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package admit_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+)
+
+// postIn posts a review of the test pod in the namespace and returns the status of the response.
+func postIn(t testing.TB, ac admit.AdmissionController, namespace string) int {
+	t.Helper()
+	pod := testPod()
+	pod.Namespace = namespace
+	return post(t, ac, "/mutate", newReview(podRequest(t, pod))).Code
+}
+
+func TestRateLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  admit.Option
+		// namespaces are flooded with requests in turn, wantLimited is the number of requests answered with 429 for
+		// each of them.
+		namespaces  []string
+		wantLimited []int
+	}{
+		{name: "global", opt: admit.WithRateLimit(0.001, 5), namespaces: []string{"a", "b"}, wantLimited: []int{5, 10}},
+		{name: "per namespace", opt: admit.WithNamespaceRateLimit(0.001, 5), namespaces: []string{"a", "b"}, wantLimited: []int{5, 5}},
+		{name: "unlimited", namespaces: []string{"a"}, wantLimited: []int{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []admit.Option
+			if tt.opt != nil {
+				opts = append(opts, tt.opt)
+			}
+			ac := admit.New(opts...)
+			for i, namespace := range tt.namespaces {
+				limited := 0
+				for j := 0; j < 10; j++ {
+					switch code := postIn(t, ac, namespace); code {
+					case http.StatusTooManyRequests:
+						limited++
+					case http.StatusOK:
+					default:
+						t.Fatalf("got status %d", code)
+					}
+				}
+				if limited != tt.wantLimited[i] {
+					t.Errorf("got %d requests in %s limited, want %d", limited, namespace, tt.wantLimited[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNamespaceRateLimitBounded(t *testing.T) {
+	t.Run("overflow", func(t *testing.T) {
+		ac := admit.New(admit.WithNamespaceRateLimit(0.001, 1))
+		for i := 0; i < 10000; i++ {
+			if code := postIn(t, ac, "ns-"+strconv.Itoa(i)); code != http.StatusOK {
+				t.Fatalf("got status %d for namespace %d", code, i)
+			}
+		}
+		// Namespaces beyond the bound share a single limit.
+		if code := postIn(t, ac, "overflow-a"); code != http.StatusOK {
+			t.Errorf("got status %d for the first overflowing namespace", code)
+		}
+		if code := postIn(t, ac, "overflow-b"); code != http.StatusTooManyRequests {
+			t.Errorf("got status %d for the second overflowing namespace, want it to share the limit", code)
+		}
+		// Namespaces within the bound keep their own limit.
+		if code := postIn(t, ac, "ns-0"); code != http.StatusTooManyRequests {
+			t.Errorf("got status %d for a limited namespace", code)
+		}
+	})
+	t.Run("idle eviction", func(t *testing.T) {
+		// The bucket refills in 10ms, so namespaces idle for longer are evicted.
+		ac := admit.New(admit.WithNamespaceRateLimit(100, 1))
+		for i := 0; i < 10000; i++ {
+			postIn(t, ac, "ns-"+strconv.Itoa(i))
+		}
+		time.Sleep(20 * time.Millisecond)
+		for _, namespace := range []string{"fresh-a", "fresh-b"} {
+			if code := postIn(t, ac, namespace); code != http.StatusOK {
+				t.Errorf("got status %d for %s, want the idle namespaces evicted", code, namespace)
+			}
+		}
+	})
+}
+
+// readCounter is a request body counting the reads of it.
+type readCounter struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	c.reads++
+	return c.r.Read(p)
+}
+
+func TestRateLimitBeforeReading(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  admit.Option
+		// wantStatus is the status of the malformed request exceeding the limit, wantRead if its body is read.
+		wantStatus int
+		wantRead   bool
+	}{
+		{name: "global", opt: admit.WithRateLimit(0.001, 1), wantStatus: http.StatusTooManyRequests},
+		{name: "per namespace", opt: admit.WithNamespaceRateLimit(0.001, 1), wantStatus: http.StatusBadRequest, wantRead: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(tt.opt)
+			if code := postIn(t, ac, "default"); code != http.StatusOK {
+				t.Fatalf("got status %d for the first request", code)
+			}
+
+			body := &readCounter{r: strings.NewReader(`{"kind":`)}
+			r := httptest.NewRequest(http.MethodPost, "/mutate", body)
+			r.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			ac.ServeHTTP(rec, r)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if read := body.reads > 0; read != tt.wantRead {
+				t.Errorf("got body read %t, want %t", read, tt.wantRead)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package admit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	admissionV1 "k8s.io/api/admission/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"k8s.io/kube-openapi/pkg/validation/strfmt"
+	"k8s.io/kube-openapi/pkg/validation/validate"
+	"sigs.k8s.io/yaml"
+)
+
+// RegisterWithSchema registers a new AdmitFunc at this controller that is only run for objects matching the JSON
+// schema, given as JSON or YAML. Objects not matching it are denied with the validation errors. Requests without a new
+// object, like DELETE requests, are not validated. If the schema cannot be parsed, the handler denies every request.
+func (ac *admissionController) RegisterWithSchema(name string, schema []byte, adm AdmitFunc, opts ...HandlerOption) {
+	validator, parseErr := newSchemaValidator(schema)
+	if parseErr != nil {
+		ac.logger.Error("could not parse schema, denying all requests", parseErr, "name", name)
+	}
+	handle := adm.handlerFunc()
+	ac.register(&handler{name: name, handle: func(ctx context.Context, req *admissionV1.AdmissionRequest) (*Result, error) {
+		if parseErr != nil {
+			return nil, fmt.Errorf("handler %s has an invalid schema: %v", name, parseErr)
+		}
+		if err := validateSchema(validator, req.Object.Raw); err != nil {
+			return nil, err
+		}
+		return handle(ctx, req)
+	}}, opts)
+}
+
+// newSchemaValidator parses the JSON schema, given as JSON or YAML, into a validator.
+func newSchemaValidator(schema []byte) (*validate.SchemaValidator, error) {
+	raw, err := yaml.YAMLToJSON(schema)
+	if err != nil {
+		return nil, err
+	}
+	s := &spec.Schema{}
+	if err := s.UnmarshalJSON(raw); err != nil {
+		return nil, err
+	}
+	return validate.NewSchemaValidator(s, nil, "", strfmt.Default), nil
+}
+
+// validateSchema fails with a DenyError listing the validation errors if the raw object does not match the schema of
+// the validator. Empty objects are not validated.
+func validateSchema(validator *validate.SchemaValidator, raw []byte) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	var obj interface{}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return fmt.Errorf("could not decode object: %v", err)
+	}
+	result := validator.Validate(obj)
+	if result.IsValid() {
+		return nil
+	}
+	messages := make([]string, len(result.Errors))
+	for i, err := range result.Errors {
+		messages[i] = err.Error()
+	}
+	return DenyError{
+		Code:    http.StatusUnprocessableEntity,
+		Reason:  metaV1.StatusReasonInvalid,
+		Message: "object does not match the schema: " + strings.Join(messages, "; "),
+	}
+}
@@ -0,0 +1,74 @@
+package admit_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	admissionV1 "k8s.io/api/admission/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// appLabelSchema requires objects to carry a string app label.
+const appLabelSchema = `
+type: object
+required: [metadata]
+properties:
+  metadata:
+    type: object
+    required: [labels]
+    properties:
+      labels:
+        type: object
+        required: [app]
+        properties:
+          app:
+            type: string
+`
+
+func TestRegisterWithSchema(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		labels map[string]string
+		delete bool
+		// wantDenial is part of the message of the denial, the handler is expected to run if it is empty.
+		wantDenial string
+		// wantInvalid is set if the object is denied as invalid.
+		wantInvalid bool
+	}{
+		{name: "matching", schema: appLabelSchema, labels: map[string]string{"app": "web"}},
+		{name: "label missing", schema: appLabelSchema, labels: map[string]string{"tier": "frontend"}, wantDenial: "object does not match the schema: metadata.labels.app in body is required", wantInvalid: true},
+		{name: "labels missing", schema: appLabelSchema, wantDenial: "object does not match the schema: metadata.labels in body is required", wantInvalid: true},
+		{name: "delete not validated", schema: appLabelSchema, delete: true},
+		{name: "invalid schema", schema: "type: [", labels: map[string]string{"app": "web"}, wantDenial: "handler schema has an invalid schema"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			ac.RegisterWithSchema("schema", []byte(tt.schema), patching("validated"))
+
+			pod := testPod()
+			pod.Labels = tt.labels
+			req := podRequest(t, pod)
+			if tt.delete {
+				req.Operation, req.Object, req.OldObject = admissionV1.Delete, runtime.RawExtension{}, req.Object
+			}
+			res := responseOf(t, post(t, ac, "/mutate", newReview(req)))
+			if tt.wantDenial == "" {
+				if !res.Allowed || len(patchesOf(t, res)) != 1 {
+					t.Errorf("got response %+v, want the handler run", res)
+				}
+				return
+			}
+			if res.Allowed || !strings.Contains(messageOf(res), tt.wantDenial) {
+				t.Fatalf("got allowed %t with message %q, want a denial with %q", res.Allowed, messageOf(res), tt.wantDenial)
+			}
+			if tt.wantInvalid && (res.Result.Code != http.StatusUnprocessableEntity || res.Result.Reason != metaV1.StatusReasonInvalid) {
+				t.Errorf("got status %d %s, want %d %s", res.Result.Code, res.Result.Reason, http.StatusUnprocessableEntity, metaV1.StatusReasonInvalid)
+			}
+		})
+	}
+}
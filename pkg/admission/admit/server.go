@@ -0,0 +1,195 @@
+package admit
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Default time in-flight requests are given to complete on shutdown
+const (
+	defaultShutdownTimeout = 10 * time.Second
+)
+
+// Default timeouts of connections, the write timeout exceeds the maximum webhook timeout of the apiserver of 30 seconds
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 35 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+)
+
+// Server serves a http.Handler, usually an AdmissionController, until its context is canceled.
+type Server struct {
+	handler         http.Handler
+	shutdownTimeout time.Duration
+	timeouts        serverTimeouts
+	tlsConfig       *tls.Config
+	socketPath      string
+}
+
+// serverTimeouts are the timeouts of the connections of a Server, which protect it from slow clients.
+type serverTimeouts struct {
+	readHeader time.Duration
+	read       time.Duration
+	write      time.Duration
+	idle       time.Duration
+}
+
+// ServerOption configures a Server on creation.
+type ServerOption func(*Server)
+
+// WithShutdownTimeout sets the time in-flight requests are given to complete once the server is shut down.
+func WithShutdownTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.shutdownTimeout = d
+	}
+}
+
+// WithReadHeaderTimeout sets the time clients are given to send the headers of a request. Zero disables the timeout.
+func WithReadHeaderTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.timeouts.readHeader = d
+	}
+}
+
+// WithReadTimeout sets the time clients are given to send a whole request. Zero disables the timeout.
+func WithReadTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.timeouts.read = d
+	}
+}
+
+// WithWriteTimeout sets the time from the end of reading the headers of a request until the response is written. It
+// should exceed the handler timeout of the controller. Zero disables the timeout.
+func WithWriteTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.timeouts.write = d
+	}
+}
+
+// WithIdleTimeout sets the time idle keep-alive connections are kept open. Zero disables the timeout.
+func WithIdleTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.timeouts.idle = d
+	}
+}
+
+// WithTLSConfig sets the TLS configuration of the server, e.g. created by NewTLSConfig.
+func WithTLSConfig(cfg *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.tlsConfig = cfg
+	}
+}
+
+// WithUnixSocket makes the server listen on a unix domain socket at path as well, e.g. for sidecars connecting to the
+// webhook without a network hop. The socket serves plain HTTP, access to it is controlled by the permissions of the
+// socket file. A stale socket file left behind by a previous run is replaced, and the file is removed on shutdown.
+func WithUnixSocket(path string) ServerOption {
+	return func(s *Server) {
+		s.socketPath = path
+	}
+}
+
+// NewServer creates a Server for the given handler.
+func NewServer(handler http.Handler, opts ...ServerOption) *Server {
+	s := &Server{
+		handler:         handler,
+		shutdownTimeout: defaultShutdownTimeout,
+		timeouts: serverTimeouts{
+			readHeader: defaultReadHeaderTimeout,
+			read:       defaultReadTimeout,
+			write:      defaultWriteTimeout,
+			idle:       defaultIdleTimeout,
+		},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// ListenAndServeTLS serves HTTPS at addr, and plain HTTP at the unix socket of the server if one is configured, until
+// ctx is canceled. addr may be empty to only serve at the unix socket. certFile and keyFile may be empty if the TLS
+// configuration of the server provides the certificate. The server then stops accepting connections and waits
+// for in-flight requests to complete, at most for the shutdown timeout. It returns nil after a graceful shutdown.
+func (s *Server) ListenAndServeTLS(ctx context.Context, addr, certFile, keyFile string) error {
+	if addr == "" && s.socketPath == "" {
+		return errors.New("neither an address nor a unix socket to listen on")
+	}
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   s.handler,
+		TLSConfig: s.tlsConfig,
+
+		ReadHeaderTimeout: s.timeouts.readHeader,
+		ReadTimeout:       s.timeouts.read,
+		WriteTimeout:      s.timeouts.write,
+		IdleTimeout:       s.timeouts.idle,
+	}
+
+	var socket net.Listener
+	if s.socketPath != "" {
+		var err error
+		if socket, err = listenUnix(s.socketPath); err != nil {
+			return err
+		}
+	}
+
+	// Every listener reports the error it stopped with.
+	errs := make(chan error, 2)
+	listeners := 0
+	if addr != "" {
+		listeners++
+		go func() {
+			errs <- server.ListenAndServeTLS(certFile, keyFile)
+		}()
+	}
+	if socket != nil {
+		listeners++
+		go func() {
+			errs <- server.Serve(socket)
+		}()
+	}
+
+	select {
+	case err := <-errs:
+		// Stop the remaining listener as well, the socket file is removed on close.
+		server.Close()
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+
+	for i := 0; i < listeners; i++ {
+		if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+// listenUnix listens on a unix domain socket at path, replacing a stale socket file. The socket file is removed once
+// the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("could not listen on %s: file exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("could not remove stale socket %s: %v", path, err)
+		}
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,358 @@
+package admit_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/fs"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+)
+
+// testCA is a certificate authority issuing certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+// newTestCA creates a self-signed certificate authority.
+func newTestCA(t testing.TB) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// keyPair is a PEM encoded certificate and its key.
+type keyPair struct {
+	certPEM, keyPEM []byte
+}
+
+// issue returns a certificate of the common name for server and client authentication. The names are the IP addresses
+// or DNS names of the certificate.
+func (ca *testCA) issue(t testing.TB, commonName string, names ...string) keyPair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyPair{
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writeKeyPair writes the certificate and key to files in dir and returns their paths.
+func writeKeyPair(t testing.TB, dir string, kp keyPair) (certFile, keyFile string) {
+	t.Helper()
+	certFile, keyFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, kp.certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, kp.keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// freeAddr returns a local address that is free to listen at.
+func freeAddr(t testing.TB) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// waitListening waits until a server accepts connections at the address.
+func waitListening(t testing.TB, network, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial(network, addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server not listening at %s: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	tests := []struct {
+		name            string
+		shutdownTimeout time.Duration
+		// wantErr is set if the in-flight request outlasts the shutdown timeout.
+		wantErr bool
+	}{
+		{name: "in-flight request completes", shutdownTimeout: 10 * time.Second},
+		{name: "shutdown timeout exceeded", shutdownTimeout: 50 * time.Millisecond, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ca := newTestCA(t)
+			certFile, keyFile := writeKeyPair(t, t.TempDir(), ca.issue(t, "server", "127.0.0.1"))
+			started, release := make(chan struct{}), make(chan struct{})
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				<-release
+				io.WriteString(w, "done")
+			})
+
+			addr := freeAddr(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			served := make(chan error, 1)
+			go func() {
+				served <- admit.NewServer(handler, admit.WithShutdownTimeout(tt.shutdownTimeout)).ListenAndServeTLS(ctx, addr, certFile, keyFile)
+			}()
+			waitListening(t, "tcp", addr)
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool}}}
+			bodies := make(chan string, 1)
+			go func() {
+				resp, err := client.Get("https://" + addr + "/")
+				if err != nil {
+					bodies <- err.Error()
+					return
+				}
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body)
+				bodies <- string(body)
+			}()
+			<-started
+			cancel()
+
+			if tt.wantErr {
+				err := <-served
+				close(release)
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("got %v, want the shutdown to time out", err)
+				}
+				return
+			}
+			select {
+			case err := <-served:
+				t.Fatalf("server returned %v before the in-flight request completed", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+			close(release)
+			if body := <-bodies; body != "done" {
+				t.Errorf("got %q, want the in-flight request to complete", body)
+			}
+			if err := <-served; err != nil {
+				t.Errorf("got %v, want a graceful shutdown", err)
+			}
+		})
+	}
+}
+
+func TestServerUnixSocket(t *testing.T) {
+	tests := []struct {
+		name string
+		// stale is set if a socket file is left behind at the path, notSocket if another file is.
+		stale, notSocket bool
+	}{
+		{name: "new socket"},
+		{name: "stale socket replaced", stale: true},
+		{name: "other file kept", notSocket: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Socket paths are limited to about 100 bytes, which the test temp dir may exceed.
+			dir, err := os.MkdirTemp("", "admit")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "webhook.sock")
+			if tt.stale {
+				ln, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Keep the file, as a crashed process would.
+				ln.(*net.UnixListener).SetUnlinkOnClose(false)
+				ln.Close()
+			}
+			if tt.notSocket {
+				if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ac := admit.New()
+			ac.Register("label", patching("a"))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			served := make(chan error, 1)
+			go func() {
+				served <- admit.NewServer(ac, admit.WithUnixSocket(path)).ListenAndServeTLS(ctx, "", "", "")
+			}()
+			if tt.notSocket {
+				if err := <-served; err == nil || !strings.Contains(err.Error(), "is not a socket") {
+					t.Errorf("got %v, want the file not to be replaced", err)
+				}
+				return
+			}
+			waitListening(t, "unix", path)
+
+			client := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return new(net.Dialer).DialContext(ctx, "unix", path)
+				},
+			}}
+			resp, err := client.Post("http://webhook/mutate", "application/json", bytes.NewReader(mustMarshal(t, newReview(podRequest(t, testPod())))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			rec.Code = resp.StatusCode
+			io.Copy(rec.Body, resp.Body)
+			resp.Body.Close()
+			if res := responseOf(t, rec); !res.Allowed || len(patchesOf(t, res)) != 1 {
+				t.Errorf("got response %+v, want an allow with a patch", res)
+			}
+
+			cancel()
+			if err := <-served; err != nil {
+				t.Errorf("got %v, want a graceful shutdown", err)
+			}
+			if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("got socket file left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestServerReadHeaderTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		// slow is set if the client stalls after the first header line.
+		slow bool
+		// cutOff is set if the server is expected to close the connection without a response.
+		cutOff bool
+	}{
+		{name: "slow headers cut off", timeout: 50 * time.Millisecond, slow: true, cutOff: true},
+		{name: "complete headers answered", timeout: 50 * time.Millisecond},
+		{name: "slow headers within timeout", timeout: 5 * time.Second, slow: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "admit")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "webhook.sock")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			served := make(chan error, 1)
+			go func() {
+				srv := admit.NewServer(admit.New(),
+					admit.WithUnixSocket(path), admit.WithReadHeaderTimeout(tt.timeout))
+				served <- srv.ListenAndServeTLS(ctx, "", "", "")
+			}()
+			defer func() {
+				cancel()
+				<-served
+			}()
+			waitListening(t, "unix", path)
+
+			conn, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := io.WriteString(conn, "GET /readyz HTTP/1.1\r\n"); err != nil {
+				t.Fatal(err)
+			}
+			if tt.slow {
+				time.Sleep(200 * time.Millisecond)
+			}
+			// The write fails if the server already closed the connection, which the read below reports as well.
+			io.WriteString(conn, "Host: webhook\r\nConnection: close\r\n\r\n")
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			got, err := io.ReadAll(conn)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatal("got connection kept open")
+			}
+			if answered := bytes.HasPrefix(got, []byte("HTTP/1.1 ")); answered == tt.cutOff {
+				t.Errorf("got response %q, want cut off %t", got, tt.cutOff)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package admit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	admissionV1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// TestRequestOption modifies the request built by TestInvoke before it is passed to the handler.
+type TestRequestOption func(*admissionV1.AdmissionRequest)
+
+// WithTestResource sets the resource and subresource of the request, e.g. for objects whose resource is not the
+// lowercase plural of their kind, or requests for a subresource like status.
+func WithTestResource(resource metaV1.GroupVersionResource, subResource string) TestRequestOption {
+	return func(req *admissionV1.AdmissionRequest) {
+		req.Resource = resource
+		req.SubResource = subResource
+	}
+}
+
+// TestInvoke runs adm for a request admitting obj with the given operation, as it would be run by a controller, and
+// returns the response. It is meant for unit testing AdmitFuncs without HTTP. The TypeMeta of obj should be set, so
+// the request carries the kind of the object and the resource guessed from it, e.g.
+//
+//	pod := &coreV1.Pod{TypeMeta: metaV1.TypeMeta{APIVersion: "v1", Kind: "Pod"}}
+//	res, err := admit.TestInvoke(handler, pod, admissionV1.Create)
+func TestInvoke(adm AdmitFunc, obj runtime.Object, op admissionV1.Operation, opts ...TestRequestOption) (*admissionV1.AdmissionResponse, error) {
+	req, err := newTestRequest(obj, op)
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		opt(req)
+	}
+
+	// Tests stay quiet, nothing is logged.
+	ac := New(WithLogger(nil)).(*admissionController)
+	return ac.review(context.Background(), req, []*handler{{name: "test", handle: adm.handlerFunc()}}, false)
+}
+
+// Preview runs the handlers registered at the base path of the controller for a request admitting the object given as
+// YAML or JSON with the given operation, and returns the patch operations they produce. Like with TestInvoke, the
+// resource of the request is guessed from the kind of the object. It is meant for trying handlers on real manifests
+// without deploying the webhook. Denials are returned as error, as are raw patches of other types than JSONPatch,
+// which cannot be decoded to patch operations.
+func Preview(controller AdmissionController, objYAML []byte, op admissionV1.Operation) ([]PatchOperation, error) {
+	ac, ok := controller.(*admissionController)
+	if !ok {
+		return nil, fmt.Errorf("cannot preview %T, only controllers created by New are supported", controller)
+	}
+	raw, err := yaml.YAMLToJSON(objYAML)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert object to JSON: %v", err)
+	}
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(raw); err != nil {
+		return nil, fmt.Errorf("could not decode object: %v", err)
+	}
+	req, err := newTestRequest(obj, op)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := ac.review(context.Background(), req, ac.handlersAt(ac.basePath), false)
+	if err != nil {
+		return nil, err
+	}
+	if !res.Allowed {
+		return nil, fmt.Errorf("denied: %s", res.Result.Message)
+	}
+	if res.PatchType != nil && *res.PatchType != admissionV1.PatchTypeJSONPatch {
+		return nil, fmt.Errorf("cannot preview patch of type %s, only JSON patches are supported", *res.PatchType)
+	}
+	var patches []PatchOperation
+	if err := json.Unmarshal(res.Patch, &patches); err != nil {
+		return nil, fmt.Errorf("could not decode patch: %v", err)
+	}
+	return patches, nil
+}
+
+// newTestRequest wraps obj into an AdmissionRequest for the given operation. The resource is guessed from the kind of
+// the object, e.g. pods for Pod. The object of a DELETE request is passed as its old object, as the apiserver does.
+func newTestRequest(obj runtime.Object, op admissionV1.Operation) (*admissionV1.AdmissionRequest, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, fmt.Errorf("could not access object metadata: %v", err)
+	}
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal object: %v", err)
+	}
+
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	gvr, _ := meta.UnsafeGuessKindToResource(gvk)
+	req := &admissionV1.AdmissionRequest{
+		UID:       "test",
+		Kind:      metaV1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+		Resource:  metaV1.GroupVersionResource{Group: gvr.Group, Version: gvr.Version, Resource: gvr.Resource},
+		Name:      accessor.GetName(),
+		Namespace: accessor.GetNamespace(),
+		Operation: op,
+	}
+	if op == admissionV1.Delete {
+		req.OldObject.Raw = raw
+	} else {
+		req.Object.Raw = raw
+	}
+	return req, nil
+}
@@ -0,0 +1,219 @@
+package admit_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	admissionV1 "k8s.io/api/admission/v1"
+	appsV1 "k8s.io/api/apps/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func ExampleTestInvoke() {
+	// injectSidecar adds a sidecar container to pods.
+	injectSidecar := func(req *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+		pod := &coreV1.Pod{}
+		if err := admit.DecodeObject(req, pod); err != nil {
+			return nil, err
+		}
+		return admit.InjectContainer(pod, coreV1.Container{Name: "proxy", Image: "envoy"}), nil
+	}
+
+	pod := &coreV1.Pod{
+		TypeMeta:   metaV1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metaV1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       coreV1.PodSpec{Containers: []coreV1.Container{{Name: "app", Image: "nginx"}}},
+	}
+	res, err := admit.TestInvoke(injectSidecar, pod, admissionV1.Create)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(res.Allowed, string(res.Patch))
+	// Output: true [{"op":"add","path":"/spec/containers/-","value":{"name":"proxy","image":"envoy","resources":{}}}]
+}
+
+func TestTestInvoke(t *testing.T) {
+	tests := []struct {
+		name        string
+		op          admissionV1.Operation
+		err         error
+		wantAllowed bool
+		wantMessage string
+	}{
+		{name: "create", op: admissionV1.Create, wantAllowed: true},
+		{name: "delete", op: admissionV1.Delete, wantAllowed: true},
+		{name: "deny", op: admissionV1.Create, err: errors.New("denied"), wantMessage: "denied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *coreV1.Pod
+			adm := func(req *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				got = &coreV1.Pod{}
+				if err := admit.DecodeTarget(req, got); err != nil {
+					return nil, err
+				}
+				if req.Operation != tt.op {
+					return nil, fmt.Errorf("got operation %s", req.Operation)
+				}
+				return nil, tt.err
+			}
+
+			res, err := admit.TestInvoke(adm, testPod(), tt.op)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Allowed != tt.wantAllowed || messageOf(res) != tt.wantMessage {
+				t.Errorf("got allowed %t with message %q, want %t with %q", res.Allowed, messageOf(res), tt.wantAllowed, tt.wantMessage)
+			}
+			if got == nil || got.Name != "web" || got.Namespace != "default" {
+				t.Errorf("handler got pod %v, want default/web", got)
+			}
+		})
+	}
+}
+
+func TestTestInvokeResource(t *testing.T) {
+	pods := metaV1.GroupVersionResource{Version: "v1", Resource: "pods"}
+	// podsOnly patches pods only, like handlers ignoring requests for other resources.
+	podsOnly := func(req *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+		if req.Resource != pods || req.SubResource != "" {
+			return nil, nil
+		}
+		return admit.EnsureLabel(testPod(), "a", "true"), nil
+	}
+	tests := []struct {
+		name        string
+		opts        []admit.TestRequestOption
+		wantPatched bool
+	}{
+		{name: "guessed from kind", wantPatched: true},
+		{name: "overridden", opts: []admit.TestRequestOption{admit.WithTestResource(pods, "status")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := admit.TestInvoke(podsOnly, testPod(), admissionV1.Create, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if patched := len(patchesOf(t, res)) > 0; patched != tt.wantPatched {
+				t.Errorf("got patched %t, want %t", patched, tt.wantPatched)
+			}
+		})
+	}
+}
+
+func TestTestInvokeQuiet(t *testing.T) {
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	for _, adm := range []admit.AdmitFunc{patching("a"), failing("denied")} {
+		if _, err := admit.TestInvoke(adm, testPod(), admissionV1.Create); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if buf.Len() > 0 {
+		t.Errorf("got logged %q, want nothing", buf.String())
+	}
+}
+
+func TestPreview(t *testing.T) {
+	const deployment = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: default
+spec:
+  replicas: 1
+  template:
+    spec:
+      containers:
+      - name: app
+        image: nginx
+`
+	// scaling sets the replicas of deployments to three and denies deleting them.
+	scaling := func(req *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+		if req.Operation == admissionV1.Delete {
+			return nil, errors.New("deployments cannot be deleted")
+		}
+		deploy := &appsV1.Deployment{}
+		if err := admit.DecodeObject(req, deploy); err != nil {
+			return nil, err
+		}
+		if req.Namespace != "default" || deploy.Spec.Template.Spec.Containers[0].Image != "nginx" {
+			return nil, fmt.Errorf("got unexpected deployment %s/%s", req.Namespace, deploy.Name)
+		}
+		return new(admit.PatchBuilder).Replace("/spec/replicas", 3).Build(), nil
+	}
+	tests := []struct {
+		name    string
+		obj     string
+		op      admissionV1.Operation
+		want    []admit.PatchOperation
+		wantErr string
+	}{
+		{name: "yaml", obj: deployment, op: admissionV1.Create, want: []admit.PatchOperation{{Op: "replace", Path: "/spec/replicas", Value: float64(3)}}},
+		{
+			name: "json",
+			obj:  `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"default"},"spec":{"template":{"spec":{"containers":[{"name":"app","image":"nginx"}]}}}}`,
+			op:   admissionV1.Update,
+			want: []admit.PatchOperation{{Op: "replace", Path: "/spec/replicas", Value: float64(3)}},
+		},
+		{name: "denied", obj: deployment, op: admissionV1.Delete, wantErr: "denied: deployments cannot be deleted"},
+		{name: "malformed", obj: "kind: [", op: admissionV1.Create, wantErr: "could not convert object to JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			ac.Register("scaling", scaling)
+
+			got, err := admit.Preview(ac, []byte(tt.obj), tt.op)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got patch %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("resource", func(t *testing.T) {
+		ac := admit.New()
+		ac.RegisterForResource("scaling", "deployments", "", scaling)
+
+		got, err := admit.Preview(ac, []byte(deployment), admissionV1.Create)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []admit.PatchOperation{{Op: "replace", Path: "/spec/replicas", Value: float64(3)}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got patch %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("merge patch", func(t *testing.T) {
+		ac := admit.New()
+		ac.RegisterHandler("scaling", func(context.Context, *admissionV1.AdmissionRequest) (*admit.Result, error) {
+			return &admit.Result{Patch: []byte(`{"spec":{"replicas":3}}`), PatchType: "MergePatch"}, nil
+		})
+
+		want := "cannot preview patch of type MergePatch"
+		if _, err := admit.Preview(ac, []byte(deployment), admissionV1.Create); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %v, want %q", err, want)
+		}
+	})
+}
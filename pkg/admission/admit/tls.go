@@ -0,0 +1,156 @@
+package admit
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// NewTLSConfig creates a TLS configuration serving the certificate in certFile and keyFile. The files are checked for
+// changes on each handshake and reloaded if modified, so a rotated certificate is picked up without a restart. If a
+// reload fails, the previous certificate is served.
+func NewTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.certificate()
+		},
+	}, nil
+}
+
+// AddSNICertificate makes the TLS configuration serve the certificate in certFile and keyFile to clients requesting one
+// of serverNames via SNI, e.g. if the webhook is reachable by several service DNS names. Like the default certificate,
+// it is reloaded when its files change. Clients requesting another name, or none at all, get the certificate the
+// configuration served before, so the one passed to NewTLSConfig is used as the fallback.
+func AddSNICertificate(config *tls.Config, certFile, keyFile string, serverNames ...string) error {
+	if len(serverNames) == 0 {
+		return errors.New("no server names given")
+	}
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.load(); err != nil {
+		return err
+	}
+
+	names := sets.New[string]()
+	for _, name := range serverNames {
+		names.Insert(normalizeServerName(name))
+	}
+	fallback := config.GetCertificate
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if names.Has(normalizeServerName(hello.ServerName)) {
+			return r.certificate()
+		}
+		if fallback == nil {
+			// Let the TLS stack pick one of config.Certificates.
+			return nil, nil
+		}
+		return fallback(hello)
+	}
+	return nil
+}
+
+// normalizeServerName lowercases a DNS name and strips a trailing dot, as names are case-insensitive and may be fully
+// qualified.
+func normalizeServerName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// RequireClientCert makes the TLS configuration require clients to present a certificate signed by a CA in caFile,
+// e.g. the one the apiserver authenticates to webhooks with. If names are given, the common name or one of the DNS
+// names of the client certificate has to be among them. Other clients are rejected during the handshake, which
+// applies to the probes as well, as the TLS layer does not know the requested path.
+func RequireClientCert(config *tls.Config, caFile string, names ...string) error {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if len(names) > 0 {
+		allowed := sets.New(names...)
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("client presented no certificate")
+			}
+			leaf := cs.PeerCertificates[0]
+			if allowed.Has(leaf.Subject.CommonName) || allowed.HasAny(leaf.DNSNames...) {
+				return nil
+			}
+			return fmt.Errorf("client certificate %s is not allowed", leaf.Subject.CommonName)
+		}
+	}
+	return nil
+}
+
+// certReloader caches a certificate and reloads it when its files are modified.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// certificate returns the current certificate, reloading it if its files were modified since it was loaded.
+func (r *certReloader) certificate() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certMod, keyMod, err := r.modTimes()
+	if err == nil && certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return r.cert, nil
+	}
+
+	if cert, err := r.load(); err == nil {
+		return cert, nil
+	}
+	// Files may be in the middle of being replaced, keep serving the previous certificate.
+	return r.cert, nil
+}
+
+// load loads the certificate from its files and caches it along with their modification times.
+func (r *certReloader) load() (*tls.Certificate, error) {
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	r.cert, r.certMod, r.keyMod = &cert, certMod, keyMod
+	return r.cert, nil
+}
+
+// modTimes returns the modification times of the certificate and key file.
+func (r *certReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
@@ -0,0 +1,211 @@
+package admit_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+)
+
+// servedCert performs a handshake with a server of the TLS configuration, requesting the server name via SNI if not
+// empty, and returns the certificate the server presented.
+func servedCert(t testing.TB, cfg *tls.Config, serverName string) *x509.Certificate {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		tls.Server(serverConn, cfg).Handshake()
+	}()
+
+	client := tls.Client(clientConn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	return client.ConnectionState().PeerCertificates[0]
+}
+
+func TestTLSConfigReloadsCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	initial, rotated := ca.issue(t, "initial"), ca.issue(t, "rotated")
+	dir := t.TempDir()
+	certFile, keyFile := writeKeyPair(t, dir, initial)
+	cfg, err := admit.NewTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name  string
+		write *keyPair
+		want  string
+	}{
+		{name: "initial certificate", want: "initial"},
+		{name: "rotated certificate", write: &rotated, want: "rotated"},
+		{name: "broken files keep the previous certificate", write: &keyPair{certPEM: []byte("broken"), keyPEM: []byte("broken")}, want: "rotated"},
+		{name: "restored certificate", write: &initial, want: "initial"},
+	}
+	for i, step := range steps {
+		if step.write != nil {
+			writeKeyPair(t, dir, *step.write)
+			// Make sure the modification time changes, file systems may have a coarse resolution.
+			mod := time.Now().Add(time.Duration(i) * time.Minute)
+			for _, f := range []string{certFile, keyFile} {
+				if err := os.Chtimes(f, mod, mod); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if got := servedCert(t, cfg, "").Subject.CommonName; got != step.want {
+			t.Errorf("%s: got certificate %s, want %s", step.name, got, step.want)
+		}
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := writeKeyPair(t, dir, ca.issue(t, "webhook", "127.0.0.1"))
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// names are the names the client certificate is checked for, client the key pair presented by the client.
+		names    []string
+		client   *keyPair
+		wantCode int
+	}{
+		{name: "signed client", client: keyPairPtr(ca.issue(t, "kube-apiserver")), wantCode: http.StatusOK},
+		{name: "signed client of the name", names: []string{"kube-apiserver"}, client: keyPairPtr(ca.issue(t, "kube-apiserver")), wantCode: http.StatusOK},
+		{name: "signed client of a DNS name", names: []string{"apiserver.local"}, client: keyPairPtr(ca.issue(t, "kube-apiserver", "apiserver.local")), wantCode: http.StatusOK},
+		{name: "signed client of another name", names: []string{"kube-apiserver"}, client: keyPairPtr(ca.issue(t, "intruder"))},
+		{name: "unsigned client", client: keyPairPtr(other.issue(t, "kube-apiserver"))},
+		{name: "no client certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := admit.NewTLSConfig(certFile, keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := admit.RequireClientCert(cfg, caFile, tt.names...); err != nil {
+				t.Fatal(err)
+			}
+			ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := &http.Server{Handler: admit.New(), ErrorLog: log.New(io.Discard, "", 0)}
+			go server.Serve(ln)
+			defer server.Close()
+
+			clientConfig := &tls.Config{RootCAs: ca.pool}
+			if tt.client != nil {
+				cert, err := tls.X509KeyPair(tt.client.certPEM, tt.client.keyPEM)
+				if err != nil {
+					t.Fatal(err)
+				}
+				clientConfig.Certificates = []tls.Certificate{cert}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+			res, err := client.Get("https://" + ln.Addr().String() + "/healthz")
+			if tt.wantCode == 0 {
+				if err == nil {
+					res.Body.Close()
+					t.Fatalf("got status %d, want the handshake to fail", res.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.wantCode {
+				t.Errorf("got status %d, want %d", res.StatusCode, tt.wantCode)
+			}
+		})
+	}
+}
+
+func keyPairPtr(kp keyPair) *keyPair {
+	return &kp
+}
+
+func TestAddSNICertificate(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := writeKeyPair(t, t.TempDir(), ca.issue(t, "default", "127.0.0.1"))
+	internalCert, internalKey := writeKeyPair(t, t.TempDir(), ca.issue(t, "internal", "webhook.default.svc"))
+	externalCert, externalKey := writeKeyPair(t, t.TempDir(), ca.issue(t, "external", "webhook.example.com", "hooks.example.com"))
+	cfg, err := admit.NewTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := admit.AddSNICertificate(cfg, internalCert, internalKey, "webhook.default.svc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := admit.AddSNICertificate(cfg, externalCert, externalKey, "webhook.example.com", "Hooks.Example.com."); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := admit.New()
+	ac.Register("label", patching("a"))
+	server := &http.Server{Handler: ac, ErrorLog: log.New(io.Discard, "", 0)}
+	go server.Serve(ln)
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		serverName string
+		want       string
+	}{
+		{name: "internal name", serverName: "webhook.default.svc", want: "internal"},
+		{name: "external name", serverName: "webhook.example.com", want: "external"},
+		{name: "second external name", serverName: "hooks.example.com", want: "external"},
+		{name: "no server name", want: "default"},
+		{name: "unknown server name", serverName: "other.example.com", want: "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := servedCert(t, cfg, tt.serverName).Subject.CommonName; got != tt.want {
+				t.Errorf("got certificate %s, want %s", got, tt.want)
+			}
+			if tt.want == "default" && tt.serverName != "" {
+				// The default certificate is not valid for unknown names, clients cannot verify it.
+				return
+			}
+
+			// The served certificate is verified for the requested name, so the admission request only succeeds with
+			// the right one.
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool, ServerName: tt.serverName}}}
+			res, err := client.Post("https://"+ln.Addr().String()+"/mutate", "application/json", bytes.NewReader(mustMarshal(t, newReview(podRequest(t, testPod())))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("got status %d, want %d", res.StatusCode, http.StatusOK)
+			}
+		})
+	}
+
+	if err := admit.AddSNICertificate(cfg, internalCert, internalKey); err == nil {
+		t.Error("got certificate added without server names")
+	}
+}
@@ -0,0 +1,67 @@
+package admit
+
+import (
+	"context"
+	"net/http"
+
+	admissionV1 "k8s.io/api/admission/v1"
+)
+
+// Tracer records spans of the admission requests and the handlers run for them, see package tracing for an
+// OpenTelemetry implementation.
+type Tracer interface {
+	// StartRequest starts the span of a webhook request. The returned context carries the span and is passed on to the
+	// handlers.
+	StartRequest(r *http.Request) (context.Context, Span)
+	// StartHandler starts the span of a handler run within the request span carried by the context. The returned
+	// context is passed to the handler.
+	StartHandler(ctx context.Context, handler string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetRequest records the admission request the span is about.
+	SetRequest(req *admissionV1.AdmissionRequest)
+	// SetDecision records if the request was allowed and with how many patch operations.
+	SetDecision(allowed bool, patchOperations int)
+	// End ends the span, recording err if the request was not answered with a review.
+	End(err error)
+}
+
+// spanKey is the context key of the request span.
+type spanKey struct{}
+
+// nopTracer records no spans.
+type nopTracer struct{}
+
+func (nopTracer) StartRequest(r *http.Request) (context.Context, Span) {
+	return r.Context(), nopSpan{}
+}
+
+func (nopTracer) StartHandler(ctx context.Context, _ string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+// nopSpan discards everything recorded.
+type nopSpan struct{}
+
+func (nopSpan) SetRequest(*admissionV1.AdmissionRequest) {}
+
+func (nopSpan) SetDecision(bool, int) {}
+
+func (nopSpan) End(error) {}
+
+// startSpan starts the span of a webhook request. The returned request carries the span in its context, which is
+// passed on to the handlers.
+func (ac *admissionController) startSpan(r *http.Request) (*http.Request, Span) {
+	ctx, span := ac.tracer.StartRequest(r)
+	return r.WithContext(context.WithValue(ctx, spanKey{}, span)), span
+}
+
+// spanFromContext returns the request span carried by the context, or one discarding everything if there is none.
+func spanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return nopSpan{}
+}
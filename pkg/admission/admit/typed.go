@@ -0,0 +1,60 @@
+package admit
+
+import (
+	"fmt"
+	"reflect"
+
+	admissionV1 "k8s.io/api/admission/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubeScheme "k8s.io/client-go/kubernetes/scheme"
+)
+
+// RegisterTyped registers f at the controller, which is called with the object of the request decoded into a new T,
+// a pointer to an API type like *coreV1.Pod. For the built-in API types, f is only run for requests of their kind,
+// while unstructured objects and object metadata are decoded for requests of any kind. Other types, e.g. those of
+// custom resources, have to be registered with RegisterTypedForGVK, as their kind is unknown. Requests whose object
+// cannot be decoded are denied. The object of DELETE requests is the one being deleted, see DecodeTarget.
+func RegisterTyped[T runtime.Object](ac AdmissionController, name string, f func(T, *admissionV1.AdmissionRequest) ([]PatchOperation, error), opts ...HandlerOption) {
+	adm, obj := typedAdmitFunc(f)
+	switch any(obj).(type) {
+	case runtime.Unstructured, *metaV1.PartialObjectMetadata:
+		ac.Register(name, adm, opts...)
+		return
+	}
+
+	gvks, _, err := kubeScheme.Scheme.ObjectKinds(obj)
+	if err != nil || len(gvks) == 0 {
+		panic(fmt.Sprintf("RegisterTyped cannot tell the kind of %T, register it with RegisterTypedForGVK", obj))
+	}
+	gvk := gvks[0]
+	ac.RegisterForGVK(name, metaV1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind}, adm, opts...)
+}
+
+// RegisterTypedForGVK registers f at the controller like RegisterTyped, but only runs it for requests of the given
+// kind, which T has to hold.
+func RegisterTypedForGVK[T runtime.Object](ac AdmissionController, name string, gvk metaV1.GroupVersionKind, f func(T, *admissionV1.AdmissionRequest) ([]PatchOperation, error), opts ...HandlerOption) {
+	adm, _ := typedAdmitFunc(f)
+	ac.RegisterForGVK(name, gvk, adm, opts...)
+}
+
+// typedAdmitFunc returns an AdmitFunc calling f with the object of the request decoded into a new T, along with an
+// empty T.
+func typedAdmitFunc[T runtime.Object](f func(T, *admissionV1.AdmissionRequest) ([]PatchOperation, error)) (AdmitFunc, T) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() != reflect.Pointer {
+		panic(fmt.Sprintf("typed handlers require a pointer type, got %s", t))
+	}
+	newObject := func() T {
+		return reflect.New(t.Elem()).Interface().(T)
+	}
+
+	adm := AdmitFunc(func(req *admissionV1.AdmissionRequest) ([]PatchOperation, error) {
+		obj := newObject()
+		if err := DecodeTarget(req, obj); err != nil {
+			return nil, fmt.Errorf("could not decode %s: %v", t.Elem().Name(), err)
+		}
+		return f(obj, req)
+	})
+	return adm, newObject()
+}
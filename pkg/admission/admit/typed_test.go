@@ -0,0 +1,144 @@
+package admit_test
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	admissionV1 "k8s.io/api/admission/v1"
+	appsV1 "k8s.io/api/apps/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// deploymentRequest returns a request creating a Deployment of the given number of replicas.
+func deploymentRequest(t *testing.T, replicas int32) *admissionV1.AdmissionRequest {
+	t.Helper()
+	deploy := &appsV1.Deployment{
+		TypeMeta:   metaV1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metaV1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       appsV1.DeploymentSpec{Replicas: &replicas},
+	}
+	return &admissionV1.AdmissionRequest{
+		UID:       "uid",
+		Operation: admissionV1.Create,
+		Kind:      metaV1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+		Resource:  metaV1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+		Name:      deploy.Name,
+		Namespace: deploy.Namespace,
+		Object:    runtime.RawExtension{Raw: mustMarshal(t, deploy)},
+	}
+}
+
+func TestRegisterTyped(t *testing.T) {
+	tests := []struct {
+		name string
+		req  func(*testing.T) *admissionV1.AdmissionRequest
+		// want are the handlers run with the values they decoded, wantDenial is part of the denial message if any.
+		want       []string
+		wantDenial string
+	}{
+		{
+			name: "pod",
+			req:  func(t *testing.T) *admissionV1.AdmissionRequest { return podRequest(t, testPod()) },
+			want: []string{"pod:nginx", "any:Pod", "metadata:web"},
+		},
+		{
+			name: "deployment",
+			req:  func(t *testing.T) *admissionV1.AdmissionRequest { return deploymentRequest(t, 3) },
+			want: []string{"deployment:3", "any:Deployment", "metadata:web"},
+		},
+		{
+			name: "malformed pod",
+			req: func(t *testing.T) *admissionV1.AdmissionRequest {
+				req := podRequest(t, testPod())
+				req.Object.Raw = []byte(`{"apiVersion":"v1","kind":"Pod","spec":{"containers":"app"}}`)
+				return req
+			},
+			wantDenial: "could not decode Pod",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			var ran []string
+			admit.RegisterTyped(ac, "pod", func(pod *coreV1.Pod, _ *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				ran = append(ran, "pod:"+pod.Spec.Containers[0].Image)
+				return nil, nil
+			})
+			admit.RegisterTyped(ac, "deployment", func(deploy *appsV1.Deployment, _ *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				ran = append(ran, "deployment:"+strconv.Itoa(int(*deploy.Spec.Replicas)))
+				return nil, nil
+			})
+			admit.RegisterTyped(ac, "any", func(obj *unstructured.Unstructured, _ *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				ran = append(ran, "any:"+obj.GetKind())
+				return nil, nil
+			})
+			admit.RegisterTyped(ac, "metadata", func(obj *metaV1.PartialObjectMetadata, _ *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				ran = append(ran, "metadata:"+obj.Name)
+				return nil, nil
+			})
+
+			res := responseOf(t, post(t, ac, "/mutate", newReview(tt.req(t))))
+			if tt.wantDenial != "" {
+				if res.Allowed || !strings.Contains(messageOf(res), tt.wantDenial) {
+					t.Errorf("got allowed %t with message %q, want a denial with %q", res.Allowed, messageOf(res), tt.wantDenial)
+				}
+				return
+			}
+			if !res.Allowed {
+				t.Fatalf("got denied: %s", messageOf(res))
+			}
+			if !reflect.DeepEqual(ran, tt.want) {
+				t.Errorf("got %q run, want %q", ran, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterTypedForGVK(t *testing.T) {
+	tests := []struct {
+		name string
+		req  func(testing.TB) *admissionV1.AdmissionRequest
+		// want are the sizes of the widgets the handler ran for.
+		want []int
+	}{
+		{name: "widget", req: func(t testing.TB) *admissionV1.AdmissionRequest { return widgetRequest(t, 3) }, want: []int{3}},
+		{name: "pod", req: func(t testing.TB) *admissionV1.AdmissionRequest { return podRequest(t, testPod()) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			var ran []int
+			gvk := metaV1.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}
+			admit.RegisterTypedForGVK(ac, "widget", gvk, func(widget *gadget, _ *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				ran = append(ran, widget.Spec.Size)
+				return nil, nil
+			})
+
+			res := responseOf(t, post(t, ac, "/mutate", newReview(tt.req(t))))
+			if !res.Allowed {
+				t.Fatalf("got denied: %s", messageOf(res))
+			}
+			if !reflect.DeepEqual(ran, tt.want) {
+				t.Errorf("got the handler run for %v, want %v", ran, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterTypedUnknownKind(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "RegisterTypedForGVK") {
+			t.Errorf("got panic %v, want one referring to RegisterTypedForGVK", r)
+		}
+	}()
+	admit.RegisterTyped(admit.New(), "widget", func(*gadget, *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+		return nil, nil
+	})
+}
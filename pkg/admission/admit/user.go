@@ -0,0 +1,27 @@
+package admit
+
+import (
+	"strings"
+
+	admissionV1 "k8s.io/api/admission/v1"
+)
+
+// serviceAccountPrefix is the prefix of the names of service account users, which are named
+// system:serviceaccount:<namespace>:<name>.
+const serviceAccountPrefix = "system:serviceaccount:"
+
+// RequestUser returns the name of the user who sent the admission request.
+func RequestUser(req *admissionV1.AdmissionRequest) string {
+	return req.UserInfo.Username
+}
+
+// RequestGroups returns the groups of the user who sent the admission request.
+func RequestGroups(req *admissionV1.AdmissionRequest) []string {
+	return req.UserInfo.Groups
+}
+
+// IsServiceAccount checks if the admission request was sent by a service account, e.g. by a controller rather than a
+// human user.
+func IsServiceAccount(req *admissionV1.AdmissionRequest) bool {
+	return strings.HasPrefix(req.UserInfo.Username, serviceAccountPrefix)
+}
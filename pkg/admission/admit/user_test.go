@@ -0,0 +1,63 @@
+package admit_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	admissionV1 "k8s.io/api/admission/v1"
+	authenticationV1 "k8s.io/api/authentication/v1"
+)
+
+func TestRequestUser(t *testing.T) {
+	tests := []struct {
+		name       string
+		user       authenticationV1.UserInfo
+		wantGroups []string
+		wantSA     bool
+	}{
+		{
+			name:       "service account",
+			user:       authenticationV1.UserInfo{Username: "system:serviceaccount:kube-system:replicaset-controller", Groups: []string{"system:serviceaccounts", "system:serviceaccounts:kube-system", "system:authenticated"}},
+			wantGroups: []string{"system:serviceaccounts", "system:serviceaccounts:kube-system", "system:authenticated"},
+			wantSA:     true,
+		},
+		{
+			name:       "normal user",
+			user:       authenticationV1.UserInfo{Username: "alice@example.com", Groups: []string{"developers", "system:authenticated"}},
+			wantGroups: []string{"developers", "system:authenticated"},
+		},
+		{
+			name: "user named like a service account",
+			user: authenticationV1.UserInfo{Username: "system:serviceaccounts"},
+		},
+		{name: "anonymous"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New()
+			var user string
+			var groups []string
+			var sa bool
+			ac.RegisterValidator("rbac", func(req *admissionV1.AdmissionRequest) error {
+				user, groups, sa = admit.RequestUser(req), admit.RequestGroups(req), admit.IsServiceAccount(req)
+				return nil
+			})
+
+			req := podRequest(t, testPod())
+			req.UserInfo = tt.user
+			if res := responseOf(t, post(t, ac, "/validate", newReview(req))); !res.Allowed {
+				t.Fatalf("got denied: %s", messageOf(res))
+			}
+			if user != tt.user.Username {
+				t.Errorf("got user %q, want %q", user, tt.user.Username)
+			}
+			if !reflect.DeepEqual(groups, tt.wantGroups) {
+				t.Errorf("got groups %q, want %q", groups, tt.wantGroups)
+			}
+			if sa != tt.wantSA {
+				t.Errorf("got service account %t, want %t", sa, tt.wantSA)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+/**
+ * Prometheus metrics for the admission controller.
+ */
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Recorder is an admit.DenialRecorder and admit.RequestRecorder exporting Prometheus metrics. It serves them as a
+// http.Handler.
+type Recorder struct {
+	registry       *prometheus.Registry
+	handler        http.Handler
+	requests       *prometheus.CounterVec
+	duration       *prometheus.HistogramVec
+	denied         *prometheus.CounterVec
+	reviews        *prometheus.CounterVec
+	reviewDuration prometheus.Histogram
+}
+
+// NewRecorder creates a Recorder with its own registry, which also includes the Go runtime and process metrics.
+func NewRecorder() *Recorder {
+	registry := prometheus.NewRegistry()
+	r := &Recorder{
+		registry: registry,
+		handler:  promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "admission_requests_total",
+			Help: "Number of admission requests processed by a handler, by result.",
+		}, []string{"result", "handler"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "admission_request_duration_seconds",
+			Help:    "Duration of processing an admission request by a handler.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"handler"}),
+		denied: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "admission_denied_total",
+			Help: "Number of admission requests denied by a handler, by reason.",
+		}, []string{"reason", "handler"}),
+		reviews: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "admission_reviews_total",
+			Help: "Number of webhook requests, by outcome.",
+		}, []string{"outcome"}),
+		reviewDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "admission_review_duration_seconds",
+			Help:    "Duration of answering a webhook request.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		r.requests,
+		r.duration,
+		r.denied,
+		r.reviews,
+		r.reviewDuration,
+	)
+	return r
+}
+
+// Registry returns the registry the metrics are registered at, e.g. to add application specific ones.
+func (r *Recorder) Registry() *prometheus.Registry {
+	return r.registry
+}
+
+// ObserveHandler records the result and duration of a single handler invocation.
+func (r *Recorder) ObserveHandler(handler, result string, duration time.Duration) {
+	r.requests.WithLabelValues(result, handler).Inc()
+	r.duration.WithLabelValues(handler).Observe(duration.Seconds())
+}
+
+// ObserveDenial records the reason of a request denied by the handler.
+func (r *Recorder) ObserveDenial(handler, reason string) {
+	r.denied.WithLabelValues(reason, handler).Inc()
+}
+
+// ObserveRequest records the outcome and duration of a webhook request.
+func (r *Recorder) ObserveRequest(outcome string, duration time.Duration) {
+	r.reviews.WithLabelValues(outcome).Inc()
+	r.reviewDuration.Observe(duration.Seconds())
+}
+
+// ServeHTTP serves the metrics in the Prometheus exposition format.
+func (r *Recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.handler.ServeHTTP(w, req)
+}
@@ -0,0 +1,146 @@
+package metrics_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	"github.com/52north/admission-webhook-server/pkg/admission/metrics"
+	admissionV1 "k8s.io/api/admission/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// admitConfigMap sends the review of a ConfigMap to the mutating webhook of ac.
+func admitConfigMap(t *testing.T, ac admit.AdmissionController) {
+	t.Helper()
+	review := &admissionV1.AdmissionReview{
+		TypeMeta: metaV1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionV1.AdmissionRequest{
+			UID:    "uid",
+			Kind:   metaV1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+			Object: runtime.RawExtension{Raw: []byte(`{"apiVersion":"v1","kind":"ConfigMap"}`)},
+		},
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	ac.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+// scrape returns the metrics exposed by ac.
+func scrape(t *testing.T, ac admit.AdmissionController) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	ac.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d scraping metrics", rec.Code)
+	}
+	scraped, _ := io.ReadAll(rec.Body)
+	return string(scraped)
+}
+
+func TestRecorder(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want []string
+	}{
+		{
+			name: "allowed",
+			want: []string{
+				`admission_requests_total{handler="test",result="allowed"} 1`,
+				`admission_request_duration_seconds_count{handler="test"} 1`,
+			},
+		},
+		{
+			name: "denied",
+			err:  errors.New("denied"),
+			want: []string{
+				`admission_requests_total{handler="test",result="denied"} 1`,
+				`admission_denied_total{handler="test",reason="unknown"} 1`,
+			},
+		},
+		{
+			name: "failed",
+			err:  admit.RetriableError{Err: errors.New("unavailable")},
+			want: []string{`admission_requests_total{handler="test",result="failed"} 1`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(admit.WithMetrics(metrics.NewRecorder()))
+			ac.Register("test", func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				return nil, tt.err
+			})
+
+			admitConfigMap(t, ac)
+
+			scraped := scrape(t, ac)
+			for _, want := range tt.want {
+				if !strings.Contains(scraped, want) {
+					t.Errorf("scraped metrics lack %s", want)
+				}
+			}
+		})
+	}
+}
+
+func TestDenialReasons(t *testing.T) {
+	forbidden := admit.DenyError{Code: http.StatusForbidden, Reason: metaV1.StatusReasonForbidden, Message: "forbidden"}
+	invalid := &admit.DenyError{Code: http.StatusUnprocessableEntity, Reason: metaV1.StatusReasonInvalid,
+		Message: "invalid"}
+	tests := []struct {
+		name string
+		// errs are returned by the handler for one request each.
+		errs []error
+		want []string
+	}{
+		{
+			name: "distinct reasons",
+			errs: []error{forbidden, invalid, forbidden},
+			want: []string{
+				`admission_denied_total{handler="policy",reason="Forbidden"} 2`,
+				`admission_denied_total{handler="policy",reason="Invalid"} 1`,
+			},
+		},
+		{
+			name: "wrapped and unknown reasons",
+			errs: []error{fmt.Errorf("checking policy: %w", invalid), errors.New("denied"), admit.DenyError{}},
+			want: []string{
+				`admission_denied_total{handler="policy",reason="Invalid"} 1`,
+				`admission_denied_total{handler="policy",reason="unknown"} 2`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := admit.New(admit.WithMetrics(metrics.NewRecorder()))
+			var n int
+			ac.Register("policy", func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				n++
+				return nil, tt.errs[n-1]
+			})
+			for range tt.errs {
+				admitConfigMap(t, ac)
+			}
+
+			scraped := scrape(t, ac)
+			for _, want := range tt.want {
+				if !strings.Contains(scraped, want) {
+					t.Errorf("scraped metrics lack %s", want)
+				}
+			}
+		})
+	}
+}
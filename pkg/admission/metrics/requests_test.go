@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	admissionV1 "k8s.io/api/admission/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// reviewOf returns the body of a review of a ConfigMap in the namespace.
+func reviewOf(t *testing.T, namespace string) []byte {
+	t.Helper()
+	body, err := json.Marshal(&admissionV1.AdmissionReview{
+		TypeMeta: metaV1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionV1.AdmissionRequest{
+			UID:       "uid",
+			Kind:      metaV1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+			Namespace: namespace,
+			Object:    runtime.RawExtension{Raw: []byte(`{"apiVersion":"v1","kind":"ConfigMap"}`)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// sampleCount returns the number of observations of the histogram of the name.
+func sampleCount(t *testing.T, r *Recorder, name string) uint64 {
+	t.Helper()
+	families, err := r.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0].GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
+
+func TestObserveRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		// err is returned by the handler, which is only registered for deployments if deploymentsOnly is set.
+		err             error
+		deploymentsOnly bool
+		namespace       string
+		body            []byte
+		want            string
+	}{
+		{name: "allowed", want: admit.OutcomeAllowed},
+		{name: "denied", err: errors.New("denied"), want: admit.OutcomeDenied},
+		{name: "exempt namespace", err: errors.New("denied"), namespace: "kube-system", want: admit.OutcomeAllowed},
+		{name: "no matching handler", err: errors.New("denied"), deploymentsOnly: true, want: admit.OutcomeAllowed},
+		{name: "malformed", body: []byte(`{"kind":`), want: admit.OutcomeError},
+		{name: "failed", err: admit.RetriableError{Err: errors.New("unavailable")}, want: admit.OutcomeError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := NewRecorder()
+			ac := admit.New(admit.WithMetrics(recorder))
+			adm := func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				return nil, tt.err
+			}
+			if tt.deploymentsOnly {
+				ac.RegisterForGVK("test", metaV1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, adm)
+			} else {
+				ac.Register("test", adm)
+			}
+
+			body := tt.body
+			if body == nil {
+				body = reviewOf(t, tt.namespace)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			ac.ServeHTTP(httptest.NewRecorder(), r)
+
+			for _, outcome := range []string{admit.OutcomeAllowed, admit.OutcomeDenied, admit.OutcomeError} {
+				want := 0.0
+				if outcome == tt.want {
+					want = 1
+				}
+				if got := testutil.ToFloat64(recorder.reviews.WithLabelValues(outcome)); got != want {
+					t.Errorf("got %v requests with outcome %s, want %v", got, outcome, want)
+				}
+			}
+			if got := sampleCount(t, recorder, "admission_review_duration_seconds"); got != 1 {
+				t.Errorf("got %d observed request durations, want 1", got)
+			}
+		})
+	}
+}
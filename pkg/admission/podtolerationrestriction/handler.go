@@ -22,25 +22,19 @@ const (
 )
 
 var (
-	podResource = metaV1.GroupVersionResource{Version: "v1", Resource: "pods"}
+	podKind = metaV1.GroupVersionKind{Version: "v1", Kind: "Pod"}
 )
 
 func Register(ctrl admit.AdmissionController) {
-	ctrl.Register(handlerName, handler)
+	ctrl.RegisterForGVK(handlerName, podKind, handler)
 }
 
 // Handling pod toleration restriction request
 func handler(req *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
-	if req.Resource != podResource {
-		log.Printf("Ignore admission request %s as it's not a pod resource", string(req.UID))
-		return nil, nil
-	}
-
 	// Parse the Pod object.
-	raw := req.Object.Raw
 	pod := coreV1.Pod{}
-	if _, _, err := admit.UniversalDeserializer.Decode(raw, nil, &pod); err != nil {
-		return nil, fmt.Errorf("could not deserialize pod object: %v", err)
+	if err := admit.DecodeObject(req, &pod); err != nil {
+		return nil, err
 	}
 
 	// Get the pod name for info
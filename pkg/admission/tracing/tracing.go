@@ -0,0 +1,84 @@
+/**
+ * OpenTelemetry tracing for the admission controller.
+ */
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	admissionV1 "k8s.io/api/admission/v1"
+)
+
+// tracerName is the name of the instrumentation the tracer is obtained for.
+const tracerName = "github.com/52north/admission-webhook-server/pkg/admission/tracing"
+
+// Span attributes
+const (
+	attrUID       = attribute.Key("admission.uid")
+	attrKind      = attribute.Key("admission.kind")
+	attrNamespace = attribute.Key("admission.namespace")
+	attrOperation = attribute.Key("admission.operation")
+	attrHandler   = attribute.Key("admission.handler")
+	attrAllowed   = attribute.Key("admission.allowed")
+	attrPatchOps  = attribute.Key("admission.patch_operations")
+)
+
+// Tracer is an admit.Tracer recording OpenTelemetry spans. The spans of webhook requests continue the traces
+// propagated by the apiserver, and the spans are passed to the handlers through their context, so requests they make
+// can be traced as well.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer creates a Tracer recording spans with a tracer of the provider.
+func NewTracer(provider trace.TracerProvider) *Tracer {
+	return &Tracer{tracer: provider.Tracer(tracerName)}
+}
+
+// StartRequest starts the server span of a webhook request, continuing the trace propagated in its headers if any.
+func (t *Tracer) StartRequest(r *http.Request) (context.Context, admit.Span) {
+	ctx := propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, s := t.tracer.Start(ctx, "admission "+r.URL.Path, trace.WithSpanKind(trace.SpanKindServer))
+	return ctx, span{s}
+}
+
+// StartHandler starts the span of a handler run as child of the request span.
+func (t *Tracer) StartHandler(ctx context.Context, handler string) (context.Context, admit.Span) {
+	ctx, s := t.tracer.Start(ctx, "admission handler "+handler, trace.WithAttributes(attrHandler.String(handler)))
+	return ctx, span{s}
+}
+
+// span is an admit.Span recording attributes of an OpenTelemetry span.
+type span struct {
+	span trace.Span
+}
+
+// SetRequest sets the attributes identifying the request.
+func (s span) SetRequest(req *admissionV1.AdmissionRequest) {
+	s.span.SetAttributes(
+		attrUID.String(string(req.UID)),
+		attrKind.String(req.Kind.String()),
+		attrNamespace.String(req.Namespace),
+		attrOperation.String(string(req.Operation)),
+	)
+}
+
+// SetDecision sets the attributes describing the response.
+func (s span) SetDecision(allowed bool, patchOperations int) {
+	s.span.SetAttributes(attrAllowed.Bool(allowed), attrPatchOps.Int(patchOperations))
+}
+
+// End ends the span, recording err as error status.
+func (s span) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
@@ -0,0 +1,162 @@
+package tracing_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	"github.com/52north/admission-webhook-server/pkg/admission/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkTrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	admissionV1 "k8s.io/api/admission/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// traceParent is a W3C trace context propagated by the apiserver.
+const traceParent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+// reviewBody returns a review of a CREATE request for a pod.
+func reviewBody(t *testing.T) []byte {
+	t.Helper()
+	body, err := json.Marshal(&admissionV1.AdmissionReview{
+		TypeMeta: metaV1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionV1.AdmissionRequest{
+			UID:       "uid",
+			Kind:      metaV1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  metaV1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Name:      "web",
+			Namespace: "default",
+			Operation: admissionV1.Create,
+			Object:    runtime.RawExtension{Raw: []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"web"}}`)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// attributes returns the attributes of the span by key.
+func attributes(span sdkTrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestTracer(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     func(t *testing.T) []byte
+		handler  admit.AdmitFuncCtx
+		wantAttr map[attribute.Key]attribute.Value
+		// wantHandler is set if a handler span is expected, wantError if the request span has an error status.
+		wantHandler bool
+		wantError   bool
+	}{
+		{
+			name: "allowed",
+			body: reviewBody,
+			handler: func(context.Context, *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				return new(admit.PatchBuilder).Add("/metadata/labels", map[string]string{"a": "b"}).Build(), nil
+			},
+			wantAttr: map[attribute.Key]attribute.Value{
+				"admission.uid":              attribute.StringValue("uid"),
+				"admission.kind":             attribute.StringValue("/v1, Kind=Pod"),
+				"admission.namespace":        attribute.StringValue("default"),
+				"admission.operation":        attribute.StringValue("CREATE"),
+				"admission.allowed":          attribute.BoolValue(true),
+				"admission.patch_operations": attribute.IntValue(1),
+			},
+			wantHandler: true,
+		},
+		{
+			name: "denied",
+			body: reviewBody,
+			handler: func(context.Context, *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+				return nil, errors.New("denied")
+			},
+			wantAttr: map[attribute.Key]attribute.Value{
+				"admission.allowed":          attribute.BoolValue(false),
+				"admission.patch_operations": attribute.IntValue(0),
+			},
+			wantHandler: true,
+		},
+		{
+			name:      "malformed review",
+			body:      func(*testing.T) []byte { return []byte("{") },
+			wantAttr:  map[attribute.Key]attribute.Value{},
+			wantError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			provider := sdkTrace.NewTracerProvider(sdkTrace.WithSpanProcessor(recorder))
+			ac := admit.New(admit.WithTracer(tracing.NewTracer(provider)))
+			var handlerSpan trace.SpanContext
+			if tt.handler != nil {
+				ac.RegisterCtx("handler", func(ctx context.Context, req *admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) {
+					handlerSpan = trace.SpanContextFromContext(ctx)
+					return tt.handler(ctx, req)
+				})
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(tt.body(t)))
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("traceparent", traceParent)
+			ac.ServeHTTP(httptest.NewRecorder(), r)
+
+			spans := map[string]sdkTrace.ReadOnlySpan{}
+			for _, span := range recorder.Ended() {
+				spans[span.Name()] = span
+			}
+			request, ok := spans["admission /mutate"]
+			if !ok {
+				t.Fatalf("got spans %v, want one for the request", spans)
+			}
+			if got := request.Parent().TraceID().String(); got != "0af7651916cd43dd8448eb211c80319c" || !request.Parent().IsRemote() {
+				t.Errorf("got parent trace %s, want the propagated one", got)
+			}
+			if request.SpanKind() != trace.SpanKindServer {
+				t.Errorf("got span kind %s, want server", request.SpanKind())
+			}
+			attrs := attributes(request)
+			for key, want := range tt.wantAttr {
+				if got := attrs[key]; got != want {
+					t.Errorf("got attribute %s %v, want %v", key, got.Emit(), want.Emit())
+				}
+			}
+			if got := request.Status().Code == codes.Error; got != tt.wantError {
+				t.Errorf("got error status %t, want %t", got, tt.wantError)
+			}
+
+			handler, ok := spans["admission handler handler"]
+			if ok != tt.wantHandler {
+				t.Fatalf("got handler span %t, want %t", ok, tt.wantHandler)
+			}
+			if !ok {
+				return
+			}
+			if handler.Parent().SpanID() != request.SpanContext().SpanID() {
+				t.Error("handler span is not a child of the request span")
+			}
+			if handlerSpan.SpanID() != handler.SpanContext().SpanID() {
+				t.Error("handler was not passed its span through the context")
+			}
+			if got := attributes(handler)["admission.handler"].AsString(); got != "handler" {
+				t.Errorf("got handler attribute %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package webhookconfig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// NewClient creates a clientset from the kubeconfig file, or from the in-cluster config if kubeconfig is empty.
+func NewClient(kubeconfig string) (kubernetes.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not load client config: %v", err)
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// InjectCABundle sets the CA bundle of all webhooks of the named MutatingWebhookConfiguration that point at the given
+// service. The configuration is patched, so other changes to it are preserved, and the patch fails if the webhooks
+// changed in between. Configurations without webhooks pointing at the service are left untouched.
+func InjectCABundle(ctx context.Context, client kubernetes.Interface, name, serviceName, serviceNamespace string, caBundle []byte) error {
+	configs := client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	config, err := configs.Get(ctx, name, metaV1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get webhook configuration %s: %v", name, err)
+	}
+
+	var ops []admit.PatchOperation
+	for i, webhook := range config.Webhooks {
+		service := webhook.ClientConfig.Service
+		if service == nil || service.Name != serviceName || service.Namespace != serviceNamespace {
+			continue
+		}
+		index := strconv.Itoa(i)
+		ops = append(ops,
+			admit.PatchOperation{Op: "test", Path: admit.Pointer("webhooks", index, "name"), Value: webhook.Name},
+			admit.PatchOperation{Op: "add", Path: admit.Pointer("webhooks", index, "clientConfig", "caBundle"), Value: caBundle})
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+
+	patchBytes, err := json.Marshal(ops)
+	if err != nil {
+		return fmt.Errorf("could not marshal JSON patch: %v", err)
+	}
+	if _, err := configs.Patch(ctx, name, types.JSONPatchType, patchBytes, metaV1.PatchOptions{}); err != nil {
+		return fmt.Errorf("could not patch webhook configuration %s: %v", name, err)
+	}
+	return nil
+}
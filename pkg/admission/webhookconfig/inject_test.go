@@ -0,0 +1,119 @@
+package webhookconfig_test
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	"github.com/52north/admission-webhook-server/pkg/admission/webhookconfig"
+	admissionregistrationV1 "k8s.io/api/admissionregistration/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// webhook returns a webhook named name pointing at the service.
+func webhook(name, serviceName, serviceNamespace string) admissionregistrationV1.MutatingWebhook {
+	return admissionregistrationV1.MutatingWebhook{
+		Name: name,
+		ClientConfig: admissionregistrationV1.WebhookClientConfig{
+			Service: &admissionregistrationV1.ServiceReference{Name: serviceName, Namespace: serviceNamespace},
+		},
+	}
+}
+
+func TestInjectCABundle(t *testing.T) {
+	caBundle := []byte("ca")
+	tests := []struct {
+		name     string
+		webhooks []admissionregistrationV1.MutatingWebhook
+		// want are the patch operations, nil if no patch is expected.
+		want []admit.PatchOperation
+	}{
+		{
+			name:     "all webhooks",
+			webhooks: []admissionregistrationV1.MutatingWebhook{webhook("a.example.com", "webhook", "infra"), webhook("b.example.com", "webhook", "infra")},
+			want: []admit.PatchOperation{
+				{Op: "test", Path: "/webhooks/0/name", Value: "a.example.com"},
+				{Op: "add", Path: "/webhooks/0/clientConfig/caBundle", Value: "Y2E="},
+				{Op: "test", Path: "/webhooks/1/name", Value: "b.example.com"},
+				{Op: "add", Path: "/webhooks/1/clientConfig/caBundle", Value: "Y2E="},
+			},
+		},
+		{
+			name: "other services skipped",
+			webhooks: []admissionregistrationV1.MutatingWebhook{
+				webhook("other.example.com", "other", "infra"),
+				webhook("namespace.example.com", "webhook", "default"),
+				{Name: "url.example.com"},
+				webhook("a.example.com", "webhook", "infra"),
+			},
+			want: []admit.PatchOperation{
+				{Op: "test", Path: "/webhooks/3/name", Value: "a.example.com"},
+				{Op: "add", Path: "/webhooks/3/clientConfig/caBundle", Value: "Y2E="},
+			},
+		},
+		{name: "no matching webhooks", webhooks: []admissionregistrationV1.MutatingWebhook{webhook("other.example.com", "other", "infra")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &admissionregistrationV1.MutatingWebhookConfiguration{
+				ObjectMeta: metaV1.ObjectMeta{Name: "webhook"},
+				Webhooks:   tt.webhooks,
+			}
+			client := fake.NewSimpleClientset(config)
+
+			if err := webhookconfig.InjectCABundle(context.Background(), client, "webhook", "webhook", "infra", caBundle); err != nil {
+				t.Fatal(err)
+			}
+
+			var patches []k8stesting.PatchAction
+			for _, action := range client.Actions() {
+				if patch, ok := action.(k8stesting.PatchAction); ok {
+					patches = append(patches, patch)
+				}
+			}
+			if tt.want == nil {
+				if len(patches) != 0 {
+					t.Fatalf("got %d patch calls, want none", len(patches))
+				}
+				return
+			}
+			if len(patches) != 1 {
+				t.Fatalf("got %d patch calls, want one", len(patches))
+			}
+			if patches[0].GetPatchType() != types.JSONPatchType || patches[0].GetName() != "webhook" {
+				t.Errorf("got %s patch of %s", patches[0].GetPatchType(), patches[0].GetName())
+			}
+			var got []admit.PatchOperation
+			if err := json.Unmarshal(patches[0].GetPatch(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got patch %v, want %v", got, tt.want)
+			}
+
+			patched, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), "webhook", metaV1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range patched.Webhooks {
+				service := w.ClientConfig.Service
+				matching := service != nil && service.Name == "webhook" && service.Namespace == "infra"
+				if got := string(w.ClientConfig.CABundle) == "ca"; got != matching {
+					t.Errorf("got CA bundle %q for webhook %s", w.ClientConfig.CABundle, w.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestInjectCABundleMissingConfig(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	if err := webhookconfig.InjectCABundle(context.Background(), client, "webhook", "webhook", "infra", []byte("ca")); err == nil {
+		t.Error("got no error for a missing configuration")
+	}
+}
@@ -0,0 +1,100 @@
+/**
+ * Generation of webhook configurations for the paths served by an admission controller.
+ */
+package webhookconfig
+
+import (
+	"strings"
+
+	admissionregistrationV1 "k8s.io/api/admissionregistration/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Config describes the webhooks of a generated MutatingWebhookConfiguration.
+type Config struct {
+	// Name is the name of the configuration. It has to be a fully qualified domain name, as it is used as the suffix
+	// of the webhook names.
+	Name string
+	// ServiceName and ServiceNamespace identify the service the controller is reachable at.
+	ServiceName      string
+	ServiceNamespace string
+	// CABundle is the PEM encoded CA bundle the serving certificate of the controller is validated with.
+	CABundle []byte
+	// FailurePolicy defaults to Ignore.
+	FailurePolicy admissionregistrationV1.FailurePolicyType
+	// Rules select the requests sent to the webhooks. They default to the creation of pods.
+	Rules []admissionregistrationV1.RuleWithOperations
+}
+
+// admissionReviewVersions are the AdmissionReview versions understood by the controller.
+var admissionReviewVersions = []string{"v1", "v1beta1"}
+
+// defaultRules select the creation of pods, which the bundled handlers admit.
+var defaultRules = []admissionregistrationV1.RuleWithOperations{{
+	Operations: []admissionregistrationV1.OperationType{admissionregistrationV1.Create},
+	Rule: admissionregistrationV1.Rule{
+		APIGroups:   []string{""},
+		APIVersions: []string{"*"},
+		Resources:   []string{"pods"},
+	},
+}}
+
+// Mutating creates a MutatingWebhookConfiguration with a webhook for each of the paths, e.g. the ones returned by
+// AdmissionController.Paths. The configuration has its TypeMeta set, so it can be marshaled to a manifest directly.
+// Each webhook gets its own copy of the rules and AdmissionReview versions, so they can be modified independently.
+func Mutating(cfg Config, paths []string) *admissionregistrationV1.MutatingWebhookConfiguration {
+	failurePolicy := cfg.FailurePolicy
+	if failurePolicy == "" {
+		failurePolicy = admissionregistrationV1.Ignore
+	}
+	rules := cfg.Rules
+	if rules == nil {
+		rules = defaultRules
+	}
+	sideEffects := admissionregistrationV1.SideEffectClassNone
+
+	config := &admissionregistrationV1.MutatingWebhookConfiguration{
+		TypeMeta: metaV1.TypeMeta{
+			APIVersion: admissionregistrationV1.SchemeGroupVersion.String(),
+			Kind:       "MutatingWebhookConfiguration",
+		},
+		ObjectMeta: metaV1.ObjectMeta{Name: cfg.Name},
+	}
+	for _, path := range paths {
+		path := path
+		config.Webhooks = append(config.Webhooks, admissionregistrationV1.MutatingWebhook{
+			Name: webhookName(path, cfg.Name),
+			ClientConfig: admissionregistrationV1.WebhookClientConfig{
+				Service: &admissionregistrationV1.ServiceReference{
+					Namespace: cfg.ServiceNamespace,
+					Name:      cfg.ServiceName,
+					Path:      &path,
+				},
+				CABundle: cfg.CABundle,
+			},
+			Rules:                   copyRules(rules),
+			FailurePolicy:           &failurePolicy,
+			SideEffects:             &sideEffects,
+			AdmissionReviewVersions: append([]string(nil), admissionReviewVersions...),
+		})
+	}
+	return config
+}
+
+// copyRules returns a deep copy of the rules.
+func copyRules(rules []admissionregistrationV1.RuleWithOperations) []admissionregistrationV1.RuleWithOperations {
+	copied := make([]admissionregistrationV1.RuleWithOperations, len(rules))
+	for i := range rules {
+		rules[i].DeepCopyInto(&copied[i])
+	}
+	return copied
+}
+
+// webhookName derives the name of the webhook serving the path, e.g. mutate-pods.<suffix> for /mutate-pods.
+func webhookName(path, suffix string) string {
+	prefix := strings.ReplaceAll(strings.Trim(path, "/"), "/", "-")
+	if prefix == "" {
+		return suffix
+	}
+	return prefix + "." + suffix
+}
@@ -0,0 +1,101 @@
+package webhookconfig_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/52north/admission-webhook-server/pkg/admission/admit"
+	"github.com/52north/admission-webhook-server/pkg/admission/webhookconfig"
+	admissionV1 "k8s.io/api/admission/v1"
+	admissionregistrationV1 "k8s.io/api/admissionregistration/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestMutating(t *testing.T) {
+	nop := func(*admissionV1.AdmissionRequest) ([]admit.PatchOperation, error) { return nil, nil }
+	ac := admit.New()
+	ac.Handle("/mutate-pods", "pods", nop)
+	ac.Handle("/mutate/ingress", "ingress", nop)
+
+	tests := []struct {
+		name              string
+		failurePolicy     admissionregistrationV1.FailurePolicyType
+		wantFailurePolicy admissionregistrationV1.FailurePolicyType
+	}{
+		{name: "default failure policy", wantFailurePolicy: admissionregistrationV1.Ignore},
+		{name: "failure policy", failurePolicy: admissionregistrationV1.Fail, wantFailurePolicy: admissionregistrationV1.Fail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := webhookconfig.Config{
+				Name:             "webhook.example.com",
+				ServiceName:      "webhook",
+				ServiceNamespace: "infra",
+				CABundle:         []byte("ca"),
+				FailurePolicy:    tt.failurePolicy,
+			}
+			config := webhookconfig.Mutating(cfg, ac.Paths())
+
+			wantNames := map[string]string{
+				"/mutate":         "mutate.webhook.example.com",
+				"/mutate-pods":    "mutate-pods.webhook.example.com",
+				"/mutate/ingress": "mutate-ingress.webhook.example.com",
+			}
+			if len(config.Webhooks) != len(wantNames) {
+				t.Fatalf("got %d webhooks, want one per path %v", len(config.Webhooks), ac.Paths())
+			}
+			for _, webhook := range config.Webhooks {
+				service := webhook.ClientConfig.Service
+				if service == nil || service.Path == nil {
+					t.Fatalf("webhook %s has no service path", webhook.Name)
+				}
+				if want := wantNames[*service.Path]; webhook.Name != want {
+					t.Errorf("got webhook %s for path %s, want %s", webhook.Name, *service.Path, want)
+				}
+				if service.Name != "webhook" || service.Namespace != "infra" || string(webhook.ClientConfig.CABundle) != "ca" {
+					t.Errorf("got client config %+v", webhook.ClientConfig)
+				}
+				if *webhook.FailurePolicy != tt.wantFailurePolicy {
+					t.Errorf("got failure policy %s, want %s", *webhook.FailurePolicy, tt.wantFailurePolicy)
+				}
+				if *webhook.SideEffects != admissionregistrationV1.SideEffectClassNone {
+					t.Errorf("got side effects %s", *webhook.SideEffects)
+				}
+				if !reflect.DeepEqual(webhook.AdmissionReviewVersions, []string{"v1", "v1beta1"}) {
+					t.Errorf("got review versions %v", webhook.AdmissionReviewVersions)
+				}
+			}
+
+			manifest, err := yaml.Marshal(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(manifest), "apiVersion: admissionregistration.k8s.io/v1\nkind: MutatingWebhookConfiguration\n") {
+				t.Errorf("got manifest without TypeMeta:\n%s", manifest)
+			}
+		})
+	}
+}
+
+func TestMutatingCopiesDefaults(t *testing.T) {
+	cfg := webhookconfig.Config{Name: "webhook.example.com", ServiceName: "webhook", ServiceNamespace: "infra"}
+	want := webhookconfig.Mutating(cfg, []string{"/mutate"}).Webhooks[0].DeepCopy()
+
+	// Modifying a webhook of one configuration must neither change the other webhooks nor later configurations.
+	config := webhookconfig.Mutating(cfg, []string{"/mutate", "/mutate-pods"})
+	modified := &config.Webhooks[0]
+	modified.Rules[0].Operations[0] = admissionregistrationV1.Delete
+	modified.Rules[0].Resources[0] = "deployments"
+	modified.Rules = append(modified.Rules, admissionregistrationV1.RuleWithOperations{})
+	modified.AdmissionReviewVersions[0] = "v2"
+
+	for _, webhook := range []admissionregistrationV1.MutatingWebhook{config.Webhooks[1], webhookconfig.Mutating(cfg, []string{"/mutate"}).Webhooks[0]} {
+		if !reflect.DeepEqual(webhook.Rules, want.Rules) {
+			t.Errorf("got rules %+v, want %+v", webhook.Rules, want.Rules)
+		}
+		if !reflect.DeepEqual(webhook.AdmissionReviewVersions, want.AdmissionReviewVersions) {
+			t.Errorf("got review versions %v, want %v", webhook.AdmissionReviewVersions, want.AdmissionReviewVersions)
+		}
+	}
+}